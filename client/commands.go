@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+)
+
+// command is a subcommand of the client, e.g. "client send".
+type command struct {
+	name    string
+	args    string // positional arguments, as shown in the usage
+	nArgs   int    // amount of positional arguments required
+	summary string
+	input   bool // whether it reads bets, so it takes the flags of the input
+	upload  bool // whether it takes the flags that tune uploads
+	run     func(ctx context.Context, client *lottery.Client, v *viper.Viper, args []string) error
+}
+
+// commands of the client. Running it without a command does what the agencies
+// do in docker compose: send the bets, notify the server and query the winners.
+var commands = []command{
+	{name: "send", summary: "send the bets file of the agency", input: true, upload: true, run: runSend},
+	{name: "notify", summary: "tell the server the agency sent all its bets", run: runNotify},
+	{name: "winners", summary: "query the winners of the agency, waiting for the draw", run: runWinners},
+	{name: "validate", args: "<file>", nArgs: 1, summary: "check the bets of a file, or - for stdin, without contacting the server", input: true, run: runValidate},
+	{name: "ping", summary: "check that the server answers", run: runPing},
+}
+
+// defaultCommand runs when no command is given.
+var defaultCommand = command{input: true, upload: true, run: run}
+
+// flagKeys maps each command line flag to the configuration key it overrides.
+var flagKeys = map[string]string{
+	"id":                   "id",
+	"server":               "server.address",
+	"log-level":            "log.level",
+	"file":                 "data.file",
+	"format":               "input.format",
+	"encoding":             "input.encoding",
+	"header":               "input.csv.header",
+	"batch-size":           "batch.maxAmount",
+	"in-flight":            "batch.inFlight",
+	"sequenced":            "batch.sequenced",
+	"persistent":           "connection.persistent",
+	"compression":          "compression.algorithm",
+	"state-dir":            "state.dir",
+	"restart-from-scratch": "checkpoint.restart",
+}
+
+// findCommand splits the command line arguments in the command to run and its own arguments.
+func findCommand(arguments []string) (command, []string, error) {
+	if len(arguments) == 0 || arguments[0] == "" || arguments[0][0] == '-' {
+		return defaultCommand, arguments, nil
+	}
+	for _, cmd := range commands {
+		if cmd.name == arguments[0] {
+			return cmd, arguments[1:], nil
+		}
+	}
+	return command{}, nil, fmt.Errorf("unknown command %q", arguments[0])
+}
+
+// flagSet returns the flags accepted by the command. Unset flags leave the value
+// of env variables and config.yaml untouched.
+func (cmd command) flagSet() *pflag.FlagSet {
+	name := "client"
+	if cmd.name != "" {
+		name += " " + cmd.name
+	}
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	flags.String("config", "./config.yaml", "configuration file")
+	flags.String("id", "", "agency ID")
+	flags.String("server", "", "server address, as host:port")
+	flags.String("log-level", "", "log level, e.g. DEBUG or INFO")
+	if cmd.input {
+		flags.String("format", "", "format of the bets: auto, csv, csv.gz or jsonl")
+		flags.String("encoding", "", "character set of the bets: utf-8, windows-1252, latin1 or auto")
+		flags.String("header", "", "whether CSV bets start with a header row: auto, true or false")
+	}
+	if cmd.upload {
+		flags.String("file", "", "bets file to send, - for stdin, /app/.data/agency-{ID}.csv by default")
+		flags.Int("batch-size", 0, "amount of bets per batch")
+		flags.Int("in-flight", 0, "batches sent without waiting for the ack of the previous ones")
+		flags.Bool("sequenced", false, "number the batches, so the server stores them only once")
+		flags.Bool("persistent", false, "reuse a single connection for every message")
+		flags.String("compression", "", "compress batches with none, gzip or flate, if the server supports it")
+		flags.String("state-dir", "", "directory of the upload checkpoint and the rejects report")
+		flags.Bool("restart-from-scratch", false, "discard the upload checkpoint and send the bets file from the first line")
+	}
+	flags.Usage = func() {
+		usage := name + " [flags]"
+		if cmd.args != "" {
+			usage = name + " " + cmd.args + " [flags]"
+		}
+		fmt.Fprintf(os.Stderr, "Usage: %s\n\nFlags:\n%s", usage, flags.FlagUsages())
+		if cmd.name == "" {
+			printCommands()
+		}
+	}
+	return flags
+}
+
+// printCommands prints the list of commands of the client.
+func printCommands() {
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", cmd.name+" "+cmd.args, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nWithout a command the bets file is sent, the server notified and the winners queried.\n")
+}
+
+// dataFile returns the path of the bets file of the agency.
+func dataFile(v *viper.Viper) string {
+	if file := v.GetString("data.file"); file != "" {
+		return file
+	}
+	return fmt.Sprintf("/app/.data/agency-%s.csv", v.GetString("id"))
+}
+
+// run sends the bets file of the agency in batches, tells the server the agency
+// is done and queries its winners. Canceling ctx, e.g. on SIGTERM or SIGINT,
+// stops the run at any step: batches already in flight get the shutdown grace
+// period to be acknowledged, connections are closed and common.ErrInterrupted
+// is returned.
+func run(ctx context.Context, client *lottery.Client, v *viper.Viper, args []string) error {
+	id := v.GetString("id")
+
+	// 1) Read the CSV and send its bets in batches.
+	ack, err := submit(ctx, client, v)
+	if err != nil {
+		return err
+	}
+	if ack.Stored == 0 {
+		// If the file is empty or has no valid bets.
+		log.Infof("action: no_bets_found | result: success | client_id: %v", id)
+		return nil
+	}
+
+	// 2) Notify the server that this agency finished sending bets.
+	if err := runNotify(ctx, client, v, nil); err != nil {
+		return err
+	}
+
+	// 3) Query the winners (if the server already did the draw, we get the results).
+	if err := runWinners(ctx, client, v, nil); err != nil {
+		return err
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	// 4) After everything, log "exit" so the tests can detect we ended properly.
+	log.Infof("action: exit | result: success | client_id: %s", id)
+	return nil
+}
+
+// runSend sends the bets file of the agency.
+func runSend(ctx context.Context, client *lottery.Client, v *viper.Viper, args []string) error {
+	_, err := submit(ctx, client, v)
+	return err
+}
+
+// submit sends the bets file of the agency and returns the ack of the server.
+func submit(ctx context.Context, client *lottery.Client, v *viper.Viper) (lottery.Ack, error) {
+	ack, err := client.SubmitFile(ctx, dataFile(v))
+	if ctx.Err() != nil {
+		return ack, interrupted(v.GetString("id"))
+	}
+	if err != nil {
+		log.Errorf("action: send_chunks | result: fail | error: %v", err)
+	}
+	return ack, err
+}
+
+// runNotify tells the server the agency sent all its bets.
+func runNotify(ctx context.Context, client *lottery.Client, v *viper.Viper, args []string) error {
+	if err := client.Finish(ctx); err != nil {
+		if ctx.Err() != nil {
+			return interrupted(v.GetString("id"))
+		}
+		return err
+	}
+	return nil
+}
+
+// runWinners queries the winners of the agency, polling until the draw is done.
+func runWinners(ctx context.Context, client *lottery.Client, v *viper.Viper, args []string) error {
+	if _, err := client.Winners(ctx); err != nil {
+		if ctx.Err() != nil {
+			return interrupted(v.GetString("id"))
+		}
+		return err
+	}
+	return nil
+}
+
+// runValidate checks the bets of the given file, logging every invalid one.
+// It fails with ErrInvalidBets if any.
+func runValidate(ctx context.Context, client *lottery.Client, v *viper.Viper, args []string) error {
+	valid, rejected, err := client.ValidateFile(args[0])
+	if err != nil {
+		log.Errorf("action: validate | result: fail | file: %s | error: %v", args[0], err)
+		return err
+	}
+	for _, bet := range rejected {
+		log.Warningf("action: validate_bet | result: fail | line: %d | bet: %s | error: %v", bet.Line, bet.Content, bet.Reason)
+	}
+	if len(rejected) > 0 {
+		log.Errorf("action: validate | result: fail | file: %s | valid_bets: %d | invalid_bets: %d", args[0], valid, len(rejected))
+		return ErrInvalidBets
+	}
+	log.Infof("action: validate | result: success | file: %s | valid_bets: %d", args[0], valid)
+	return nil
+}
+
+// runPing checks that the server answers a ping.
+func runPing(ctx context.Context, client *lottery.Client, v *viper.Viper, args []string) error {
+	rtt, err := client.Ping(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return interrupted(v.GetString("id"))
+		}
+		log.Errorf("action: ping | result: fail | server_address: %s | error: %v", v.GetString("server.address"), err)
+		return err
+	}
+	log.Infof("action: ping | result: success | server_address: %s | rtt: %v", v.GetString("server.address"), rtt.Round(time.Microsecond))
+	return nil
+}
+
+// interrupted logs the exit of a run stopped by a shutdown signal and returns common.ErrInterrupted.
+func interrupted(id string) error {
+	log.Infof("action: exit | result: success | client_id: %v | message: shutdown signal received", id)
+	return common.ErrInterrupted
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindCommand(t *testing.T) {
+	tests := []struct {
+		arguments []string
+		command   string // empty for the default command
+		rest      int    // arguments left for the command
+		fails     bool
+	}{
+		{arguments: nil},
+		{arguments: []string{"--id", "3"}, rest: 2},
+		{arguments: []string{"send", "--batch-size", "10"}, command: "send", rest: 2},
+		{arguments: []string{"validate", "bets.csv"}, command: "validate", rest: 1},
+		{arguments: []string{"ping"}, command: "ping"},
+		{arguments: []string{"draw"}, fails: true},
+	}
+	for _, tt := range tests {
+		cmd, rest, err := findCommand(tt.arguments)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("findCommand(%q) = %q, want an error", tt.arguments, cmd.name)
+			}
+			continue
+		}
+		if err != nil || cmd.name != tt.command || len(rest) != tt.rest {
+			t.Errorf("findCommand(%q) = %q, %q, %v, want %q with %d arguments", tt.arguments, cmd.name, rest, err, tt.command, tt.rest)
+		}
+	}
+}
+
+func TestCommandFlags(t *testing.T) {
+	// Only the commands that upload bets take the upload flags
+	for _, name := range []string{"", "send", "notify", "winners", "validate", "ping"} {
+		cmd := defaultCommand
+		if name != "" {
+			cmd, _, _ = findCommand([]string{name})
+		}
+		flags := cmd.flagSet()
+		if got := flags.Lookup("batch-size") != nil; got != cmd.upload {
+			t.Errorf("command %q takes --batch-size: %v, want %v", name, got, cmd.upload)
+		}
+		if flags.Lookup("server") == nil {
+			t.Errorf("command %q doesn't take --server", name)
+		}
+	}
+	cmd, _, _ := findCommand([]string{"notify"})
+	if err := cmd.flagSet().Parse([]string{"--batch-size", "10"}); err == nil {
+		t.Error("notify accepted --batch-size")
+	}
+}
+
+func TestInitConfigPrecedence(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(config, []byte(`
+id: "1"
+server:
+  address: "file:12345"
+log:
+  level: "DEBUG"
+loop:
+  period: "1s"
+batch:
+  maxAmount: 10
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CLI_SERVER_ADDRESS", "env:12345")
+	t.Setenv("CLI_LOG_LEVEL", "WARNING")
+
+	flags := defaultCommand.flagSet()
+	if err := flags.Parse([]string{"--config", config, "--log-level", "ERROR", "--batch-size", "20"}); err != nil {
+		t.Fatal(err)
+	}
+	v, err := InitConfig(flags)
+	if err != nil {
+		t.Fatalf("InitConfig() = %v", err)
+	}
+	want := map[string]string{
+		"id":              "1",         // unset flags leave the file value
+		"server.address":  "env:12345", // env over the file
+		"log.level":       "ERROR",     // flag over env and the file
+		"batch.maxAmount": "20",        // flag over the file
+	}
+	for key, value := range want {
+		if got := v.GetString(key); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package common
+
+import "time"
+
+// batchSizer picks the amount of bets of each batch. The size is fixed unless
+// adaptive sizing is enabled: then it grows while acks arrive within the target
+// latency and is halved when they take longer or the server rejects a batch.
+type batchSizer struct {
+	size     int
+	min      int
+	max      int
+	target   time.Duration
+	adaptive bool
+}
+
+// newBatchSizer creates the sizer described by config, starting at config.MaxBatch bets.
+func newBatchSizer(config ClientConfig) *batchSizer {
+	s := &batchSizer{
+		size:     config.MaxBatch,
+		min:      config.AdaptiveMinBatch,
+		max:      config.AdaptiveMaxBatch,
+		target:   config.AdaptiveTargetLatency,
+		adaptive: config.AdaptiveBatch,
+	}
+	if s.size < 1 {
+		s.size = 1
+	}
+	if s.min < 1 {
+		s.min = 1
+	}
+	if s.max < s.min {
+		s.max = s.min
+	}
+	if s.adaptive {
+		s.size = clamp(s.size, s.min, s.max)
+	}
+	return s
+}
+
+// Size returns the amount of bets of the next batch.
+func (s *batchSizer) Size() int {
+	return s.size
+}
+
+// Observe adjusts the size after a batch was acknowledged, given the latency of
+// its ack and whether the server rejected any of its bets.
+func (s *batchSizer) Observe(latency time.Duration, rejected bool) {
+	if !s.adaptive {
+		return
+	}
+	previous := s.size
+	switch {
+	case rejected || latency > s.target:
+		s.size = clamp(s.size/2, s.min, s.max)
+	default:
+		increase := s.size / 8
+		if increase < 1 {
+			increase = 1
+		}
+		s.size = clamp(s.size+increase, s.min, s.max)
+	}
+	if s.size != previous {
+		clientLog.Debugf("action: batch_size | result: success | size: %d | previous: %d | latency: %v | rejected: %v",
+			s.size, previous, latency, rejected)
+	}
+}
+
+func clamp(value int, min int, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
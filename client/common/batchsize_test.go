@@ -0,0 +1,178 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchSizer(t *testing.T) {
+	adaptive := ClientConfig{MaxBatch: 16, AdaptiveBatch: true, AdaptiveMinBatch: 4, AdaptiveMaxBatch: 20, AdaptiveTargetLatency: 100 * time.Millisecond}
+	type ack struct {
+		latency  time.Duration
+		rejected bool
+	}
+	tests := []struct {
+		name   string
+		config ClientConfig
+		acks   []ack
+		sizes  []int // size after each ack
+	}{
+		{
+			name:   "fixed",
+			config: ClientConfig{MaxBatch: 16},
+			acks:   []ack{{time.Millisecond, false}, {time.Second, false}, {time.Millisecond, true}},
+			sizes:  []int{16, 16, 16},
+		},
+		{
+			name:   "grows while acks are fast",
+			config: adaptive,
+			acks:   []ack{{time.Millisecond, false}, {time.Millisecond, false}, {time.Millisecond, false}},
+			sizes:  []int{18, 20, 20},
+		},
+		{
+			name:   "halves on slow acks",
+			config: adaptive,
+			acks:   []ack{{time.Second, false}, {time.Second, false}, {time.Second, false}},
+			sizes:  []int{8, 4, 4},
+		},
+		{
+			name:   "halves on rejections",
+			config: adaptive,
+			acks:   []ack{{time.Millisecond, true}, {time.Millisecond, false}},
+			sizes:  []int{8, 9},
+		},
+		{
+			name:   "starts within the bounds",
+			config: ClientConfig{MaxBatch: 100, AdaptiveBatch: true, AdaptiveMinBatch: 4, AdaptiveMaxBatch: 20, AdaptiveTargetLatency: time.Second},
+			acks:   []ack{{time.Millisecond, false}},
+			sizes:  []int{20},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sizer := newBatchSizer(tt.config)
+			for i, a := range tt.acks {
+				sizer.Observe(a.latency, a.rejected)
+				if sizer.Size() != tt.sizes[i] {
+					t.Fatalf("size after ack %d = %d, want %d", i+1, sizer.Size(), tt.sizes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBatchMaxBytes(t *testing.T) {
+	const maxBytes = 256
+	var input strings.Builder
+	for i := 1; i <= 20; i++ {
+		// Names of growing length, so the bets that fit in a batch vary
+		fmt.Fprintf(&input, "%s,Paz,%d,1990-01-01,%d\n", strings.Repeat("A", 5*i), i, i)
+	}
+	// A bet that can't fit in any batch on its own
+	fmt.Fprintf(&input, "%s,Paz,21,1990-01-01,21\n", strings.Repeat("B", maxBytes))
+
+	server := startStubServer(t, 0, ackAll)
+	dir := t.TempDir()
+	source := filepath.Join(dir, "agency-1.csv")
+	if err := os.WriteFile(source, []byte(input.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(ClientConfig{
+		ID:            "1",
+		ServerAddress: server.listener.Addr().String(),
+		MaxBatch:      100,
+		MaxBatchBytes: maxBytes,
+		Sequenced:     true,
+		Persistent:    true,
+	})
+	defer client.session.Close()
+
+	upload, err := client.SendFile(context.Background(), source)
+	if err != nil {
+		t.Fatalf("SendFile() = %v", err)
+	}
+	if upload.Stored != 20 {
+		t.Errorf("SendFile() = %d stored, want 20", upload.Stored)
+	}
+	bets := 0
+	payloads := server.received()
+	for _, payload := range payloads {
+		if len(payload) > maxBytes {
+			t.Errorf("batch of %d bytes, want at most %d", len(payload), maxBytes)
+		}
+		bets += strings.Count(payload, "\n") - 1
+	}
+	if bets != 20 || len(payloads) < 2 {
+		t.Errorf("sent %d bets in %d batches, want 20 bets in several batches", bets, len(payloads))
+	}
+	if len(upload.Rejected) != 1 || upload.Rejected[0].Line != 21 {
+		t.Errorf("rejected bets = %+v, want the oversized one", upload.Rejected)
+	}
+}
+
+func TestReplayPendingBatches(t *testing.T) {
+	const input = "Ana,Paz,1,1990-01-01,1\nLuis,Paz,2,1990-01-01,2\nEva,Paz,3,1990-01-01,3\nJuan,Paz,4,1990-01-01,4\n"
+	hash := sha256.Sum256([]byte(input))
+	server := startStubServer(t, 0, ackAll)
+	dir := t.TempDir()
+	source := filepath.Join(dir, "agency-1.csv")
+	if err := os.WriteFile(source, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(ClientConfig{
+		ID:            "1",
+		ServerAddress: server.listener.Addr().String(),
+		MaxBatch:      10,
+		Sequenced:     true,
+		Persistent:    true,
+		StateDir:      dir,
+		Checkpoint:    true,
+	})
+	defer client.session.Close()
+
+	// A previous run got the ack of line 1 and stopped with lines 2-3 in flight
+	// as batch 4, so they must be sent again as that same batch
+	checkpoint := Checkpoint{
+		Source:     source,
+		SourceHash: hex.EncodeToString(hash[:]),
+		Offset:     int64(len("Ana,Paz,1,1990-01-01,1\n")),
+		Line:       1,
+		Upload:     "u1",
+		Sequence:   1,
+		Sent:       1,
+		Pending:    []PendingBatch{{Line: 3, Sequence: 4}},
+	}
+	if err := checkpoint.Save(client.checkpointPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := client.SendFile(context.Background(), source)
+	if err != nil {
+		t.Fatalf("SendFile() = %v", err)
+	}
+	if upload.Stored != 4 {
+		t.Errorf("SendFile() = %d stored, want 4", upload.Stored)
+	}
+	want := []string{"agency_ID|1|upload|u1|seq|4", "agency_ID|1|upload|u1|seq|5"}
+	payloads := server.received()
+	if got := headers(payloads); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("batch headers = %q, want %q", got, want)
+	}
+	if bets := strings.Count(payloads[0], "\n") - 1; bets != 2 {
+		t.Errorf("replayed batch has %d bets, want lines 2-3", bets)
+	}
+	saved, err := LoadCheckpoint(client.checkpointPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Line != 4 || saved.Sequence != 5 || len(saved.Pending) != 0 {
+		t.Errorf("checkpoint = %+v, want line 4, sequence 5 and nothing pending", saved)
+	}
+}
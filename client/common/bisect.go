@@ -0,0 +1,81 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// Sequences of the parts of a bisected batch have the top bit set, so they never
+// collide with the sequences of regular batches. The parts are numbered as the
+// nodes of a binary tree whose root is the whole batch: the halves of node n are
+// 2n and 2n+1. Since both the numbering and the batch boundaries only depend on
+// the source, a part sent again after resuming an upload gets the same sequence
+// and is not stored twice.
+const (
+	partSequenceFlag = uint64(1) << 63
+	partNodeBits     = 20 // enough for batches of up to 2^19 bets
+)
+
+// partSequence returns the sequence of the given node of the bisected batch with
+// the given sequence, or zero for unsequenced batches.
+func partSequence(sequence uint64, node uint64) uint64 {
+	if sequence == 0 {
+		return 0
+	}
+	return partSequenceFlag | sequence<<partNodeBits | node
+}
+
+// sendBatch sends the batch of job. When the server rejects it, the batch is
+// split in halves that are sent on their own, recursively, until the rejected
+// bets are isolated. They are recorded in job.rejected while every other bet of
+// the batch gets stored.
+func (c *Client) sendBatch(ctx context.Context, session *Session, job *batchJob) error {
+	start := time.Now()
+	err := c.sendBatchWithRetry(ctx, session, job.request)
+	job.latency = time.Since(start)
+	if !errors.Is(err, protocol.ErrRejected) {
+		return err
+	}
+	clientLog.Warningf("action: bisect_batch | result: in_progress | client_id: %v | lines: %d-%d | batch_size: %d",
+		c.config.ID, job.lines[0], job.lines[len(job.lines)-1], len(job.lines))
+	return c.bisect(ctx, session, job, job.request.Lines, job.lines, 1)
+}
+
+// bisect isolates the rejected bets among lines, which were rejected as a
+// whole. node identifies lines in the tree of parts of job.
+func (c *Client) bisect(ctx context.Context, session *Session, job *batchJob, lines []string, lineNumbers []int, node uint64) error {
+	if len(lines) == 1 {
+		clientLog.Warningf("action: apuesta_rechazada | result: success | client_id: %v | line: %d", c.config.ID, lineNumbers[0])
+		job.rejected = append(job.rejected, RejectedBet{Line: lineNumbers[0], Content: lines[0], Reason: protocol.ErrRejected})
+		return nil
+	}
+
+	half := len(lines) / 2
+	parts := []struct {
+		lines       []string
+		lineNumbers []int
+		node        uint64
+	}{
+		{lines[:half], lineNumbers[:half], 2 * node},
+		{lines[half:], lineNumbers[half:], 2*node + 1},
+	}
+	for _, part := range parts {
+		request := &protocol.BatchRequest{
+			AgencyID: job.request.AgencyID,
+			Upload:   job.request.Upload,
+			Sequence: partSequence(job.request.Sequence, part.node),
+			Lines:    part.lines,
+		}
+		err := c.sendBatchWithRetry(ctx, session, request)
+		if errors.Is(err, protocol.ErrRejected) {
+			err = c.bisect(ctx, session, job, part.lines, part.lineNumbers, part.node)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
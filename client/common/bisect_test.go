@@ -0,0 +1,50 @@
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+func TestPartSequence(t *testing.T) {
+	tests := []struct {
+		sequence uint64
+		node     uint64
+		want     uint64
+	}{
+		{0, 2, 0},
+		{1, 2, 1<<63 | 1<<20 | 2},
+		{1, 3, 1<<63 | 1<<20 | 3},
+		{7, 13, 1<<63 | 7<<20 | 13},
+	}
+	seen := map[uint64]bool{}
+	for _, tt := range tests {
+		got := partSequence(tt.sequence, tt.node)
+		if got != tt.want {
+			t.Errorf("partSequence(%d, %d) = %x, want %x", tt.sequence, tt.node, got, tt.want)
+		}
+		if got != 0 && (seen[got] || got>>63 == 0) {
+			t.Errorf("partSequence(%d, %d) = %x collides with another batch", tt.sequence, tt.node, got)
+		}
+		seen[got] = true
+	}
+}
+
+func TestBisectedBatchStored(t *testing.T) {
+	// Bets isolated by the bisection are not stored, even for batches
+	// acknowledged after another one failed
+	errSend := errors.New("send fail")
+	p := &batchPipeline{acked: make(map[int]*batchJob), submitted: 3, onAck: func(*batchJob) error { return nil }}
+	jobs := []*batchJob{
+		{index: 0, request: &protocol.BatchRequest{Lines: make([]string, 4)}, rejected: make([]RejectedBet, 1)},
+		{index: 1, request: &protocol.BatchRequest{Lines: make([]string, 4)}},
+		{index: 2, request: &protocol.BatchRequest{Lines: make([]string, 4)}, rejected: make([]RejectedBet, 2)},
+	}
+	p.handle(batchResult{job: jobs[0]})
+	p.handle(batchResult{job: jobs[1], err: errSend})
+	p.handle(batchResult{job: jobs[2]})
+	if p.Stored() != 5 {
+		t.Errorf("Stored() = %d, want 5", p.Stored())
+	}
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Encoding is the character set of a bets source.
+type Encoding string
+
+// Encodings of a bets source. Records are converted to UTF-8 before being sent.
+const (
+	EncodingUTF8        Encoding = "utf-8"        // the default, records that are not valid UTF-8 are rejected
+	EncodingWindows1252 Encoding = "windows-1252" // as exported by most spreadsheets on Windows
+	EncodingLatin1      Encoding = "latin1"       // ISO-8859-1
+	EncodingAuto        Encoding = "auto"         // each record is kept if valid UTF-8, read as Windows-1252 otherwise
+)
+
+// ParseEncoding parses the name of an encoding, empty meaning EncodingUTF8.
+func ParseEncoding(name string) (Encoding, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "utf-8", "utf8":
+		return EncodingUTF8, nil
+	case "windows-1252", "cp1252":
+		return EncodingWindows1252, nil
+	case "latin1", "latin-1", "iso-8859-1":
+		return EncodingLatin1, nil
+	case "auto":
+		return EncodingAuto, nil
+	}
+	return EncodingUTF8, fmt.Errorf("unknown input encoding %q, expected utf-8, windows-1252, latin1 or auto", name)
+}
+
+// textDecoder converts the records of a source to UTF-8.
+type textDecoder func(raw string) (string, error)
+
+// newTextDecoder returns the decoder of records in the given encoding.
+func newTextDecoder(encoding Encoding) (textDecoder, error) {
+	encoding, err := ParseEncoding(string(encoding))
+	if err != nil {
+		return nil, err
+	}
+	switch encoding {
+	case EncodingWindows1252:
+		return charmapDecoder(charmap.Windows1252, encoding), nil
+	case EncodingLatin1:
+		return charmapDecoder(charmap.ISO8859_1, encoding), nil
+	case EncodingAuto:
+		fallback := charmapDecoder(charmap.Windows1252, EncodingWindows1252)
+		return func(raw string) (string, error) {
+			if utf8.ValidString(raw) {
+				return raw, checkControl(raw, EncodingUTF8)
+			}
+			return fallback(raw)
+		}, nil
+	}
+	return func(raw string) (string, error) {
+		for i, r := range raw {
+			if r == utf8.RuneError {
+				if _, size := utf8.DecodeRuneInString(raw[i:]); size == 1 {
+					return "", fmt.Errorf("invalid UTF-8 byte 0x%02X at column %d, set input.encoding if the file is not UTF-8", raw[i], i+1)
+				}
+			}
+		}
+		return raw, checkControl(raw, EncodingUTF8)
+	}, nil
+}
+
+// charmapDecoder returns a decoder of the single byte character set m.
+func charmapDecoder(m *charmap.Charmap, encoding Encoding) textDecoder {
+	return func(raw string) (string, error) {
+		var text strings.Builder
+		text.Grow(len(raw))
+		for i := 0; i < len(raw); i++ {
+			r := m.DecodeByte(raw[i])
+			if r == utf8.RuneError || isForbiddenControl(r) {
+				return "", fmt.Errorf("byte 0x%02X at column %d is not a %s character", raw[i], i+1, encoding)
+			}
+			text.WriteRune(r)
+		}
+		return text.String(), nil
+	}
+}
+
+// checkControl fails if text has control characters, which no bet field can
+// hold and usually come from reading a source in the wrong encoding.
+func checkControl(text string, encoding Encoding) error {
+	for i, r := range text {
+		if isForbiddenControl(r) {
+			return fmt.Errorf("control character %U at column %d is not valid %s text", r, i+1, encoding)
+		}
+	}
+	return nil
+}
+
+// isForbiddenControl reports whether r is a control character other than the
+// tab and the line breaks that may separate records and their fields.
+func isForbiddenControl(r rune) bool {
+	return unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r'
+}
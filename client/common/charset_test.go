@@ -0,0 +1,63 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTextDecoder(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding Encoding
+		raw      string
+		want     string
+		fails    bool
+	}{
+		{name: "windows-1252", encoding: EncodingWindows1252, raw: "Jos\xe9 \x80", want: "José €"},
+		{name: "latin1", encoding: EncodingLatin1, raw: "Jos\xe9", want: "José"},
+		{name: "utf-8", encoding: EncodingUTF8, raw: "José", want: "José"},
+		{name: "latin1 byte as utf-8", encoding: EncodingUTF8, raw: "Jos\xe9", fails: true},
+		{name: "auto keeps utf-8", encoding: EncodingAuto, raw: "José", want: "José"},
+		{name: "auto falls back to windows-1252", encoding: EncodingAuto, raw: "Jos\xe9", want: "José"},
+		{name: "control character", encoding: EncodingUTF8, raw: "Jos\x01", fails: true},
+		{name: "undefined windows-1252 byte", encoding: EncodingWindows1252, raw: "Jos\x81", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decode, err := newTextDecoder(tt.encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			text, err := decode(tt.raw)
+			if (err != nil) != tt.fails {
+				t.Fatalf("decode(%q) = %q, %v, want failure %v", tt.raw, text, err, tt.fails)
+			}
+			if !tt.fails && text != tt.want {
+				t.Errorf("decode(%q) = %q, want %q", tt.raw, text, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnknownEncoding(t *testing.T) {
+	if _, err := ParseEncoding("ebcdic"); err == nil {
+		t.Error("ParseEncoding(ebcdic) succeeded, want an error")
+	}
+	if _, err := NewBetSource(strings.NewReader("Ana,Paz,1,1990-01-01,1\n"), FormatCSV, "ebcdic", CSVSchema{}); err == nil {
+		t.Error("NewBetSource() with an unknown encoding succeeded, want an error")
+	}
+}
+
+func TestLatin1Source(t *testing.T) {
+	source, err := NewBetSource(strings.NewReader("Jos\xe9,Pe\xf1a,1,1990-01-01,1\n"), FormatCSV, EncodingLatin1, CSVSchema{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := source.Next()
+	if err != nil || record.Err != nil {
+		t.Fatalf("Next() = %+v, %v", record, err)
+	}
+	if record.Bet.FirstName != "José" || record.Bet.LastName != "Peña" {
+		t.Errorf("bet = %+v, want José Peña", record.Bet)
+	}
+}
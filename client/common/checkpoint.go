@@ -0,0 +1,108 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint records how much of a source file the server already acknowledged,
+// so an interrupted upload can resume after the last acknowledged batch instead
+// of sending the file again from the first line.
+type Checkpoint struct {
+	Source     string `json:"source"`      // path of the bets file
+	SourceHash string `json:"source_hash"` // sha256 of the bets file
+	Offset     int64  `json:"offset"`      // bytes of the uncompressed file covered by acknowledged batches
+	Line       int    `json:"line"`        // last line covered by acknowledged batches
+	Upload     string `json:"upload"`      // ID of the upload the sequences belong to
+	Sequence   uint64 `json:"sequence"`    // sequence number of the last acknowledged batch
+	Sent       int    `json:"sent"`        // bets acknowledged so far
+
+	// Sequenced batches sent after the acknowledged ones. A resumed upload ends
+	// its first batches at these same lines, so every batch the server may have
+	// stored keeps its sequence number and is not stored twice.
+	Pending []PendingBatch `json:"pending,omitempty"`
+}
+
+// PendingBatch is a batch of a checkpoint that was sent but not acknowledged yet.
+type PendingBatch struct {
+	Line     int    `json:"line"`     // last line covered by the batch
+	Sequence uint64 `json:"sequence"` // sequence number the batch was sent with
+}
+
+// lastSequence returns the highest sequence number the checkpoint knows was
+// used, acknowledged or not.
+func (c *Checkpoint) lastSequence() uint64 {
+	last := c.Sequence
+	for _, batch := range c.Pending {
+		if batch.Sequence > last {
+			last = batch.Sequence
+		}
+	}
+	return last
+}
+
+// LoadCheckpoint reads the checkpoint stored at path. It returns nil without
+// error if there is no checkpoint yet.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := &Checkpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, fmt.Errorf("corrupted checkpoint %s: %w", path, err)
+	}
+	return checkpoint, nil
+}
+
+// Save stores the checkpoint at path. The file is replaced atomically so a crash
+// while saving never leaves a partially written checkpoint behind.
+func (c *Checkpoint) Save(path string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// RemoveCheckpoint deletes the checkpoint stored at path, if any.
+func RemoveCheckpoint(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// hashFile returns the hex encoded sha256 of the content of file, leaving the
+// file offset at the beginning.
+func hashFile(file *os.File) (string, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
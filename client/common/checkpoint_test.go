@@ -0,0 +1,187 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckpointSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "agency-1.checkpoint")
+	saved := &Checkpoint{
+		Source:     "bets.csv",
+		SourceHash: "abc",
+		Offset:     120,
+		Line:       4,
+		Upload:     "0123456789abcdef",
+		Sequence:   2,
+		Sent:       4,
+	}
+	if err := saved.Save(path); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+	loaded, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("LoadCheckpoint() = %v", err)
+	}
+	if !reflect.DeepEqual(loaded, saved) {
+		t.Errorf("LoadCheckpoint() = %+v, want %+v", loaded, saved)
+	}
+}
+
+func TestCheckpointSaveReplaces(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agency-1.checkpoint")
+	first := &Checkpoint{Source: "bets.csv", Line: 2, Sequence: 1}
+	if err := first.Save(path); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+	second := &Checkpoint{Source: "bets.csv", Line: 4, Sequence: 2}
+	if err := second.Save(path); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+
+	loaded, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("LoadCheckpoint() = %v", err)
+	}
+	if !reflect.DeepEqual(loaded, second) {
+		t.Errorf("LoadCheckpoint() = %+v, want %+v", loaded, second)
+	}
+	// The temporary file is renamed over the checkpoint, never left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "agency-1.checkpoint" {
+		names := make([]string, len(entries))
+		for i, entry := range entries {
+			names[i] = entry.Name()
+		}
+		t.Errorf("state directory holds %v, want only the checkpoint", names)
+	}
+}
+
+func TestLoadCheckpointMissingOrCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agency-1.checkpoint")
+	if checkpoint, err := LoadCheckpoint(path); checkpoint != nil || err != nil {
+		t.Errorf("LoadCheckpoint() of a missing file = %+v, %v, want nil, nil", checkpoint, err)
+	}
+
+	// What a crash in the middle of a write would leave if it were not atomic
+	if err := os.WriteFile(path, []byte(`{"source":"bets.csv","offs`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCheckpoint(path); err == nil {
+		t.Error("LoadCheckpoint() of a truncated file succeeded")
+	}
+
+	if err := RemoveCheckpoint(path); err != nil {
+		t.Errorf("RemoveCheckpoint() = %v", err)
+	}
+	if err := RemoveCheckpoint(path); err != nil {
+		t.Errorf("RemoveCheckpoint() of a missing file = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("checkpoint still exists: %v", err)
+	}
+}
+
+func TestSendBetsFromCheckpoint(t *testing.T) {
+	const input = "Ana,Paz,1,1990-01-01,1\nLuis,Paz,2,1990-01-01,2\nEva,Paz,3,1990-01-01,3\n"
+	hash := sha256.Sum256([]byte(input))
+	// What a previous run that stopped after the ack of the first line leaves behind
+	interrupted := Checkpoint{
+		SourceHash: hex.EncodeToString(hash[:]),
+		Offset:     int64(len("Ana,Paz,1,1990-01-01,1\n")),
+		Line:       1,
+		Upload:     "u1",
+		Sequence:   1,
+		Sent:       1,
+	}
+
+	tests := []struct {
+		name    string
+		restart bool
+		hash    string // of the file when the checkpoint was saved, the real one if empty
+		sent    []string
+		total   int
+		fails   bool
+	}{
+		{
+			name:  "resume after the last ack",
+			sent:  []string{"agency_ID|1|upload|u1|seq|2", "agency_ID|1|upload|u1|seq|3"},
+			total: 3,
+		},
+		{
+			name:    "restart from scratch in a new upload",
+			restart: true,
+			sent:    []string{"agency_ID|1|upload|<new>|seq|1", "agency_ID|1|upload|<new>|seq|2", "agency_ID|1|upload|<new>|seq|3"},
+			total:   3,
+		},
+		{name: "file changed since the checkpoint", hash: "abc", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startStubServer(t, 0, ackAll)
+			dir := t.TempDir()
+			source := filepath.Join(dir, "agency-1.csv")
+			if err := os.WriteFile(source, []byte(input), 0644); err != nil {
+				t.Fatal(err)
+			}
+			client := NewClient(ClientConfig{
+				ID:                 "1",
+				ServerAddress:      server.listener.Addr().String(),
+				MaxBatch:           1,
+				Sequenced:          true,
+				Persistent:         true,
+				StateDir:           dir,
+				Checkpoint:         true,
+				RestartFromScratch: tt.restart,
+			})
+			defer client.session.Close()
+			checkpoint := interrupted
+			checkpoint.Source = source
+			if tt.hash != "" {
+				checkpoint.SourceHash = tt.hash
+			}
+			if err := checkpoint.Save(client.checkpointPath()); err != nil {
+				t.Fatal(err)
+			}
+
+			upload, err := client.SendFile(context.Background(), source)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("SendFile() = %+v, want an error", upload)
+				}
+				if got := server.received(); len(got) != 0 {
+					t.Errorf("sent %q, want nothing", got)
+				}
+				return
+			}
+			if err != nil || upload.Stored != tt.total {
+				t.Fatalf("SendFile() = %+v, %v, want %d stored", upload, err, tt.total)
+			}
+			if tt.restart && client.upload == "u1" {
+				t.Error("restarting from scratch kept the upload of the discarded checkpoint")
+			}
+			want := strings.ReplaceAll(strings.Join(tt.sent, "\n"), "<new>", client.upload)
+			if got := strings.Join(headers(server.received()), "\n"); got != want {
+				t.Errorf("batch headers = %q, want %q", got, want)
+			}
+			saved, err := LoadCheckpoint(client.checkpointPath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.Line != 3 || saved.Sent != 3 || saved.Upload != client.upload || saved.Sequence != client.lastSequence {
+				t.Errorf("checkpoint after the upload = %+v, want line 3, 3 sent in upload %s", saved, client.upload)
+			}
+		})
+	}
+}
@@ -2,15 +2,21 @@ package common
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net"
 	"os"
-	"os/signal"
+	"path/filepath"
 	"strconv"
-	"strings"
-	"syscall"
 	"time"
 
 	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
 )
 
 var clientLog = logging.MustGetLogger("clientLog")
@@ -21,270 +27,373 @@ type ClientConfig struct {
 	ServerAddress string
 	LoopAmount    int
 	LoopPeriod    time.Duration
-	MaxBatch      int // batch.maxAmount from config.yaml
+	MaxBatch      int  // batch.maxAmount from config.yaml, initial size when adaptive
+	MaxBatchBytes int  // batch.maxBytes from config.yaml, bound of the encoded batch, 0 means no bound
+	InFlight      int  // batch.inFlight from config.yaml
+	Sequenced     bool // batch.sequenced from config.yaml
+	Persistent    bool // connection.persistent from config.yaml
+
+	AdaptiveBatch         bool          // batch.adaptive.enabled from config.yaml
+	AdaptiveMinBatch      int           // batch.adaptive.min from config.yaml
+	AdaptiveMaxBatch      int           // batch.adaptive.max from config.yaml
+	AdaptiveTargetLatency time.Duration // batch.adaptive.targetLatency from config.yaml
+
+	// Retry policies from the retry section of config.yaml, the defaults are used when left unset
+	DialRetry    RetryPolicy // retry.dial, connecting to the server
+	SendRetry    RetryPolicy // retry.send, sending each batch
+	WinnersRetry RetryPolicy // retry.winners, polling the winners until the draw is done
+
+	DrawWait time.Duration // winners.wait from config.yaml, longest the server holds each winners query until the draw, 0 to only poll
+
+	// Timeouts of each operation with the server, zero means no timeout
+	DialTimeout  time.Duration // timeouts.dial from config.yaml
+	WriteTimeout time.Duration // timeouts.write from config.yaml
+	ReadTimeout  time.Duration // timeouts.read from config.yaml
+
+	TLS     *tls.Config // built from the tls section of config.yaml, nil for plain TCP
+	AuthKey []byte      // auth.secret from config.yaml, signs every request when set
+
+	Handshake bool // protocol.hello from config.yaml, negotiate the protocol with the server before the first message
+
+	Compression          string // compression.algorithm from config.yaml, protocol.FeatureGzip or protocol.FeatureFlate, empty for none
+	CompressionThreshold int    // compression.threshold from config.yaml, batches below it in bytes are sent uncompressed
+	Digest               string // integrity.digest from config.yaml, protocol.FeatureCRC32C or protocol.FeatureSHA256, empty for none
+
+	HeartbeatInterval time.Duration // heartbeat.interval from config.yaml, idle time before pinging persistent connections
+
+	ShutdownGrace time.Duration // shutdown.grace from config.yaml
+
+	InputFormat   Format    // input.format from config.yaml, detected from the file extension when FormatAuto
+	InputEncoding Encoding  // input.encoding from config.yaml, character set of the sources, UTF-8 by default
+	CSV           CSVSchema // input.csv from config.yaml, layout of CSV sources
+
+	StateDir           string // state.dir from config.yaml, holds checkpoints and rejects reports
+	Checkpoint         bool   // checkpoint.enabled from config.yaml
+	RestartFromScratch bool   // --restart-from-scratch flag
+
+	ThinkTime time.Duration // pause after handing each batch to the sender
+	Metrics   Metrics       // optional receiver of per batch outcomes
 }
 
-// Client handles reading bets from a CSV file and sending them in batches.
+// Client sends the bets of an agency to the server in batches, tells the server
+// when the agency is done and queries its winners. It is not safe for concurrent use.
 type Client struct {
-	config ClientConfig
+	config       ClientConfig
+	session      *Session
+	upload       string             // ID of the upload the sequences of the batches belong to
+	lastSequence uint64             // highest sequence number used, it never goes down
+	server       *protocol.HelloAck // what was agreed on with the server, nil before the hello exchange or without it
 }
 
 // NewClient initializes a new client receiving the configuration as a parameter.
 func NewClient(config ClientConfig) *Client {
-	return &Client{
-		config: config,
+	if config.DialRetry == (RetryPolicy{}) {
+		config.DialRetry = DefaultDialRetry
 	}
-}
-
-// StartClientBatch reads the file "agency-{ID}.csv", processes bets in chunks, and sends them to the server.
-func (c *Client) StartClientBatch() {
-	// 1) Handle SIGTERM
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM)
-	select {
-	case <-sigChan:
-		clientLog.Infof("action: exit | result: success | client_id: %v | message: SIGTERM received", c.config.ID)
-		return
-	default:
-		// no SIGTERM => proceed
+	if config.SendRetry == (RetryPolicy{}) {
+		config.SendRetry = DefaultSendRetry
 	}
-
-	// 2) Read CSV: "agency-{ID}.csv" and send the CSV data in batches.
-	filename := fmt.Sprintf("/app/.data/agency-%s.csv", c.config.ID)
-	total, err := c.sendBetsByChunks(filename)
-	if err != nil {
-		clientLog.Errorf("action: send_chunks | result: fail | error: %v", err)
-		return
+	if config.WinnersRetry == (RetryPolicy{}) {
+		config.WinnersRetry = DefaultWinnersRetry
 	}
-	if total == 0 {
-		// If the file is empty or has no valid bets.
-		clientLog.Infof("action: no_bets_found | result: success | client_id: %v", c.config.ID)
-		return
+	// Digests are only added once the server agreed on them in the hello
+	if !config.Handshake {
+		config.Digest = ""
 	}
-
-	// 3) Notify the server that this agency finished sending bets.
-	if err := c.NotifyFinished(); err != nil {
-		return
+	sessionConfig := config
+	sessionConfig.Digest = ""
+	return &Client{
+		config:  config,
+		session: NewSession(sessionConfig),
+		upload:  newUploadID(),
 	}
+}
 
-	// 4) Query the winners (if the server already did the draw, we get the results).
-	if err := c.QueryWinners(); err != nil {
-		return
+// newUploadID returns a random ID for the sequences of a new upload, so they
+// don't collide with the ones of earlier uploads of the agency.
+func newUploadID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
 	}
+	return hex.EncodeToString(id)
+}
 
-	time.Sleep(500 * time.Millisecond)
-
-	// 5) After everything, log "exit" so the tests can detect we ended properly.
-	clientLog.Infof("action: exit | result: success | client_id: %s", c.config.ID)
+// checkpointPath returns where the upload checkpoint of the agency is stored.
+func (c *Client) checkpointPath() string {
+	return filepath.Join(c.config.StateDir, fmt.Sprintf("agency-%s.checkpoint", c.config.ID))
 }
 
-// sendBetsByChunks opens the CSV file and reads it line by line.
-// Whenever the batch size c.config.MaxBatch is reached, it sends the batch
-// to the server using sendBatchAndAwaitResponse. Then it clears the in-memory
-// batch before continuing to read further lines.
-func (c *Client) sendBetsByChunks(filename string) (int, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return 0, err
+// loadProgress returns the checkpoint the upload of file must resume from. The
+// checkpoint is empty when checkpoints are disabled, when there is no previous
+// one or when a restart from scratch was requested. Restarting from scratch
+// starts a new upload, so the server doesn't take its batches for resends of
+// the discarded one, which it may have stored with the same sequences.
+// Resuming is refused if the file changed since the previous checkpoint was
+// saved, since its offsets and line numbers would no longer point to the same bets.
+func (c *Client) loadProgress(file *os.File, filename string) (*Checkpoint, error) {
+	if !c.config.Checkpoint {
+		return &Checkpoint{Source: filename}, nil
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	var batch []string
-	batchSize := c.config.MaxBatch
-	total := 0 // total lines sent
-
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
-		batch = append(batch, line)
 
-		// If the batch is full, send it to the server.
-		if len(batch) == batchSize {
-			if err := c.sendBatchWithRetry(batch); err != nil {
-				return total, err
-			}
-			total += len(batch)
-			// Reuse the slice without reallocating.
-			batch = batch[:0]
-		}
+	hash, err := hashFile(file)
+	if err != nil {
+		return nil, err
 	}
+	fresh := &Checkpoint{Source: filename, SourceHash: hash}
 
-	// Send the last partial batch (if any).
-	if len(batch) > 0 {
-		if err := c.sendBatchWithRetry(batch); err != nil {
-			return total, err
-		}
-		total += len(batch)
+	path := c.checkpointPath()
+	if c.config.RestartFromScratch {
+		c.upload = newUploadID()
+		clientLog.Infof("action: reset_checkpoint | result: success | client_id: %v | checkpoint: %s | upload: %s", c.config.ID, path, c.upload)
+		return fresh, RemoveCheckpoint(path)
 	}
 
-	// Check for any error that happened during scanning.
-	if err := scanner.Err(); err != nil {
-		return total, err
+	previous, err := LoadCheckpoint(path)
+	if err != nil {
+		return nil, err
 	}
+	if previous == nil {
+		return fresh, nil
+	}
+	if previous.SourceHash != hash {
+		return nil, fmt.Errorf("can't resume upload: %s changed since checkpoint %s was saved at line %d "+
+			"(sha256 was %s, now %s); run with --restart-from-scratch to send it again from the first line",
+			filename, path, previous.Line, previous.SourceHash, hash)
+	}
+	return previous, nil
+}
 
-	clientLog.Infof("action: all_batches_sent | result: success | client_id: %v | total_bets: %v",
-		c.config.ID, total)
-	return total, nil
+// saveProgress records that every line up to lineNumber, ending at offset, was
+// acknowledged by the server, the last batch being the one with the given sequence.
+func (c *Client) saveProgress(progress *Checkpoint, offset int64, lineNumber int, sequence uint64, total int) error {
+	if !c.config.Checkpoint {
+		return nil
+	}
+	progress.Offset = offset
+	progress.Line = lineNumber
+	progress.Sequence = sequence
+	progress.Sent = total
+	return c.saveCheckpoint(progress)
 }
 
-// sendBatchAndAwaitResponse builds the batch message and sends it using the transport function sendMessage.
-func (c *Client) sendBatchAndAwaitResponse(batch []string) error {
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("agency_ID|%s\n", c.config.ID))
-	for _, line := range batch {
-		sb.WriteString(line)
-		sb.WriteString("\n")
+// saveCheckpoint stores progress as the checkpoint of the upload.
+func (c *Client) saveCheckpoint(progress *Checkpoint) error {
+	if !c.config.Checkpoint {
+		return nil
 	}
-	messageBody := sb.String()
+	if err := progress.Save(c.checkpointPath()); err != nil {
+		return fmt.Errorf("save checkpoint: %w", err)
+	}
+	return nil
+}
 
-	conn, err := dialWithRetry(c.config.ServerAddress)
-	if err != nil {
-		return fmt.Errorf("connect fail: %w", err)
+// newBatchRequest builds the request for the given bet lines. When batches are
+// sequenced it takes the given sequence, that of a batch sent before, or the
+// next sequence number of the upload when it is zero.
+func (c *Client) newBatchRequest(lines []string, sequence uint64) *protocol.BatchRequest {
+	request := &protocol.BatchRequest{AgencyID: c.config.ID, Lines: lines}
+	if c.config.Sequenced {
+		if sequence == 0 {
+			c.lastSequence++
+			sequence = c.lastSequence
+		}
+		request.Upload = c.upload
+		request.Sequence = sequence
 	}
-	defer conn.Close()
+	return request
+}
 
-	response, err := sendMessage(conn, messageBody)
+// sendBatchAndAwaitResponse sends the batch request over session and waits for
+// the server ack. A duplicate ack means a previous attempt of this same batch was
+// already stored, so it counts as a success. A "fail|N" ack is returned as
+// protocol.ErrRejected, which is not retried. When frames carry digests, an ack
+// that doesn't echo the one of the batch fails with protocol.ErrCorrupted, so
+// the batch is sent again.
+func (c *Client) sendBatchAndAwaitResponse(ctx context.Context, session *Session, request *protocol.BatchRequest) error {
+	ack := &protocol.BatchAck{}
+	frame := &protocol.Compressed{Message: request, Algorithm: c.compression(), Threshold: c.config.CompressionThreshold}
+	var digest string
+	err := session.Do(ctx, func(conn net.Conn, reader *bufio.Reader) error {
+		if err := frame.Encode(conn); err != nil {
+			return err
+		}
+		digest = sentDigest(conn)
+		return ack.Decode(reader)
+	})
 	if err != nil {
 		return fmt.Errorf("send fail: %w", err)
 	}
-
-	// Parse response, expecting "success|N" or "fail|N".
-	parts := strings.Split(response, "|")
-	if len(parts) != 2 {
-		return fmt.Errorf("invalid server response: %s", response)
+	// An ack that doesn't echo the digest of the batch may belong to another
+	// one, or be damaged, so the batch is sent again instead of trusting it
+	if digest != "" && ack.Digest != digest && (ack.Success || ack.Digest != "") {
+		return fmt.Errorf("send fail: %w: ack digest %q does not match the batch digest %s", protocol.ErrCorrupted, ack.Digest, digest)
 	}
-	status := parts[0]
-	countStr := parts[1]
-	if _, convErr := strconv.Atoi(countStr); convErr != nil {
-		return fmt.Errorf("invalid count in server response: %s", response)
+	if frame.Applied {
+		clientLog.Debugf("action: compress_batch | result: success | algorithm: %s | bytes: %d | compressed_bytes: %d | ratio: %.2f",
+			frame.Algorithm, frame.RawSize, frame.Size, frame.Ratio())
 	}
 
-	if status == "success" {
-		clientLog.Infof("action: apuesta_enviada | result: success | batch_size: %s", countStr)
-	} else {
-		clientLog.Errorf("action: apuesta_enviada | result: fail | batch_size: %s", countStr)
+	switch {
+	case ack.Duplicate:
+		clientLog.Infof("action: apuesta_enviada | result: success | batch_size: %d | seq: %d | message: already stored",
+			ack.Count, request.Sequence)
+	case ack.Success && frame.Applied:
+		clientLog.Infof("action: apuesta_enviada | result: success | batch_size: %d | compression_ratio: %.2f", ack.Count, frame.Ratio())
+	case ack.Success:
+		clientLog.Infof("action: apuesta_enviada | result: success | batch_size: %d", ack.Count)
+	default:
+		clientLog.Errorf("action: apuesta_enviada | result: fail | batch_size: %d", ack.Count)
+		return fmt.Errorf("%w: batch of %d bets answered with fail|%d", protocol.ErrRejected, len(request.Lines), ack.Count)
 	}
 	return nil
 }
 
 // sendBatchWithRetry attempts to send a batch with retries in case of failure.
-// It wraps sendBatchAndAwaitResponse, retrying up to MaxRetries times with a delay of WaitTime between attempts.
-func (c *Client) sendBatchWithRetry(batch []string) error {
-	var err error
-	for attempt := 1; attempt <= MaxRetries; attempt++ {
-		err = c.sendBatchAndAwaitResponse(batch)
-		if err == nil {
-			// Successfully sent the batch.
-			return nil
+// It wraps sendBatchAndAwaitResponse, retrying as c.config.SendRetry says.
+// When batches are sequenced every attempt carries the same sequence number, so the
+// server stores the batch only once even if an ack gets lost.
+// It gives up as soon as ctx is done.
+func (c *Client) sendBatchWithRetry(ctx context.Context, session *Session, request *protocol.BatchRequest) error {
+	err := c.config.SendRetry.Retry(ctx, func(ctx context.Context, attempt int) error {
+		start := time.Now()
+		if err := c.sendBatchAndAwaitResponse(ctx, session, request); err != nil {
+			clientLog.Errorf("action: send_batch_retry | attempt: %d | result: fail | error: %v", attempt, err)
+			return err
 		}
-		clientLog.Errorf("action: send_batch_retry | attempt: %d | result: fail | error: %v", attempt, err)
-		time.Sleep(WaitTime)
+		// Successfully sent the batch.
+		if c.config.Metrics != nil {
+			c.config.Metrics.BatchAcked(len(request.Lines), time.Since(start))
+		}
+		return nil
+	}, func(attempt int, err error, delay time.Duration) {
+		if c.config.Metrics != nil {
+			c.config.Metrics.BatchRetried(err)
+		}
+	})
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	err = fmt.Errorf("failed to send batch: %w", err)
+	if c.config.Metrics != nil {
+		c.config.Metrics.BatchFailed(err)
 	}
-	return fmt.Errorf("failed to send batch after %d attempts: %w", MaxRetries, err)
+	return err
 }
 
 // NotifyFinished sends "notify_finished|<agency>" to tell the server we are done sending bets,
 // using persistent send/receive logic.
-func (c *Client) NotifyFinished() error {
-	conn, err := dialWithRetry(c.config.ServerAddress)
-	if err != nil {
-		clientLog.Criticalf("action: notify_connect | result: fail | error: %v", err)
+func (c *Client) NotifyFinished(ctx context.Context) error {
+	if err := c.negotiate(ctx); err != nil {
 		return err
 	}
-	defer conn.Close()
-
-	message := fmt.Sprintf("notify_finished|%s\n", c.config.ID)
-	response, err := sendMessage(conn, message)
-	if err != nil {
-		clientLog.Errorf("action: notify_receive | result: fail | error: %v", err)
+	request := &protocol.NotifyFinished{AgencyID: c.config.ID}
+	if err := c.session.RoundTrip(ctx, request, &protocol.NotifyAck{}); err != nil {
+		clientLog.Errorf("action: notify | result: fail | error: %v", err)
 		return err
 	}
-	if response != "ack_notify" {
-		clientLog.Errorf("action: notify | result: fail | unexpected response: %s", response)
-		return fmt.Errorf("unexpected response: %s", response)
-	}
 
 	clientLog.Infof("action: notify | result: success | client_id: %s", c.config.ID)
 	return nil
 }
 
-// QueryWinners retries several times until the draw (sorteo) is ready,
-// using persistent send/receive logic for the query message.
-func (c *Client) QueryWinners() error {
-	maxRetries := 30
-	wait := 1 * time.Second
-
-	for i := 0; i < maxRetries; i++ {
-		conn, err := dialWithRetry(c.config.ServerAddress)
-		if err != nil {
-			clientLog.Criticalf("action: query_connect | result: fail | error: %v", err)
-			return err
+// Winners polls the winners until the draw (sorteo) is ready, waiting between
+// queries as c.config.WinnersRetry says, using persistent send/receive logic for the query message.
+// Servers that agreed on protocol.FeatureWaitDraw hold each query until the
+// draw is done, for up to c.config.DrawWait, so there is no need to poll
+// while the draw is not ready; with the rest the queries are polled.
+// It returns the documents of the winning bets of the agency.
+func (c *Client) Winners(ctx context.Context) ([]string, error) {
+	if err := c.negotiate(ctx); err != nil {
+		return nil, err
+	}
+	wait := c.config.DrawWait > 0 && c.server != nil && c.server.Has(protocol.FeatureWaitDraw)
+	var winners []string
+	err := c.config.WinnersRetry.Retry(ctx, func(ctx context.Context, attempt int) error {
+		var reply protocol.Message
+		exchange := func(request protocol.Message) func(conn net.Conn, reader *bufio.Reader) error {
+			return func(conn net.Conn, reader *bufio.Reader) error {
+				if err := request.Encode(conn); err != nil {
+					return err
+				}
+				var err error
+				reply, err = protocol.ReadWinnersReply(reader)
+				return err
+			}
 		}
-
-		message := fmt.Sprintf("query_winners|%s\n", c.config.ID)
-		// Build and send the query message.
-		data := []byte(message)
-		header := fmt.Sprintf("%d;", len(data))
-		fullMessage := []byte(header)
-		fullMessage = append(fullMessage, data...)
-		if err := writeFull(conn, fullMessage); err != nil {
-			clientLog.Errorf("action: query_send | result: fail | error: %v", err)
-			conn.Close()
-			return err
+		var err error
+		if wait {
+			timeout := c.drawWait(ctx)
+			clientLog.Debugf("action: wait_draw | result: in_progress | client_id: %v | timeout: %v", c.config.ID, timeout)
+			err = c.session.DoWaiting(ctx, timeout, exchange(&protocol.WaitDraw{AgencyID: c.config.ID, Timeout: timeout}))
+		} else {
+			err = c.session.Do(ctx, exchange(&protocol.QueryWinners{AgencyID: c.config.ID}))
 		}
-
-		reader := bufio.NewReader(conn)
-		headerResponse, err := readResponseWithRetry(reader)
 		if err != nil {
-			clientLog.Errorf("action: query_receive_header | result: fail | error: %v", err)
-			conn.Close()
 			return err
 		}
-		headerResponse = strings.TrimSpace(headerResponse)
-
-		if strings.HasPrefix(headerResponse, "in_progress-sorteo_no_listo") {
-			clientLog.Infof("action: consulta_ganadores | result: in_progress | reason: %s. Retrying...", headerResponse)
-			conn.Close()
-			time.Sleep(wait)
-			continue
-		}
 
-		if strings.HasPrefix(headerResponse, "fail-") {
-			clientLog.Errorf("action: consulta_ganadores | result: fail | reason: %s", headerResponse)
-			conn.Close()
-			return nil
+		switch r := reply.(type) {
+		case *protocol.DrawNotReady:
+			return protocol.ErrDrawNotReady
+		case *protocol.QueryFailed:
+			return fmt.Errorf("%w: winners query failed: %s", protocol.ErrRejected, r.Reason)
+		case *protocol.WinnersResponse:
+			for _, document := range r.Documents {
+				clientLog.Infof("winner document: %s", document)
+			}
+			clientLog.Infof("action: consulta_ganadores | result: success | cant_ganadores: %d", len(r.Documents))
+			winners = r.Documents
 		}
-
-		parts := strings.Split(headerResponse, "|")
-		if len(parts) != 2 || parts[0] != "ok" {
-			conn.Close()
-			return fmt.Errorf("invalid response from server: %s", headerResponse)
+		return nil
+	}, func(attempt int, err error, delay time.Duration) {
+		if !errors.Is(err, protocol.ErrDrawNotReady) {
+			clientLog.Warningf("action: consulta_ganadores | result: in_progress | error: %v | retry_in: %v", err, delay.Round(time.Millisecond))
+			return
 		}
-		count, err := strconv.Atoi(parts[1])
-		if err != nil {
-			conn.Close()
-			return fmt.Errorf("invalid count in response: %s", parts[1])
+		clientLog.Infof("action: consulta_ganadores | result: in_progress | reason: draw not ready. Retrying in %v...", delay.Round(time.Millisecond))
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			clientLog.Errorf("action: consulta_ganadores | result: fail | error: %v", err)
 		}
+		return nil, err
+	}
+	return winners, nil
+}
 
-		// Read the winner documents.
-		for j := 0; j < count; j++ {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				clientLog.Errorf("failed reading winner %d: %v", j+1, err)
-				conn.Close()
-				return err
-			}
-			line = strings.TrimSpace(line)
-			clientLog.Infof("winner document: %s", line)
+// drawWait returns how long the server may hold a WaitDraw: c.config.DrawWait,
+// or less if ctx ends before.
+func (c *Client) drawWait(ctx context.Context) time.Duration {
+	wait := c.config.DrawWait
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < wait {
+			wait = left
 		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
 
-		clientLog.Infof("action: consulta_ganadores | result: success | cant_ganadores: %d", count)
-		conn.Close()
-		return nil
+// Ping checks that the server is reachable and answers, returning the round
+// trip time of a ping. Servers without ping support answer with a protocol error.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	if err := c.negotiate(ctx); err != nil {
+		return 0, err
+	}
+	if !c.supports(protocol.FeaturePing) {
+		return 0, fmt.Errorf("%w: the server does not support ping", protocol.ErrProtocol)
 	}
+	start := time.Now()
+	if err := c.session.RoundTrip(ctx, &protocol.Ping{}, &protocol.Pong{}); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
 
-	return fmt.Errorf("exceeded maxRetries waiting for the draw (sorteo) to be ready")
+// Close closes the connection to the server, if any.
+func (c *Client) Close() error {
+	return c.session.Close()
 }
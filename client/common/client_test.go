@@ -0,0 +1,63 @@
+package common
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// ackAll answers every batch with a success ack for all its bets.
+func ackAll(payload []byte) protocol.Message {
+	return &protocol.BatchAck{Success: true, Count: strings.Count(string(payload), "\n") - 1}
+}
+
+// headers returns the header line of every batch payload.
+func headers(payloads []string) []string {
+	var headers []string
+	for _, payload := range payloads {
+		headers = append(headers, payload[:strings.IndexByte(payload, '\n')])
+	}
+	return headers
+}
+
+func TestBatchSequences(t *testing.T) {
+	server := startStubServer(t, 0, ackAll)
+	source := filepath.Join(t.TempDir(), "agency-1.csv")
+	if err := os.WriteFile(source, []byte("Ana,Paz,1,1990-01-01,1\nLuis,Paz,2,1990-01-01,2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	send := func(client *Client) {
+		t.Helper()
+		if _, err := client.SendFile(context.Background(), source); err != nil {
+			t.Fatalf("SendFile() = %v", err)
+		}
+	}
+	config := ClientConfig{ID: "1", ServerAddress: server.listener.Addr().String(), MaxBatch: 1, Sequenced: true, Persistent: true}
+	first, second := NewClient(config), NewClient(config)
+	defer first.session.Close()
+	defer second.session.Close()
+
+	// Sending the file twice must not reuse the sequences of the first time,
+	// and another client of the same agency numbers its batches under its own upload
+	send(first)
+	send(first)
+	send(second)
+	want := []string{
+		"agency_ID|1|upload|" + first.upload + "|seq|1",
+		"agency_ID|1|upload|" + first.upload + "|seq|2",
+		"agency_ID|1|upload|" + first.upload + "|seq|3",
+		"agency_ID|1|upload|" + first.upload + "|seq|4",
+		"agency_ID|1|upload|" + second.upload + "|seq|1",
+		"agency_ID|1|upload|" + second.upload + "|seq|2",
+	}
+	if got := headers(server.received()); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("batch headers = %q, want %q", got, want)
+	}
+	if first.upload == second.upload {
+		t.Errorf("both clients use upload %q", first.upload)
+	}
+}
@@ -1,82 +1,79 @@
 package common
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"net"
-	"strings"
 	"time"
 
 	"github.com/op/go-logging"
 )
 
-const (
-	MaxRetries = 3
-	WaitTime   = 1 * time.Second
-)
-
 var comunicationLog = logging.MustGetLogger("log")
 
-// writeFull ensures that the entire data slice is written to the connection.
-// It loops until all bytes have been sent or an error occurs.
-func writeFull(conn net.Conn, data []byte) error {
-	totalWritten := 0
-	for totalWritten < len(data) {
-		n, err := conn.Write(data[totalWritten:])
-		if err != nil {
-			return err
+// dialWithRetry tries to establish a connection, retrying as the policy says.
+// Each attempt is bounded by timeout, if positive, and fails with a *TimeoutError
+// when it expires. With tlsConfig the TLS handshake is part of the attempt; a
+// failed handshake is not retried. It gives up as soon as ctx is done.
+func dialWithRetry(ctx context.Context, address string, policy RetryPolicy, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	err := policy.Retry(ctx, func(ctx context.Context, attempt int) error {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, timeout)
 		}
-		totalWritten += n
-	}
-	return nil
-}
+		defer cancel()
 
-// readResponseWithRetry attempts to read a line from the buffered reader with retries.
-// This makes the reading process persistent in case of transient errors.
-func readResponseWithRetry(reader *bufio.Reader) (string, error) {
-	var response string
-	var err error
-	for attempt := 1; attempt <= MaxRetries; attempt++ {
-		response, err = reader.ReadString('\n')
-		if err == nil || err == io.EOF {
-			return response, nil
+		var err error
+		conn, err = dialer.DialContext(attemptCtx, "tcp", address)
+		if err == nil && tlsConfig != nil {
+			conn, err = handshake(attemptCtx, conn, address, tlsConfig)
+		}
+		var netErr net.Error
+		if err != nil && ctx.Err() == nil && (attemptCtx.Err() != nil || errors.As(err, &netErr) && netErr.Timeout()) {
+			return &TimeoutError{Op: "dial", Duration: timeout, Err: err}
+		}
+		return err
+	}, func(attempt int, err error, delay time.Duration) {
+		comunicationLog.Errorf("action: dial_retry | result: in_progress | attempt: %d | retry_in: %v | error: %v", attempt, delay, err)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
 		}
-		comunicationLog.Errorf("action: read_response_retry | attempt: %d | error: %v", attempt, err)
-		time.Sleep(WaitTime)
+		return nil, fmt.Errorf("failed to dial: %w", err)
 	}
-	return response, err
+	return conn, nil
 }
 
-// dialWithRetry tries to establish a connection with retries.
-func dialWithRetry(address string) (net.Conn, error) {
-	var conn net.Conn
-	var err error
-	for attempt := 1; attempt <= MaxRetries; attempt++ {
-		conn, err = net.Dial("tcp", address)
-		if err == nil {
-			return conn, nil
-		}
-        comunicationLog.Errorf("action: dial_retry | result: in_progress | attempt: %d | error: %v", attempt, err)
-		time.Sleep(WaitTime)
+// sleepContext pauses for d, returning ctx.Err() early if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return nil, fmt.Errorf("failed to dial after %d attempts: %w", MaxRetries, err)
 }
 
-// sendMessage builds a message with a length header and sends it over the connection,
-// then reads the response using persistent read logic.
-func sendMessage(conn net.Conn, message string) (string, error) {
-	data := []byte(message)
-	header := fmt.Sprintf("%d;", len(data))
-	fullMessage := []byte(header)
-	fullMessage = append(fullMessage, data...)
-	if err := writeFull(conn, fullMessage); err != nil {
-		return "", err
-	}
-	reader := bufio.NewReader(conn)
-	response, err := readResponseWithRetry(reader)
-	if err != nil {
-		return "", err
-	}
-	return strings.TrimSpace(response), nil
+// withGrace returns a context that is canceled grace after parent is done, so
+// work already started can finish, or when the returned cancel is called.
+// Values of parent are not inherited.
+func withGrace(parent context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-parent.Done():
+			if sleepContext(ctx, grace) == nil {
+				cancel()
+			}
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
 }
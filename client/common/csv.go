@@ -0,0 +1,241 @@
+package common
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// BetFields are the fields of a bet, as named in the header of CSV sources and
+// in JSON Lines sources, in the order of the default CSV layout.
+var BetFields = []string{"first_name", "last_name", "document", "birthdate", "number"}
+
+// HeaderMode says whether CSV sources start with a header row.
+type HeaderMode string
+
+// Header modes of a CSVSchema.
+const (
+	HeaderAuto    HeaderMode = ""      // the first row is a header if it has the names of the columns
+	HeaderPresent HeaderMode = "true"  // the first row is always a header
+	HeaderAbsent  HeaderMode = "false" // there is no header, columns are found by position
+)
+
+// maxRecordLines bounds the lines of a CSV record, so a quote that is never
+// closed doesn't swallow the rest of the source into a single record.
+const maxRecordLines = 4
+
+// CSVSchema describes the layout of CSV sources. The zero value reads the
+// "first_name,last_name,document,birthdate,number" columns in that order,
+// skipping a first row holding those names.
+type CSVSchema struct {
+	Header    HeaderMode
+	Delimiter rune // ',' when zero
+
+	// Column of each bet field, keyed by the names in BetFields: either the name
+	// of the column in the header or its position, starting at 1. Fields left
+	// out are found by their own name in the header, or at their position in
+	// BetFields when there is no header.
+	Columns map[string]string
+}
+
+// ParseHeaderMode parses "auto", "true" or "false", empty meaning HeaderAuto.
+func ParseHeaderMode(name string) (HeaderMode, error) {
+	switch mode := HeaderMode(strings.ToLower(strings.TrimSpace(name))); mode {
+	case "auto", HeaderAuto:
+		return HeaderAuto, nil
+	case HeaderPresent, HeaderAbsent:
+		return mode, nil
+	}
+	return HeaderAuto, fmt.Errorf("invalid header mode %q, expected auto, true or false", name)
+}
+
+// Validate checks that the schema can be used.
+func (s CSVSchema) Validate() error {
+	if _, err := ParseHeaderMode(string(s.Header)); err != nil {
+		return err
+	}
+	if s.Delimiter != 0 && (s.Delimiter == '"' || s.Delimiter == '\r' || s.Delimiter == '\n') {
+		return fmt.Errorf("invalid CSV delimiter %q", s.Delimiter)
+	}
+	columns := map[string]string{}
+	for field, column := range s.Columns {
+		if fieldIndex(field) < 0 {
+			return fmt.Errorf("unknown bet field %q in CSV columns, expected one of %s", field, strings.Join(BetFields, ", "))
+		}
+		key := strings.ToLower(strings.TrimSpace(column))
+		if key == "" {
+			return fmt.Errorf("empty CSV column for %s", field)
+		}
+		if position, err := strconv.Atoi(key); err == nil && position < 1 {
+			return fmt.Errorf("invalid CSV column %d for %s, positions start at 1", position, field)
+		}
+		if other, ok := columns[key]; ok {
+			return fmt.Errorf("CSV column %q is mapped to both %s and %s", column, other, field)
+		}
+		columns[key] = field
+	}
+	if s.Header == HeaderAbsent {
+		for field, column := range s.Columns {
+			if _, err := strconv.Atoi(strings.TrimSpace(column)); err != nil {
+				return fmt.Errorf("CSV column %q of %s is a name, but sources have no header", column, field)
+			}
+		}
+	}
+	return nil
+}
+
+// fieldIndex returns the position of field in BetFields, or -1.
+func fieldIndex(field string) int {
+	for i, name := range BetFields {
+		if name == field {
+			return i
+		}
+	}
+	return -1
+}
+
+// csvDecoder parses the records of a CSV source laid out as its schema says.
+// The layout is resolved with the first record, which may be a header.
+type csvDecoder struct {
+	schema   CSVSchema
+	resolved bool
+	columns  []int // column of each bet field, in the order of BetFields
+	width    int   // fields every record must have, 0 when it only needs to reach every column
+}
+
+// newCSVDecoder returns a decoder of CSV records laid out as schema says.
+func newCSVDecoder(schema CSVSchema) *csvDecoder {
+	if schema.Delimiter == 0 {
+		schema.Delimiter = ','
+	}
+	return &csvDecoder{schema: schema}
+}
+
+// Complete reports whether record holds a whole CSV record, i.e. it doesn't end
+// within a quoted field that continues in the next line.
+func (d *csvDecoder) Complete(record string, lines int) bool {
+	if lines >= maxRecordLines || strings.Count(record, `"`)%2 == 0 {
+		return true
+	}
+	_, err := d.split(record)
+	return !errors.Is(err, csv.ErrQuote)
+}
+
+// Decode parses a record. The first one resolves the layout of the source, and
+// when it is a header it holds no bet, so header is true. So is it when the
+// layout can't be resolved, along with the error.
+func (d *csvDecoder) Decode(record string) (bet protocol.Bet, header bool, err error) {
+	fields, err := d.split(record)
+	if err != nil {
+		return protocol.Bet{}, false, err
+	}
+	if !d.resolved {
+		d.resolved = true
+		header, err = d.resolve(fields)
+		if header || err != nil {
+			return protocol.Bet{}, header, err
+		}
+	}
+
+	if d.width > 0 && len(fields) != d.width {
+		return protocol.Bet{}, false, fmt.Errorf("expected %d fields, got %d", d.width, len(fields))
+	}
+	values := make([]string, len(d.columns))
+	for i, column := range d.columns {
+		if column >= len(fields) {
+			return protocol.Bet{}, false, fmt.Errorf("missing %s: expected at least %d fields, got %d", BetFields[i], column+1, len(fields))
+		}
+		values[i] = fields[column]
+	}
+	bet, err = protocol.ParseBetFields(values)
+	return bet, false, err
+}
+
+// split parses the fields of a record.
+func (d *csvDecoder) split(record string) ([]string, error) {
+	reader := csv.NewReader(strings.NewReader(record))
+	reader.Comma = d.schema.Delimiter
+	reader.FieldsPerRecord = -1
+	fields, err := reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, fmt.Errorf("invalid CSV record: %w", parseErr.Err)
+		}
+		return nil, fmt.Errorf("invalid CSV record: %w", err)
+	}
+	return fields, nil
+}
+
+// resolve finds the column of every bet field given the first record of the
+// source, and reports whether that record is a header. Errors are returned as
+// headers, since no record can be read without knowing the columns.
+func (d *csvDecoder) resolve(first []string) (bool, error) {
+	names := map[string]int{}
+	for i, name := range first {
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff") // byte order mark of some spreadsheet exports
+		}
+		names[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	// Column of each field as the schema says, -1 for the ones given by name
+	positions := make([]int, len(BetFields))
+	wanted := make([]string, len(BetFields))
+	custom := false
+	for i, field := range BetFields {
+		column, ok := d.schema.Columns[field]
+		if !ok {
+			positions[i], wanted[i] = i, field
+			continue
+		}
+		custom = true
+		column = strings.ToLower(strings.TrimSpace(column))
+		if position, err := strconv.Atoi(column); err == nil {
+			positions[i], wanted[i] = position-1, field
+		} else {
+			positions[i], wanted[i] = -1, column
+		}
+	}
+
+	header := d.schema.Header == HeaderPresent
+	if d.schema.Header == HeaderAuto {
+		header = true
+		for _, name := range wanted {
+			if _, ok := names[name]; !ok {
+				header = false
+				break
+			}
+		}
+	}
+
+	d.columns = positions
+	if !header {
+		for i, position := range positions {
+			if position < 0 {
+				return true, fmt.Errorf("CSV column %q of %s is a name, but the source has no header", wanted[i], BetFields[i])
+			}
+		}
+		if !custom {
+			d.width = len(BetFields)
+		}
+		return false, nil
+	}
+
+	for i, position := range positions {
+		if position >= 0 && d.schema.Columns[BetFields[i]] != "" {
+			continue
+		}
+		column, ok := names[wanted[i]]
+		if !ok {
+			return true, fmt.Errorf("CSV header %q has no %q column for %s", strings.Join(first, string(d.schema.Delimiter)), wanted[i], BetFields[i])
+		}
+		d.columns[i] = column
+	}
+	d.width = len(first)
+	return true, nil
+}
@@ -0,0 +1,157 @@
+package common
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCSVSource(t *testing.T) {
+	tests := []struct {
+		name      string
+		schema    CSVSchema
+		input     string
+		documents []string // of the valid bets, in order
+		rejected  []int    // lines of the records that are not valid bets
+		fails     bool     // the layout of the source can't be resolved
+	}{
+		{
+			name:      "auto without header",
+			input:     "Ana,Paz,1,1990-01-01,1\nLuis,Paz,2,1990-01-01,2\n",
+			documents: []string{"1", "2"},
+		},
+		{
+			name:      "auto with header",
+			input:     "first_name,last_name,document,birthdate,number\nAna,Paz,1,1990-01-01,1\n",
+			documents: []string{"1"},
+		},
+		{
+			name:      "auto with reordered columns",
+			input:     "\ufeffNumber,Document,Birthdate,Last_Name,First_Name\n7,1,1990-01-01,Paz,Ana\n",
+			documents: []string{"1"},
+		},
+		{
+			name:      "header on with mapped names",
+			schema:    CSVSchema{Header: HeaderPresent, Columns: map[string]string{"document": "dni", "number": "apuesta"}},
+			input:     "apuesta,first_name,last_name,dni,birthdate\n7,Ana,Paz,1,1990-01-01\n",
+			documents: []string{"1"},
+		},
+		{
+			name:      "header on with mapped positions",
+			schema:    CSVSchema{Header: HeaderPresent, Columns: map[string]string{"number": "1"}},
+			input:     "n,first_name,last_name,document,birthdate\n7,Ana,Paz,1,1990-01-01\n",
+			documents: []string{"1"},
+		},
+		{
+			name:     "header off takes the header as a bet",
+			schema:   CSVSchema{Header: HeaderAbsent},
+			input:    "first_name,last_name,document,birthdate,number\nAna,Paz,1,1990-01-01,1\n",
+			rejected: []int{1},
+			// The rest is read by position
+			documents: []string{"1"},
+		},
+		{
+			name:      "header off with mapped positions",
+			schema:    CSVSchema{Header: HeaderAbsent, Columns: map[string]string{"document": "5", "number": "3"}},
+			input:     "Ana,Paz,7,1990-01-01,1,extra\n",
+			documents: []string{"1"},
+		},
+		{
+			name:   "header on missing a column",
+			schema: CSVSchema{Header: HeaderPresent},
+			input:  "first_name,last_name,document,birthdate\nAna,Paz,1,1990-01-01\n",
+			fails:  true,
+		},
+		{
+			name:   "auto with mapped names but no header",
+			schema: CSVSchema{Columns: map[string]string{"document": "dni"}},
+			input:  "Ana,Paz,1,1990-01-01,1\n",
+			fails:  true,
+		},
+		{
+			name:      "rows missing fields",
+			input:     "first_name,last_name,document,birthdate,number\nAna,Paz,1,1990-01-01\nLuis,Paz,2,1990-01-01,2\n",
+			documents: []string{"2"},
+			rejected:  []int{2},
+		},
+		{
+			name:  "quoted fields",
+			input: "\"Pérez, Juan\",Paz,1,1990-01-01,1\n\"Ana\nMaría\",Paz,2,1990-01-01,2\nLuis,Paz,3,1990-01-01,3\n",
+			// A line break can't be sent, the record spanning lines 2-3 is rejected whole
+			documents: []string{"1", "3"},
+			rejected:  []int{3},
+		},
+		{
+			name:      "delimiter",
+			schema:    CSVSchema{Delimiter: ';'},
+			input:     "first_name;last_name;document;birthdate;number\nPérez, Juan;Paz;1;1990-01-01;1\n",
+			documents: []string{"1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.schema.Validate(); err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			source, err := NewBetSource(strings.NewReader(tt.input), FormatCSV, EncodingUTF8, tt.schema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var documents []string
+			var rejected []int
+			for {
+				record, err := source.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					if !tt.fails {
+						t.Fatalf("Next() = %v", err)
+					}
+					return
+				}
+				switch {
+				case record.Content == "":
+				case record.Err != nil:
+					rejected = append(rejected, record.Line)
+				default:
+					documents = append(documents, record.Bet.Document)
+				}
+			}
+			if tt.fails {
+				t.Fatalf("read %q, want the layout to be refused", documents)
+			}
+			if strings.Join(documents, ",") != strings.Join(tt.documents, ",") {
+				t.Errorf("documents = %q, want %q", documents, tt.documents)
+			}
+			if len(rejected) != len(tt.rejected) || (len(rejected) > 0 && rejected[0] != tt.rejected[0]) {
+				t.Errorf("rejected lines = %v, want %v", rejected, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestCSVSchemaValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema CSVSchema
+		fails  bool
+	}{
+		{"zero value", CSVSchema{}, false},
+		{"mapped columns", CSVSchema{Header: HeaderPresent, Columns: map[string]string{"document": "dni", "number": "2"}}, false},
+		{"unknown header mode", CSVSchema{Header: "maybe"}, true},
+		{"quote delimiter", CSVSchema{Delimiter: '"'}, true},
+		{"unknown field", CSVSchema{Columns: map[string]string{"dni": "1"}}, true},
+		{"empty column", CSVSchema{Columns: map[string]string{"document": " "}}, true},
+		{"position zero", CSVSchema{Columns: map[string]string{"document": "0"}}, true},
+		{"column mapped twice", CSVSchema{Columns: map[string]string{"document": "dni", "number": "DNI"}}, true},
+		{"name without header", CSVSchema{Header: HeaderAbsent, Columns: map[string]string{"document": "dni"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.schema.Validate(); (err != nil) != tt.fails {
+				t.Errorf("Validate() = %v, want failure %v", err, tt.fails)
+			}
+		})
+	}
+}
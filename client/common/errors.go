@@ -0,0 +1,53 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// ErrInterrupted is returned when the run is canceled, e.g. by SIGTERM or SIGINT,
+// before it completes.
+var ErrInterrupted = errors.New("interrupted")
+
+// TimeoutError is returned when dialing, writing to or reading from the server
+// takes longer than its configured timeout. It matches protocol.ErrTimeout with
+// errors.Is. Timeouts are transient, so the retry policies try again after them.
+type TimeoutError struct {
+	Op       string        // "dial", "write", "read" or "heartbeat"
+	Duration time.Duration // timeout that expired
+	Err      error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout after %v: %v", e.Op, e.Duration, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error { return e.Err }
+
+// Is makes errors.Is(err, protocol.ErrTimeout) report timeouts.
+func (e *TimeoutError) Is(target error) bool { return target == protocol.ErrTimeout }
+
+// Timeout reports that the error is a timeout, as net.Error does.
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Temporary reports that the operation may succeed if retried, as net.Error does.
+func (e *TimeoutError) Temporary() bool { return true }
+
+// Retryable reports whether the operation that failed with err may succeed if
+// it is attempted again. Connection problems, timeouts and a draw not done yet
+// are transient; unparseable replies, rejections, failed TLS handshakes,
+// refused signatures and Permanent errors are not.
+func Retryable(err error) bool {
+	var permanent *permanentError
+	switch {
+	case errors.As(err, &permanent):
+		return false
+	case errors.Is(err, protocol.ErrProtocol), errors.Is(err, protocol.ErrRejected), errors.Is(err, protocol.ErrTLS),
+		errors.Is(err, protocol.ErrUnauthorized):
+		return false
+	}
+	return true
+}
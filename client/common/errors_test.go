@@ -0,0 +1,104 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+func TestRetryable(t *testing.T) {
+	timeout := &TimeoutError{Op: "read", Duration: time.Second, Err: os.ErrDeadlineExceeded}
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+		is        error // sentinel the error must match, if any
+	}{
+		{"server closed", fmt.Errorf("send fail: %w", protocol.ErrServerClosed), true, protocol.ErrServerClosed},
+		{"timeout", fmt.Errorf("send fail: %w", timeout), true, protocol.ErrTimeout},
+		{"draw not ready", protocol.ErrDrawNotReady, true, protocol.ErrDrawNotReady},
+		{"unclassified", errors.New("connection refused"), true, nil},
+		{"protocol", fmt.Errorf("send fail: %w: unexpected response", protocol.ErrProtocol), false, protocol.ErrProtocol},
+		{"rejected", fmt.Errorf("%w: fail|0", protocol.ErrRejected), false, protocol.ErrRejected},
+		{"permanent", Permanent(protocol.ErrServerClosed), false, protocol.ErrServerClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Retryable(tt.err); got != tt.retryable {
+				t.Errorf("Retryable(%v) = %v, want %v", tt.err, got, tt.retryable)
+			}
+			if tt.is != nil && !errors.Is(tt.err, tt.is) {
+				t.Errorf("errors.Is(%v, %v) = false", tt.err, tt.is)
+			}
+		})
+	}
+}
+
+// rawReply is a reply written to the stream as is.
+type rawReply string
+
+func (r rawReply) Encode(w io.Writer) error {
+	_, err := io.WriteString(w, string(r))
+	return err
+}
+
+func (r rawReply) Decode(io.Reader) error { return nil }
+
+func TestServerErrors(t *testing.T) {
+	quick := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Multiplier: 1}
+	batch := func(c *Client) error {
+		request := c.newBatchRequest([]string{"Ana,Paz,1,1990-01-01,1"}, 0)
+		return c.sendBatchWithRetry(context.Background(), c.session, request)
+	}
+	winners := func(c *Client) error {
+		_, err := c.Winners(context.Background())
+		return err
+	}
+	tests := []struct {
+		name     string
+		reply    protocol.Message
+		send     func(c *Client) error
+		want     error
+		attempts int
+	}{
+		{"batch refused", &protocol.BatchAck{Success: false}, batch, protocol.ErrRejected, 1},
+		{"unparseable ack", rawReply("maybe|1\n"), batch, protocol.ErrProtocol, 1},
+		{"closed before the ack", nil, batch, protocol.ErrServerClosed, 3},
+		{"winners query refused", &protocol.QueryFailed{Reason: "agencia_no_encontrada"}, winners, protocol.ErrRejected, 1},
+		{"draw never ready", &protocol.DrawNotReady{}, winners, protocol.ErrDrawNotReady, 3},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			closeAfter := 0
+			if tt.reply == nil {
+				// Closing after a frame left unanswered drops the connection before the ack
+				closeAfter = 1
+			}
+			server := startStubServer(t, closeAfter, func([]byte) protocol.Message { return tt.reply })
+			client := NewClient(ClientConfig{
+				ID:            "1",
+				ServerAddress: server.listener.Addr().String(),
+				Persistent:    true,
+				SendRetry:     quick,
+				WinnersRetry:  quick,
+			})
+			defer client.session.Close()
+
+			err := tt.send(client)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("error = %v, want %v", err, tt.want)
+			}
+			// A reused connection that breaks is dialed again once within the same attempt
+			if n := len(server.received()); n < tt.attempts || n > 2*tt.attempts {
+				t.Errorf("server got %d messages, want %d attempts", n, tt.attempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// negotiate runs the hello exchange the first time the client talks to the
+// server, when ClientConfig.Handshake is set, and adapts the client to what
+// the server supports. Servers that don't understand the hello are spoken to
+// with the legacy protocol: without sequenced batches, persistent connections,
+// heartbeats, compression, digests or waiting for the draw, whatever the
+// configuration says. The outcome is kept for the rest of the client's life.
+func (c *Client) negotiate(ctx context.Context) error {
+	if !c.config.Handshake || c.server != nil {
+		return nil
+	}
+	hello := &protocol.Hello{Version: protocol.Version, AgencyID: c.config.ID, Features: protocol.Features}
+	ack := &protocol.HelloAck{}
+	err := c.session.RoundTrip(ctx, hello, ack)
+	switch {
+	case errors.Is(err, protocol.ErrHelloUnsupported):
+		clientLog.Infof("action: hello | result: success | client_id: %v | version: %d | message: server only speaks the legacy protocol",
+			c.config.ID, protocol.LegacyVersion)
+		ack = &protocol.HelloAck{Version: protocol.LegacyVersion}
+	case err != nil:
+		clientLog.Errorf("action: hello | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return err
+	default:
+		clientLog.Infof("action: hello | result: success | client_id: %v | version: %d | features: %s | max_batch_bytes: %d",
+			c.config.ID, ack.Version, strings.Join(ack.Features, ","), ack.MaxBatchBytes)
+	}
+	c.server = ack
+
+	if c.config.Sequenced && !ack.Has(protocol.FeatureSequenced) {
+		clientLog.Warningf("action: hello | result: in_progress | client_id: %v | message: server does not support sequenced batches, sending them unsequenced", c.config.ID)
+		c.config.Sequenced = false
+	}
+	if c.config.Persistent && !ack.Has(protocol.FeaturePersistent) {
+		clientLog.Warningf("action: hello | result: in_progress | client_id: %v | message: server does not keep connections open, using one per message", c.config.ID)
+		c.config.Persistent = false
+	}
+	if c.config.HeartbeatInterval > 0 && !ack.Has(protocol.FeaturePing) {
+		c.config.HeartbeatInterval = 0
+	}
+	if c.config.Compression != "" && !ack.Has(c.config.Compression) {
+		clientLog.Warningf("action: hello | result: in_progress | client_id: %v | message: server does not support %s compression, sending batches uncompressed",
+			c.config.ID, c.config.Compression)
+	}
+	if c.config.Digest != "" && !ack.Has(c.config.Digest) {
+		clientLog.Warningf("action: hello | result: in_progress | client_id: %v | message: server does not support %s digests, sending frames without them",
+			c.config.ID, c.config.Digest)
+		c.config.Digest = ""
+	}
+	if ack.MaxBatchBytes > 0 && (c.config.MaxBatchBytes == 0 || c.config.MaxBatchBytes > ack.MaxBatchBytes) {
+		clientLog.Infof("action: hello | result: in_progress | client_id: %v | message: batches bounded to the %d bytes the server accepts", c.config.ID, ack.MaxBatchBytes)
+		c.config.MaxBatchBytes = ack.MaxBatchBytes
+	}
+	c.session.configure(c.config)
+	return nil
+}
+
+// compression returns the algorithm batches are compressed with, empty when
+// compression is disabled or the server did not agree on it in the hello.
+func (c *Client) compression() string {
+	if c.config.Compression == "" || c.server == nil || !c.server.Has(c.config.Compression) {
+		return ""
+	}
+	return c.config.Compression
+}
+
+// ParseCompression parses the name of a compression algorithm, "none" or empty
+// meaning no compression.
+func ParseCompression(name string) (string, error) {
+	switch algorithm := strings.ToLower(strings.TrimSpace(name)); algorithm {
+	case "", "none":
+		return "", nil
+	case protocol.FeatureGzip, protocol.FeatureFlate:
+		return algorithm, nil
+	}
+	return "", fmt.Errorf("unknown compression algorithm %q, expected none, gzip or flate", name)
+}
+
+// ParseDigest parses the name of a digest algorithm, "none" or empty meaning no
+// digest.
+func ParseDigest(name string) (string, error) {
+	switch algorithm := strings.ToLower(strings.TrimSpace(name)); algorithm {
+	case "", "none":
+		return "", nil
+	case protocol.FeatureCRC32C, protocol.FeatureSHA256:
+		return algorithm, nil
+	}
+	return "", fmt.Errorf("unknown digest algorithm %q, expected none, crc32c or sha256", name)
+}
+
+// supports reports whether the server supports feature. It is assumed to when
+// there was no hello exchange.
+func (c *Client) supports(feature string) bool {
+	return c.server == nil || c.server.Has(feature)
+}
@@ -0,0 +1,206 @@
+package common
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// isHello reports whether payload is a hello frame.
+func isHello(payload []byte) bool {
+	return strings.HasPrefix(string(payload), "hello|")
+}
+
+// quotedInput has a bet with a comma in its first name between two plain ones.
+const quotedInput = "Ana,Paz,1,1990-01-01,1\n\"Pérez, Juan\",Paz,2,1990-01-01,2\nEva,Paz,3,1990-01-01,3\n"
+
+func TestLegacyServerFallback(t *testing.T) {
+	// A legacy server answers the hello as any request it doesn't understand,
+	// and closes the connection after each reply
+	server := startStubServer(t, 1, func(payload []byte) protocol.Message {
+		if isHello(payload) {
+			return &protocol.BatchAck{Success: false}
+		}
+		if strings.HasPrefix(string(payload), "notify_finished|") {
+			return &protocol.NotifyAck{}
+		}
+		if strings.HasPrefix(string(payload), "query_winners|") {
+			return &protocol.WinnersResponse{Documents: []string{"3"}}
+		}
+		return ackAll(payload)
+	})
+	client := NewClient(ClientConfig{
+		ID:                "1",
+		ServerAddress:     server.listener.Addr().String(),
+		MaxBatch:          10,
+		Sequenced:         true,
+		Persistent:        true,
+		HeartbeatInterval: 10 * time.Millisecond,
+		Handshake:         true,
+		Compression:       protocol.FeatureGzip,
+		Digest:            protocol.FeatureCRC32C,
+		DrawWait:          time.Second,
+	})
+	defer client.session.Close()
+	ctx := context.Background()
+
+	upload, err := client.SendFrom(ctx, strings.NewReader(quotedInput))
+	if err != nil {
+		t.Fatalf("SendFrom() = %v", err)
+	}
+	if upload.Stored != 2 || len(upload.Rejected) != 1 || upload.Rejected[0].Line != 2 {
+		t.Errorf("SendFrom() = %+v, want 2 bets stored and the quoted one rejected", upload)
+	}
+	if err := client.NotifyFinished(ctx); err != nil {
+		t.Fatalf("NotifyFinished() = %v", err)
+	}
+	if winners, err := client.Winners(ctx); err != nil || len(winners) != 1 {
+		t.Fatalf("Winners() = %v, %v, want one winner", winners, err)
+	}
+
+	if client.server == nil || client.server.Version != protocol.LegacyVersion || len(client.server.Features) != 0 {
+		t.Errorf("agreed on %+v, want the legacy protocol", client.server)
+	}
+	if client.config.Sequenced || client.config.Persistent || client.config.HeartbeatInterval != 0 {
+		t.Errorf("config = %+v, want no sequences, persistent connections or heartbeats", client.config)
+	}
+	payloads := server.received()
+	// The winners are polled, wait_draw is not sent
+	want := []string{"hello|", "agency_ID|1\n", "notify_finished|1\n", "query_winners|1\n"}
+	if len(payloads) != len(want) {
+		t.Fatalf("frames = %q, want the hello, one batch, the notify and the winners query", payloads)
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(payloads[i], prefix) {
+			t.Errorf("frame %d = %q, want it to start with %q", i+1, payloads[i], prefix)
+		}
+	}
+	for _, payload := range payloads {
+		if protocol.IsCompressed([]byte(payload)) || protocol.IsDigested([]byte(payload)) {
+			t.Errorf("compressed or digested frame %q sent to a legacy server", payload)
+		}
+	}
+	if server.connections() != len(want) {
+		t.Errorf("connections = %d, want one per message", server.connections())
+	}
+}
+
+func TestHelloAgreement(t *testing.T) {
+	server := startStubServer(t, 0, func(payload []byte) protocol.Message {
+		if isHello(payload) {
+			return &protocol.HelloAck{
+				Version:       protocol.Version,
+				Features:      []string{protocol.FeatureSequenced, protocol.FeatureQuotedBets},
+				MaxBatchBytes: 4096,
+			}
+		}
+		return ackAll(payload)
+	})
+	client := NewClient(ClientConfig{
+		ID:            "1",
+		ServerAddress: server.listener.Addr().String(),
+		MaxBatch:      10,
+		MaxBatchBytes: 1 << 20,
+		Sequenced:     true,
+		Persistent:    true,
+		Handshake:     true,
+	})
+	defer client.session.Close()
+
+	upload, err := client.SendFrom(context.Background(), strings.NewReader(quotedInput))
+	if err != nil {
+		t.Fatalf("SendFrom() = %v", err)
+	}
+	if upload.Stored != 3 || len(upload.Rejected) != 0 {
+		t.Errorf("SendFrom() = %+v, want the 3 bets stored", upload)
+	}
+	if !client.config.Sequenced || client.config.Persistent || client.config.MaxBatchBytes != 4096 {
+		t.Errorf("config = %+v, want sequences, a connection per message and batches of up to 4096 bytes", client.config)
+	}
+	payloads := server.received()
+	if len(payloads) != 2 || !strings.Contains(payloads[1], "|seq|") || !strings.Contains(payloads[1], "\"Pérez, Juan\"") {
+		t.Errorf("frames = %q, want the hello and a sequenced batch with the quoted bet", payloads)
+	}
+}
+
+func TestQuotedBetsWithoutHello(t *testing.T) {
+	server := startStubServer(t, 0, ackAll)
+	client := NewClient(ClientConfig{ID: "1", ServerAddress: server.listener.Addr().String(), MaxBatch: 10})
+	defer client.session.Close()
+
+	// Without the hello exchange it's unknown whether the server reads quoted fields
+	upload, err := client.SendFrom(context.Background(), strings.NewReader(quotedInput))
+	if err != nil {
+		t.Fatalf("SendFrom() = %v", err)
+	}
+	if upload.Stored != 2 || len(upload.Rejected) != 1 || upload.Rejected[0].Line != 2 {
+		t.Errorf("SendFrom() = %+v, want 2 bets stored and the quoted one rejected", upload)
+	}
+	for _, payload := range server.received() {
+		if strings.Contains(payload, `"`) {
+			t.Errorf("quoted bet sent in %q", payload)
+		}
+	}
+}
+
+func TestWinnersWaitDraw(t *testing.T) {
+	tests := []struct {
+		name     string
+		features []string
+		request  string // prefix of the winners queries
+		queries  int
+	}{
+		{"agreed", []string{protocol.FeatureWaitDraw}, "wait_draw|1|", 1},
+		{"not agreed", nil, "query_winners|1", 2},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			// The draw is done after the first plain query, while wait_draw
+			// queries are held until then
+			var mu sync.Mutex
+			polled := false
+			server := startStubServer(t, 0, func(payload []byte) protocol.Message {
+				switch {
+				case isHello(payload):
+					return &protocol.HelloAck{Version: protocol.Version, Features: tt.features}
+				case strings.HasPrefix(string(payload), "wait_draw|"):
+					return &protocol.WinnersResponse{Documents: []string{"7"}}
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if !polled {
+					polled = true
+					return &protocol.DrawNotReady{}
+				}
+				return &protocol.WinnersResponse{Documents: []string{"7"}}
+			})
+			client := NewClient(ClientConfig{
+				ID:            "1",
+				ServerAddress: server.listener.Addr().String(),
+				Handshake:     true,
+				DrawWait:      time.Second,
+				WinnersRetry:  RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Multiplier: 1},
+			})
+			defer client.session.Close()
+
+			winners, err := client.Winners(context.Background())
+			if err != nil || len(winners) != 1 || winners[0] != "7" {
+				t.Fatalf("Winners() = %v, %v, want document 7", winners, err)
+			}
+			queries := server.received()[1:]
+			if len(queries) != tt.queries {
+				t.Fatalf("queries = %q, want %d", queries, tt.queries)
+			}
+			for _, query := range queries {
+				if !strings.HasPrefix(query, tt.request) {
+					t.Errorf("query = %q, want it to start with %q", query, tt.request)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package common
+
+import "time"
+
+// Metrics receives the outcome of every batch sent by a Client, e.g. to build
+// load test reports. Implementations must be safe for concurrent use, since
+// batches of the same client may be sent from several goroutines.
+type Metrics interface {
+	// BatchAcked is called when the server acknowledges a batch of size bets.
+	// latency is the duration of the round trip that got the ack.
+	BatchAcked(size int, latency time.Duration)
+	// BatchRetried is called when an attempt to send a batch fails and the
+	// batch is going to be sent again.
+	BatchRetried(err error)
+	// BatchFailed is called when a batch is given up after every attempt failed.
+	BatchFailed(err error)
+}
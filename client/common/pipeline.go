@@ -0,0 +1,157 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// batchJob is a batch read from the source that is waiting for its ack.
+type batchJob struct {
+	index    int // position of the batch in the upload
+	request  *protocol.BatchRequest
+	lines    []int         // source line of each bet of the batch
+	offset   int64         // source offset right after the last line covered by the batch
+	line     int           // last source line covered by the batch
+	rejected []RejectedBet // bets the server refused, set once the batch is sent
+	latency  time.Duration // time it took to get the batch acknowledged
+}
+
+// batchResult is the outcome of sending a batchJob.
+type batchResult struct {
+	job *batchJob
+	err error
+}
+
+// batchPipeline keeps up to inFlight batches being sent at the same time. Each
+// worker owns a session, so batches travel over a small pool of connections.
+// Acks may arrive in any order, but onAck is called in submission order and only
+// for the contiguous prefix of acknowledged batches, so order dependent state
+// such as the upload checkpoint never skips a batch still in flight.
+type batchPipeline struct {
+	client  *Client
+	onAck   func(job *batchJob) error
+	jobs    chan *batchJob
+	results chan batchResult
+	wg      sync.WaitGroup
+
+	submitted int               // batches handed to the workers
+	handled   int               // batches whose result was processed
+	nextAck   int               // index of the oldest batch not acknowledged yet
+	acked     map[int]*batchJob // acknowledged batches waiting for older ones
+	stored    int               // bets stored by every acknowledged batch, in order or not
+	closed    bool
+	err       error // first error found, stops the pipeline
+}
+
+// newBatchPipeline starts inFlight workers. The first one reuses the client
+// session and the rest open their own. Workers give up the batches they are
+// sending once ctx is done.
+func newBatchPipeline(ctx context.Context, client *Client, inFlight int, onAck func(job *batchJob) error) *batchPipeline {
+	if inFlight < 1 {
+		inFlight = 1
+	}
+	p := &batchPipeline{
+		client:  client,
+		onAck:   onAck,
+		jobs:    make(chan *batchJob),
+		results: make(chan batchResult, inFlight),
+		acked:   make(map[int]*batchJob),
+	}
+
+	for i := 0; i < inFlight; i++ {
+		session := client.session
+		if i > 0 {
+			session = NewSession(client.config)
+		}
+		p.wg.Add(1)
+		go p.work(ctx, session, i > 0)
+	}
+	return p
+}
+
+// work sends the batches received from the jobs channel until it is closed.
+func (p *batchPipeline) work(ctx context.Context, session *Session, ownSession bool) {
+	defer p.wg.Done()
+	if ownSession {
+		defer session.Close()
+	}
+	for job := range p.jobs {
+		err := p.client.sendBatch(ctx, session, job)
+		p.results <- batchResult{job: job, err: err}
+	}
+}
+
+// Submit hands a batch to the workers, blocking while inFlight batches are
+// already waiting for their ack. It returns the first error found so far, or
+// ctx.Err() if ctx is done before the batch could be handed over.
+func (p *batchPipeline) Submit(ctx context.Context, job *batchJob) error {
+	job.index = p.submitted
+	for {
+		if p.err != nil {
+			return p.err
+		}
+		select {
+		case p.jobs <- job:
+			p.submitted++
+			return nil
+		case result := <-p.results:
+			p.handle(result)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close waits for every submitted batch and stops the workers. It returns the
+// first error found while sending. It is safe to call more than once.
+func (p *batchPipeline) Close() error {
+	if p.closed {
+		return p.err
+	}
+	p.closed = true
+	close(p.jobs)
+	for p.handled < p.submitted {
+		p.handle(<-p.results)
+	}
+	p.wg.Wait()
+	return p.err
+}
+
+// Stored returns the amount of bets of every batch acknowledged so far,
+// including those acknowledged out of order after another batch failed, for
+// which onAck is never called.
+func (p *batchPipeline) Stored() int {
+	return p.stored
+}
+
+// handle records the result of a batch and calls onAck for every batch that
+// became part of the contiguous acknowledged prefix.
+func (p *batchPipeline) handle(result batchResult) {
+	p.handled++
+	if result.err != nil {
+		if p.err == nil {
+			p.err = result.err
+		}
+		return
+	}
+
+	// A batch acknowledged after an older one failed is still stored, but
+	// it can't be part of the acknowledged prefix anymore.
+	p.stored += len(result.job.request.Lines) - len(result.job.rejected)
+	if p.err != nil {
+		return
+	}
+	p.acked[result.job.index] = result.job
+	for p.err == nil {
+		job, ok := p.acked[p.nextAck]
+		if !ok {
+			return
+		}
+		delete(p.acked, p.nextAck)
+		p.nextAck++
+		p.err = p.onAck(job)
+	}
+}
@@ -0,0 +1,138 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+func TestBatchPipelineHandle(t *testing.T) {
+	errSend := errors.New("send fail")
+	errSave := errors.New("save checkpoint")
+	type result struct {
+		index int
+		err   error
+	}
+	tests := []struct {
+		name    string
+		results []result // in the order the acks arrive
+		saveErr int      // index of the batch whose onAck fails, -1 for none
+		acked   []int    // batches handed to onAck, in order
+		stored  int      // bets acknowledged, each batch holds index+1 bets
+		err     error
+	}{
+		{
+			name:    "in order",
+			results: []result{{0, nil}, {1, nil}, {2, nil}},
+			saveErr: -1,
+			acked:   []int{0, 1, 2},
+			stored:  6,
+		},
+		{
+			name:    "out of order",
+			results: []result{{2, nil}, {0, nil}, {1, nil}},
+			saveErr: -1,
+			acked:   []int{0, 1, 2},
+			stored:  6,
+		},
+		{
+			name:    "acks after a failure are stored but not checkpointed",
+			results: []result{{0, nil}, {1, errSend}, {2, nil}},
+			saveErr: -1,
+			acked:   []int{0},
+			stored:  4,
+			err:     errSend,
+		},
+		{
+			name:    "acks waiting for a failed batch",
+			results: []result{{2, nil}, {0, nil}, {1, errSend}},
+			saveErr: -1,
+			acked:   []int{0},
+			stored:  4,
+			err:     errSend,
+		},
+		{
+			name:    "checkpoint failure",
+			results: []result{{0, nil}, {1, nil}, {2, nil}},
+			saveErr: 1,
+			acked:   []int{0, 1},
+			stored:  6,
+			err:     errSave,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var acked []int
+			p := &batchPipeline{
+				acked:     make(map[int]*batchJob),
+				submitted: len(tt.results),
+				onAck: func(job *batchJob) error {
+					acked = append(acked, job.index)
+					if job.index == tt.saveErr {
+						return errSave
+					}
+					return nil
+				},
+			}
+			for _, r := range tt.results {
+				job := &batchJob{index: r.index, request: &protocol.BatchRequest{Lines: make([]string, r.index+1)}}
+				p.handle(batchResult{job: job, err: r.err})
+			}
+			if !reflect.DeepEqual(acked, tt.acked) {
+				t.Errorf("onAck called for %v, want %v", acked, tt.acked)
+			}
+			if p.Stored() != tt.stored {
+				t.Errorf("Stored() = %d, want %d", p.Stored(), tt.stored)
+			}
+			if p.err != tt.err {
+				t.Errorf("err = %v, want %v", p.err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSendBetsInFlight(t *testing.T) {
+	server := startStubServer(t, 0, ackAll)
+	dir := t.TempDir()
+	source := filepath.Join(dir, "agency-1.csv")
+	var input strings.Builder
+	for document := 1; document <= 10; document++ {
+		fmt.Fprintf(&input, "Ana,Paz,%d,1990-01-01,%d\n", document, document)
+	}
+	if err := os.WriteFile(source, []byte(input.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(ClientConfig{
+		ID:            "1",
+		ServerAddress: server.listener.Addr().String(),
+		MaxBatch:      3,
+		InFlight:      3,
+		Sequenced:     true,
+		Persistent:    true,
+		StateDir:      dir,
+		Checkpoint:    true,
+	})
+	defer client.session.Close()
+
+	upload, err := client.SendFile(context.Background(), source)
+	if err != nil || upload.Stored != 10 {
+		t.Fatalf("SendFile() = %+v, %v, want 10 stored", upload, err)
+	}
+	if got := server.received(); len(got) != 4 {
+		t.Errorf("sent %d batches, want 4", len(got))
+	}
+	if n := server.connections(); n > 3 {
+		t.Errorf("connections = %d, want at most one per batch in flight", n)
+	}
+	checkpoint, err := LoadCheckpoint(client.checkpointPath())
+	if err != nil || checkpoint.Line != 10 || checkpoint.Sent != 10 || checkpoint.Sequence != 4 {
+		t.Errorf("checkpoint = %+v, %v, want line 10, 10 sent up to sequence 4", checkpoint, err)
+	}
+}
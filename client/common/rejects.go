@@ -0,0 +1,67 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// RejectsReport records the input lines that were not sent to the server,
+// together with their line number and the reason they were rejected.
+// The report file is only created when the first line is rejected.
+type RejectsReport struct {
+	path       string
+	appendMode bool
+	file       *os.File
+	count      int
+}
+
+// NewRejectsReport creates a report that will be written to path.
+func NewRejectsReport(path string) *RejectsReport {
+	return &RejectsReport{path: path}
+}
+
+// SetAppend makes the report keep the lines already in the file, instead of
+// overwriting it, e.g. when resuming an interrupted upload.
+func (r *RejectsReport) SetAppend(appendMode bool) {
+	r.appendMode = appendMode
+}
+
+// Add appends a rejected line to the report.
+func (r *RejectsReport) Add(lineNumber int, line string, reason error) error {
+	if r.file == nil {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if r.appendMode {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(r.path, flags, 0644)
+		if err != nil {
+			return err
+		}
+		r.file = file
+	}
+	r.count++
+	_, err := fmt.Fprintf(r.file, "line: %d | reason: %v | content: %s\n", lineNumber, reason, line)
+	return err
+}
+
+// Count returns the amount of lines rejected so far.
+func (r *RejectsReport) Count() int {
+	return r.count
+}
+
+// Path returns the location of the report file.
+func (r *RejectsReport) Path() string {
+	return r.path
+}
+
+// Close closes the report file, if it was created.
+func (r *RejectsReport) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+func TestRejectsReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agency-1-rejects.txt")
+	report := NewRejectsReport(path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("report created before any rejection: %v", err)
+	}
+
+	if err := report.Add(3, "Ana,Paz", errors.New("expected 5 fields, got 2")); err != nil {
+		t.Fatalf("Add() = %v", err)
+	}
+	if err := report.Add(7, ",Paz,1,1990-01-01,1", errors.New("empty first_name")); err != nil {
+		t.Fatalf("Add() = %v", err)
+	}
+	if err := report.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "line: 3 | reason: expected 5 fields, got 2 | content: Ana,Paz\n" +
+		"line: 7 | reason: empty first_name | content: ,Paz,1,1990-01-01,1\n"
+	if string(data) != want {
+		t.Errorf("report = %q, want %q", data, want)
+	}
+	if report.Count() != 2 || report.Path() != path {
+		t.Errorf("Count(), Path() = %d, %q, want 2, %q", report.Count(), report.Path(), path)
+	}
+}
+
+func TestSendBetsRejectsInvalidLines(t *testing.T) {
+	server := startStubServer(t, 0, func(payload []byte) protocol.Message {
+		lines := strings.Count(string(payload), "\n") - 1
+		return &protocol.BatchAck{Success: true, Count: lines}
+	})
+	dir := t.TempDir()
+	client := NewClient(ClientConfig{ID: "1", ServerAddress: server.listener.Addr().String(), MaxBatch: 2, Persistent: true, StateDir: dir})
+	defer client.session.Close()
+
+	source := filepath.Join(dir, "agency-1.csv")
+	input := "Ana,Paz,1,1990-01-01,1\n" +
+		"Ana,Paz,2,17/03/1999,2\n" +
+		"\n" +
+		"Luis , Paz , 3 , 1990-01-01 , 3\n" +
+		"Luis,Paz,4,1990-01-01\n" +
+		"Eva,Paz,5,1990-01-01,5\n"
+	if err := os.WriteFile(source, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := client.SendFile(context.Background(), source)
+	if err != nil {
+		t.Fatalf("SendFile() = %v", err)
+	}
+	if upload.Stored != 3 {
+		t.Errorf("SendFile() = %d bets, want 3", upload.Stored)
+	}
+	// Valid bets are sent normalized, invalid ones never reach the server
+	want := []string{
+		"agency_ID|1\nAna,Paz,1,1990-01-01,1\nLuis,Paz,3,1990-01-01,3\n",
+		"agency_ID|1\nEva,Paz,5,1990-01-01,5\n",
+	}
+	if got := server.received(); strings.Join(got, "") != strings.Join(want, "") {
+		t.Errorf("batches = %q, want %q", got, want)
+	}
+	if len(upload.Rejected) != 2 {
+		t.Fatalf("rejected = %d, want 2", len(upload.Rejected))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "agency-1-rejects.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range []string{"line: 2 | reason: invalid birthdate", "line: 5 | reason: expected 5 fields"} {
+		if !strings.Contains(string(data), prefix) {
+			t.Errorf("report %q has no %q", data, prefix)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how an operation is retried. Attempt n waits
+// BaseDelay * Multiplier^(n-1) before the next one, capped at MaxDelay. With
+// Jitter the wait is instead picked at random between zero and that value (full
+// jitter), so agencies that failed at the same moment don't retry in lockstep.
+type RetryPolicy struct {
+	MaxAttempts int           // attempts before giving up, 0 means no limit other than Deadline
+	BaseDelay   time.Duration // wait after the first failed attempt
+	MaxDelay    time.Duration // upper bound of the wait between attempts, 0 means no bound
+	Multiplier  float64       // growth of the wait after each failed attempt
+	Jitter      bool          // randomize the waits between zero and the computed delay
+	Deadline    time.Duration // overall time budget of all the attempts, 0 means no limit
+}
+
+// Default retry policies of a Client, used when ClientConfig leaves them unset.
+var (
+	DefaultDialRetry = RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    5 * time.Second,
+		Multiplier:  2,
+		Jitter:      true,
+	}
+	DefaultSendRetry = RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   1 * time.Second,
+		MaxDelay:    10 * time.Second,
+		Multiplier:  2,
+		Jitter:      true,
+	}
+	DefaultWinnersRetry = RetryPolicy{
+		MaxAttempts: 30,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    5 * time.Second,
+		Multiplier:  1.5,
+		Jitter:      true,
+		Deadline:    2 * time.Minute,
+	}
+)
+
+// Validate checks that the policy can be used.
+func (p RetryPolicy) Validate() error {
+	switch {
+	case p.MaxAttempts < 0:
+		return fmt.Errorf("maxAttempts can't be negative")
+	case p.MaxAttempts == 0 && p.Deadline <= 0:
+		return fmt.Errorf("either maxAttempts or deadline must be set")
+	case p.BaseDelay < 0 || p.MaxDelay < 0 || p.Deadline < 0:
+		return fmt.Errorf("delays can't be negative")
+	case p.Multiplier < 1:
+		return fmt.Errorf("multiplier must be at least 1")
+	}
+	return nil
+}
+
+// Delay returns the wait after the given failed attempt (starting at 1).
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := float64(p.BaseDelay) * math.Pow(math.Max(p.Multiplier, 1), float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if delay > math.MaxInt64 {
+		delay = math.MaxInt64
+	}
+	if p.Jitter && delay >= 1 {
+		return time.Duration(rand.Int63n(int64(delay)))
+	}
+	return time.Duration(delay)
+}
+
+// permanentError marks an error that must not be retried.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so that Retry returns it right away instead of trying again.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// Retry calls fn until it succeeds, returns an error that is not Retryable, or
+// the policy runs out of attempts or time. fn gets a context bound to the policy
+// Deadline and the attempt number, starting at 1. onRetry, if not nil, is called after each failed
+// attempt that is going to be retried, with the wait before the next one.
+// If ctx is done Retry returns ctx.Err(); otherwise the error of the last attempt.
+func (p RetryPolicy) Retry(ctx context.Context, fn func(ctx context.Context, attempt int) error,
+	onRetry func(attempt int, err error, delay time.Duration)) error {
+	attemptCtx := ctx
+	if p.Deadline > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, p.Deadline)
+		defer cancel()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn(attemptCtx, attempt)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !Retryable(err) {
+			var permanent *permanentError
+			if errors.As(err, &permanent) {
+				return permanent.err
+			}
+			return err
+		}
+		if attemptCtx.Err() != nil {
+			return fmt.Errorf("gave up after %d attempts, deadline of %v exceeded: %w", attempt, p.Deadline, err)
+		}
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+
+		delay := p.Delay(attempt)
+		if onRetry != nil {
+			onRetry(attempt, err, delay)
+		}
+		if sleepContext(attemptCtx, delay) != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("gave up after %d attempts, deadline of %v exceeded: %w", attempt, p.Deadline, err)
+		}
+	}
+}
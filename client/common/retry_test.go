@@ -0,0 +1,138 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+var errTransient = fmt.Errorf("%w: connection reset", protocol.ErrServerClosed)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second, Multiplier: 2}
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		if got := policy.Delay(i + 1); got != w*time.Millisecond {
+			t.Errorf("Delay(%d) = %v, want %v", i+1, got, w*time.Millisecond)
+		}
+	}
+	// Attempts far enough to overflow the exponential stay at the cap
+	if got := policy.Delay(10000); got != time.Second {
+		t.Errorf("Delay(10000) = %v, want %v", got, time.Second)
+	}
+
+	policy.Jitter = true
+	for attempt := 1; attempt <= 20; attempt++ {
+		if got := policy.Delay(attempt); got < 0 || got > time.Second {
+			t.Errorf("Delay(%d) with jitter = %v, want between 0 and %v", attempt, got, time.Second)
+		}
+	}
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		valid  bool
+	}{
+		{"attempts", RetryPolicy{MaxAttempts: 3, Multiplier: 1}, true},
+		{"deadline", RetryPolicy{Deadline: time.Second, Multiplier: 2}, true},
+		{"no bound", RetryPolicy{Multiplier: 2}, false},
+		{"negative attempts", RetryPolicy{MaxAttempts: -1, Multiplier: 2}, false},
+		{"negative delay", RetryPolicy{MaxAttempts: 3, BaseDelay: -time.Second, Multiplier: 2}, false},
+		{"shrinking", RetryPolicy{MaxAttempts: 3, Multiplier: 0.5}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Multiplier: 2}
+	var attempts, retries int
+	err := policy.Retry(context.Background(), func(ctx context.Context, attempt int) error {
+		attempts++
+		if attempt != attempts {
+			t.Errorf("attempt = %d, want %d", attempt, attempts)
+		}
+		return errTransient
+	}, func(attempt int, err error, delay time.Duration) {
+		retries++
+	})
+	if !errors.Is(err, errTransient) {
+		t.Errorf("Retry() = %v, want %v", err, errTransient)
+	}
+	if attempts != 3 || retries != 2 {
+		t.Errorf("Retry() made %d attempts and %d retries, want 3 and 2", attempts, retries)
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 20 * time.Millisecond, Multiplier: 1, Deadline: 100 * time.Millisecond}
+	start := time.Now()
+	attempts := 0
+	err := policy.Retry(context.Background(), func(ctx context.Context, attempt int) error {
+		attempts++
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("the attempt context has no deadline")
+		}
+		return errTransient
+	}, nil)
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, errTransient) {
+		t.Errorf("Retry() = %v, want %v", err, errTransient)
+	}
+	if elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Retry() took %v, want about the 100ms deadline", elapsed)
+	}
+	if attempts < 2 || attempts > 6 {
+		t.Errorf("Retry() made %d attempts, want about 5", attempts)
+	}
+}
+
+func TestRetryStopsOnPermanentErrors(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, Multiplier: 1}
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"rejected", fmt.Errorf("send fail: %w", protocol.ErrRejected), protocol.ErrRejected},
+		{"protocol", fmt.Errorf("%w: unexpected response", protocol.ErrProtocol), protocol.ErrProtocol},
+		{"permanent", Permanent(errTransient), errTransient},
+		{"wrapped permanent", fmt.Errorf("send fail: %w", Permanent(errTransient)), errTransient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := policy.Retry(context.Background(), func(ctx context.Context, attempt int) error {
+				attempts++
+				return tt.err
+			}, nil)
+			if !errors.Is(err, tt.want) || attempts != 1 {
+				t.Errorf("Retry() = %v after %d attempts, want %v after 1", err, attempts, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{MaxAttempts: 100, BaseDelay: time.Hour, Multiplier: 1}
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err := policy.Retry(ctx, func(ctx context.Context, attempt int) error {
+		return errTransient
+	}, nil)
+	if err != context.Canceled {
+		t.Errorf("Retry() = %v, want %v", err, context.Canceled)
+	}
+}
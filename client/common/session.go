@@ -0,0 +1,382 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// Session manages the connection used to talk to the server.
+// In persistent mode a single connection is opened once and reused for every
+// message (batches, notify_finished and winners queries); it is re-established
+// transparently only when it breaks. Otherwise a new connection is opened for
+// each message and closed right after the reply, which is what servers that
+// close the socket after answering expect.
+//
+// Every read and write is bounded by the configured timeouts. Persistent
+// connections that stay idle for the heartbeat interval are checked with a
+// ping, so a dead server is noticed before the next message is sent.
+//
+// When the configuration has an AuthKey every request frame, heartbeats
+// included, is signed with it as protocol.Signer describes, and when it has a
+// Digest every frame carries a digest of it as protocol.AddDigest describes.
+type Session struct {
+	address           string
+	persistent        bool
+	dialRetry         RetryPolicy
+	dialTimeout       time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	heartbeatInterval time.Duration
+	tls               *tls.Config
+	signer            *protocol.Signer
+	digest            string
+
+	mu            sync.Mutex // guards the connection, shared with the heartbeat
+	conn          *timeoutConn
+	framed        net.Conn // conn, preparing the frames written to it when there is a signer or a digest
+	reader        *bufio.Reader
+	lastUsed      time.Time
+	stopHeartbeat chan struct{}
+}
+
+// NewSession creates a session against the server of config. No connection is
+// opened until the first message is sent.
+func NewSession(config ClientConfig) *Session {
+	var signer *protocol.Signer
+	if len(config.AuthKey) > 0 {
+		signer = &protocol.Signer{AgencyID: config.ID, Key: config.AuthKey}
+	}
+	return &Session{
+		address:           config.ServerAddress,
+		persistent:        config.Persistent,
+		dialRetry:         config.DialRetry,
+		dialTimeout:       config.DialTimeout,
+		readTimeout:       config.ReadTimeout,
+		writeTimeout:      config.WriteTimeout,
+		heartbeatInterval: config.HeartbeatInterval,
+		tls:               config.TLS,
+		signer:            signer,
+		digest:            config.Digest,
+	}
+}
+
+// configure applies the connection settings of config to the next connections
+// of the session, e.g. after the hello exchange showed the server lacks some
+// feature. The current connection is dropped if it no longer fits them.
+func (s *Session) configure(config ClientConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.persistent = config.Persistent
+	s.heartbeatInterval = config.HeartbeatInterval
+	s.digest = config.Digest
+	if !s.persistent || (s.heartbeatInterval <= 0 && s.stopHeartbeat != nil) {
+		s.drop()
+	} else if s.conn != nil {
+		s.framed = s.frame(s.conn)
+	}
+}
+
+// frame returns conn wrapped to prepare the frames written to it, if needed.
+func (s *Session) frame(conn net.Conn) net.Conn {
+	if s.signer == nil && s.digest == "" {
+		return conn
+	}
+	return &frameConn{Conn: conn, signer: s.signer, digest: s.digest}
+}
+
+// Do runs exchange over the session connection, dialing the server if there is
+// no open connection. If exchange fails on a connection reused from a previous
+// message, the connection is assumed to be broken: it is replaced by a new one
+// and exchange is attempted once more.
+// When ctx is done any pending read or write is interrupted, the connection is
+// dropped and ctx.Err() is returned.
+func (s *Session) Do(ctx context.Context, exchange func(conn net.Conn, reader *bufio.Reader) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reused := s.conn != nil
+	err := s.exchange(ctx, exchange)
+	if err != nil && reused && ctx.Err() == nil {
+		comunicationLog.Warningf("action: session_reconnect | result: in_progress | error: %v", err)
+		err = s.exchange(ctx, exchange)
+	}
+	return err
+}
+
+// RoundTrip encodes request over the session and decodes the reply into response.
+func (s *Session) RoundTrip(ctx context.Context, request protocol.Message, response protocol.Message) error {
+	return s.Do(ctx, func(conn net.Conn, reader *bufio.Reader) error {
+		if err := request.Encode(conn); err != nil {
+			return err
+		}
+		return response.Decode(reader)
+	})
+}
+
+// DoWaiting is Do for exchanges whose reply the server holds for up to wait,
+// such as a protocol.WaitDraw: the read timeout is extended by wait while
+// exchange runs.
+func (s *Session) DoWaiting(ctx context.Context, wait time.Duration, exchange func(conn net.Conn, reader *bufio.Reader) error) error {
+	return s.Do(ctx, func(conn net.Conn, reader *bufio.Reader) error {
+		s.conn.setReadGrace(wait)
+		defer s.conn.setReadGrace(0)
+		return exchange(conn, reader)
+	})
+}
+
+// Close closes the current connection, if any. The session can still be used
+// afterwards; the next message opens a new connection.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.drop()
+}
+
+// drop closes the current connection and stops its heartbeat. s.mu must be held.
+func (s *Session) drop() error {
+	if s.conn == nil {
+		return nil
+	}
+	if s.stopHeartbeat != nil {
+		close(s.stopHeartbeat)
+		s.stopHeartbeat = nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	s.framed = nil
+	s.reader = nil
+	return err
+}
+
+// exchange runs a single attempt of exchange, dialing if needed. The connection
+// is dropped when the attempt fails, when ctx is done or when the session is not
+// persistent.
+func (s *Session) exchange(ctx context.Context, exchange func(conn net.Conn, reader *bufio.Reader) error) error {
+	if s.conn == nil {
+		conn, err := dialWithRetry(ctx, s.address, s.dialRetry, s.dialTimeout, s.tls)
+		if err != nil {
+			return err
+		}
+		s.conn = &timeoutConn{Conn: conn, readTimeout: s.readTimeout, writeTimeout: s.writeTimeout}
+		s.framed = s.frame(s.conn)
+		s.reader = bufio.NewReader(s.conn)
+		if s.persistent && s.heartbeatInterval > 0 {
+			s.stopHeartbeat = make(chan struct{})
+			go s.heartbeat(s.conn, s.heartbeatInterval, s.stopHeartbeat)
+		}
+	}
+
+	stop := interruptOnDone(ctx, s.conn)
+	err := exchange(s.framed, s.reader)
+	stop()
+	s.lastUsed = time.Now()
+	if ctx.Err() != nil {
+		// The deadline set to interrupt the exchange leaves the connection unusable
+		err = ctx.Err()
+	}
+	if err != nil || !s.persistent {
+		s.drop()
+	}
+	return err
+}
+
+// heartbeat pings the server whenever conn stayed idle for interval, the
+// heartbeat interval when conn was dialed, until stop is closed. A ping not
+// answered in time drops the connection, so the next message dials a new one
+// instead of waiting on a dead peer.
+func (s *Session) heartbeat(conn *timeoutConn, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		if s.conn != conn {
+			s.mu.Unlock()
+			return
+		}
+		if time.Since(s.lastUsed) >= interval {
+			if err := s.ping(); err != nil {
+				comunicationLog.Warningf("action: heartbeat | result: fail | server_address: %s | error: %v", s.address, err)
+				s.drop()
+				s.mu.Unlock()
+				return
+			}
+			s.lastUsed = time.Now()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// ping sends a Ping over the current connection and waits for the Pong, for
+// at most the read timeout, or the heartbeat interval when there is none.
+// s.mu must be held.
+func (s *Session) ping() error {
+	timeout := s.readTimeout
+	if timeout <= 0 {
+		timeout = s.heartbeatInterval
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stop := interruptOnDone(ctx, s.conn)
+	defer stop()
+	if err := (&protocol.Ping{}).Encode(s.framed); err != nil {
+		return err
+	}
+	if err := (&protocol.Pong{}).Decode(s.reader); err != nil {
+		if ctx.Err() != nil {
+			return &TimeoutError{Op: "heartbeat", Duration: timeout, Err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// interruptOnDone makes any blocked read or write on conn return as soon as ctx
+// is done, by moving the connection deadline to the past. The returned function
+// must be called once the operations on conn are over.
+func interruptOnDone(ctx context.Context, conn *timeoutConn) func() {
+	finished := make(chan struct{})
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		select {
+		case <-ctx.Done():
+			conn.interrupt()
+		case <-finished:
+		}
+	}()
+	return func() {
+		close(finished)
+		<-watcherDone
+	}
+}
+
+// frameConn prepares every frame written to the connection: it signs the
+// payload with signer, if any, and then adds a digest of the signed payload
+// with the digest algorithm, if any, remembering it in lastDigest.
+type frameConn struct {
+	net.Conn
+	signer     *protocol.Signer
+	digest     string
+	lastDigest string
+}
+
+// WriteFrame implements protocol.FrameWriter.
+func (c *frameConn) WriteFrame(payload []byte) error {
+	if c.signer != nil {
+		signed, err := c.signer.Sign(payload)
+		if err != nil {
+			return fmt.Errorf("sign frame: %w", err)
+		}
+		payload = signed
+	}
+	if c.digest != "" {
+		digested, digest, err := protocol.AddDigest(payload, c.digest)
+		if err != nil {
+			return err
+		}
+		payload, c.lastDigest = digested, digest
+	}
+	return protocol.WriteFrame(c.Conn, payload)
+}
+
+// sentDigest returns the digest of the last frame written to conn, empty when
+// frames carry no digest.
+func sentDigest(conn net.Conn) string {
+	if framed, ok := conn.(*frameConn); ok {
+		return framed.lastDigest
+	}
+	return ""
+}
+
+// timeoutConn bounds every read and write on the wrapped connection with its
+// timeout, reporting the expired ones as *TimeoutError. Once interrupted, all
+// the pending and future operations fail right away.
+type timeoutConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	mu          sync.Mutex
+	interrupted bool
+	readGrace   time.Duration // added to the read timeout while the server holds a reply
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	timeout := c.readTimeout
+	if timeout > 0 {
+		timeout += c.readGrace
+	}
+	c.mu.Unlock()
+	if err := c.arm(c.Conn.SetReadDeadline, timeout); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b)
+	return n, tlsAlert(c.timeoutError("read", timeout, err))
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if err := c.arm(c.Conn.SetWriteDeadline, c.writeTimeout); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(b)
+	return n, tlsAlert(c.timeoutError("write", c.writeTimeout, err))
+}
+
+// arm sets the deadline of the next operation with setDeadline.
+func (c *timeoutConn) arm(setDeadline func(time.Time) error, timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.interrupted {
+		return os.ErrDeadlineExceeded
+	}
+	if timeout <= 0 {
+		return nil
+	}
+	return setDeadline(time.Now().Add(timeout))
+}
+
+// setReadGrace sets the time added to the read timeout.
+func (c *timeoutConn) setReadGrace(grace time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readGrace = grace
+}
+
+// interrupt makes the pending and future operations on the connection fail.
+func (c *timeoutConn) interrupt() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interrupted = true
+	c.Conn.SetDeadline(time.Unix(1, 0))
+}
+
+// timeoutError turns an expired deadline into a *TimeoutError, unless it was
+// caused by interrupt.
+func (c *timeoutConn) timeoutError(op string, timeout time.Duration, err error) error {
+	if err == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.interrupted {
+		return err
+	}
+	return &TimeoutError{Op: op, Duration: timeout, Err: err}
+}
@@ -0,0 +1,314 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// stubServer answers every frame it receives with the reply it builds for it,
+// closing each connection after closeAfter frames when closeAfter is not zero.
+// Frames for which the reply is nil are left unanswered.
+type stubServer struct {
+	listener   net.Listener
+	closeAfter int
+	reply      func(payload []byte) protocol.Message
+
+	mu       sync.Mutex
+	conns    int
+	payloads []string
+}
+
+// startStubServer runs a stubServer until the test ends. A nil reply answers
+// every frame with "ack_notify".
+func startStubServer(t *testing.T, closeAfter int, reply func(payload []byte) protocol.Message) *stubServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply == nil {
+		reply = func([]byte) protocol.Message { return &protocol.NotifyAck{} }
+	}
+	s := &stubServer{listener: listener, closeAfter: closeAfter, reply: reply}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *stubServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *stubServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for replies := 0; s.closeAfter == 0 || replies < s.closeAfter; replies++ {
+		payload, err := protocol.ReadFrame(reader)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.payloads = append(s.payloads, string(payload))
+		s.mu.Unlock()
+		reply := s.reply(payload)
+		if reply == nil {
+			continue
+		}
+		if err := reply.Encode(conn); err != nil {
+			return
+		}
+	}
+}
+
+func (s *stubServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+// received returns the payloads of the frames received so far.
+func (s *stubServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.payloads...)
+}
+
+func TestSessionConnections(t *testing.T) {
+	tests := []struct {
+		name       string
+		persistent bool
+		closeAfter int // replies after which the server drops the connection
+		want       int // connections opened for three messages
+	}{
+		{"persistent", true, 0, 1},
+		{"per message", false, 0, 3},
+		{"persistent reconnects after a broken socket", true, 1, 3},
+		{"persistent reconnects once the server closes", true, 2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startStubServer(t, tt.closeAfter, nil)
+			session := NewSession(ClientConfig{ServerAddress: server.listener.Addr().String(), Persistent: tt.persistent, DialRetry: DefaultDialRetry})
+			defer session.Close()
+
+			for i := 0; i < 3; i++ {
+				err := session.RoundTrip(context.Background(), &protocol.NotifyFinished{AgencyID: "1"}, &protocol.NotifyAck{})
+				if err != nil {
+					t.Fatalf("RoundTrip() #%d = %v", i+1, err)
+				}
+			}
+			if n := server.connections(); n != tt.want {
+				t.Errorf("connections = %d, want %d", n, tt.want)
+			}
+		})
+	}
+}
+
+// pings returns how many of payloads are pings.
+func pings(payloads []string) int {
+	n := 0
+	for _, payload := range payloads {
+		if payload == "ping\n" {
+			n++
+		}
+	}
+	return n
+}
+
+// connected reports whether session holds an open connection.
+func connected(session *Session) bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.conn != nil
+}
+
+// startSinkServer accepts connections and never reads from them, until the
+// test ends.
+func startSinkServer(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return listener
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	once := RetryPolicy{MaxAttempts: 1, Multiplier: 1}
+	tests := []struct {
+		name    string
+		op      string
+		config  ClientConfig
+		message func(conn net.Conn, reader *bufio.Reader) error
+	}{
+		{
+			name:   "read",
+			op:     "read",
+			config: ClientConfig{ReadTimeout: timeout},
+			message: func(conn net.Conn, reader *bufio.Reader) error {
+				if err := (&protocol.NotifyFinished{AgencyID: "1"}).Encode(conn); err != nil {
+					return err
+				}
+				return (&protocol.NotifyAck{}).Decode(reader)
+			},
+		},
+		{
+			name:   "write",
+			op:     "write",
+			config: ClientConfig{WriteTimeout: timeout},
+			message: func(conn net.Conn, reader *bufio.Reader) error {
+				// More than the socket buffers hold, on a server that stopped reading
+				_, err := conn.Write(make([]byte, 64<<20))
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The server never answers, nor reads
+			config := tt.config
+			config.ServerAddress = startSinkServer(t).Addr().String()
+			config.Persistent = true
+			config.DialRetry = once
+			session := NewSession(config)
+			defer session.Close()
+
+			start := time.Now()
+			err := session.Do(context.Background(), tt.message)
+			elapsed := time.Since(start)
+			var timeoutErr *TimeoutError
+			if !errors.As(err, &timeoutErr) || timeoutErr.Op != tt.op {
+				t.Fatalf("Do() = %v, want a %s timeout", err, tt.op)
+			}
+			if elapsed < timeout || elapsed > 10*timeout {
+				t.Errorf("Do() gave up after %v, want about %v", elapsed, timeout)
+			}
+			if connected(session) {
+				t.Error("the connection that timed out was kept")
+			}
+		})
+	}
+
+	t.Run("dial", func(t *testing.T) {
+		// A deadline that is over before the connection is established
+		server := startStubServer(t, 0, nil)
+		session := NewSession(ClientConfig{ServerAddress: server.listener.Addr().String(), DialTimeout: time.Nanosecond, DialRetry: once})
+		err := session.RoundTrip(context.Background(), &protocol.NotifyFinished{AgencyID: "1"}, &protocol.NotifyAck{})
+		var timeoutErr *TimeoutError
+		if !errors.As(err, &timeoutErr) || timeoutErr.Op != "dial" {
+			t.Errorf("RoundTrip() = %v, want a dial timeout", err)
+		}
+	})
+}
+
+func TestSessionHeartbeat(t *testing.T) {
+	const interval = 40 * time.Millisecond
+	tests := []struct {
+		name   string
+		silent bool // the server stops answering, pings included, after the first message
+	}{
+		{"pings keep an idle connection", false},
+		{"a dead peer is dropped", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answered := false
+			var mu sync.Mutex
+			server := startStubServer(t, 0, func(payload []byte) protocol.Message {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case !answered:
+					answered = true
+					return &protocol.NotifyAck{}
+				case tt.silent:
+					return nil
+				case string(payload) == "ping\n":
+					return &protocol.Pong{}
+				}
+				return &protocol.NotifyAck{}
+			})
+			session := NewSession(ClientConfig{
+				ServerAddress:     server.listener.Addr().String(),
+				Persistent:        true,
+				DialRetry:         DefaultDialRetry,
+				ReadTimeout:       2 * interval,
+				HeartbeatInterval: interval,
+			})
+			defer session.Close()
+
+			err := session.RoundTrip(context.Background(), &protocol.NotifyFinished{AgencyID: "1"}, &protocol.NotifyAck{})
+			if err != nil {
+				t.Fatalf("RoundTrip() = %v", err)
+			}
+
+			// Idle for several intervals: the pings are answered, or the one
+			// left unanswered drops the connection within its read timeout
+			time.Sleep(8 * interval)
+			if n := pings(server.received()); n < 1 || (!tt.silent && n < 2) {
+				t.Errorf("pings = %d, want one per idle interval", n)
+			}
+			if alive := connected(session); alive == tt.silent {
+				t.Fatalf("connection open = %v, want %v", alive, !tt.silent)
+			}
+
+			// The next message goes over the same connection, or a new one
+			// replaces the dropped one
+			err = session.RoundTrip(context.Background(), &protocol.NotifyFinished{AgencyID: "1"}, &protocol.NotifyAck{})
+			if tt.silent {
+				// The server doesn't answer on the new connection either
+				var timeoutErr *TimeoutError
+				if !errors.As(err, &timeoutErr) {
+					t.Errorf("RoundTrip() = %v, want a read timeout", err)
+				}
+			} else if err != nil {
+				t.Errorf("RoundTrip() = %v", err)
+			}
+			want := 1
+			if tt.silent {
+				want = 2
+			}
+			if n := server.connections(); n != want {
+				t.Errorf("connections = %d, want %d", n, want)
+			}
+		})
+	}
+}
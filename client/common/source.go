@@ -0,0 +1,214 @@
+package common
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// Format is the encoding of the bets of a source.
+type Format string
+
+// Formats of a bets source.
+const (
+	FormatAuto  Format = ""       // detected from the extension of the file, CSV when unknown
+	FormatCSV   Format = "csv"    // "first_name,last_name,document,birthdate,number" lines
+	FormatCSVGz Format = "csv.gz" // gzip compressed CSV
+	FormatJSONL Format = "jsonl"  // one JSON object per line, with the fields named as the CSV columns
+)
+
+// StdinPath is the path that makes the bets be read from the standard input.
+const StdinPath = "-"
+
+// ParseFormat parses the name of a format, "auto" or empty meaning FormatAuto.
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(strings.ToLower(strings.TrimSpace(name))); format {
+	case "auto", FormatAuto:
+		return FormatAuto, nil
+	case FormatCSV, FormatCSVGz, FormatJSONL:
+		return format, nil
+	}
+	return FormatAuto, fmt.Errorf("unknown input format %q, expected auto, csv, csv.gz or jsonl", name)
+}
+
+// DetectFormat returns the format of the bets file at path given its extension.
+func DetectFormat(path string) Format {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return FormatCSVGz
+	case strings.HasSuffix(path, ".jsonl"), strings.HasSuffix(path, ".ndjson"):
+		return FormatJSONL
+	}
+	return FormatCSV
+}
+
+// Record is an entry of a bets source.
+type Record struct {
+	Line    int    // line where the record ends in the source, starting at 1
+	Offset  int64  // bytes of the uncompressed source up to the end of the record
+	Content string // the record as read, empty for blank lines and headers, which hold no bet
+	Header  bool   // whether the record is the header of the source
+	Bet     protocol.Bet
+	Err     error // why Content is not a valid bet
+}
+
+// BetSource yields the records of a source of bets, in order.
+type BetSource interface {
+	// Next returns the next record, or io.EOF after the last one.
+	Next() (Record, error)
+}
+
+// NewBetSource reads the bets of r, encoded in the given format and character
+// set. FormatAuto is read as CSV, laid out as schema says.
+func NewBetSource(r io.Reader, format Format, encoding Encoding, schema CSVSchema) (BetSource, error) {
+	return newLineSource(r, format, encoding, schema, 0, 0)
+}
+
+// recordDecoder parses the records of a line based source.
+type recordDecoder interface {
+	// Complete reports whether record, made of the given amount of lines, holds
+	// a whole record, or it continues in the next line.
+	Complete(record string, lines int) bool
+	// Decode parses a record. header is true for records that describe the
+	// source instead of holding a bet; an error along with it means the rest
+	// of the source can't be read.
+	Decode(record string) (bet protocol.Bet, header bool, err error)
+}
+
+// jsonDecoder parses JSON Lines records.
+type jsonDecoder struct{}
+
+// Complete returns true, JSON records can't span several lines.
+func (jsonDecoder) Complete(record string, lines int) bool { return true }
+
+// Decode parses a JSON object with the bet fields.
+func (jsonDecoder) Decode(record string) (protocol.Bet, bool, error) {
+	bet, err := protocol.ParseJSONBet(record)
+	return bet, false, err
+}
+
+// lineSource reads records made of one or more lines, converting them to UTF-8
+// with text and parsing them with decoder. Lines and offsets count the bytes of
+// the source as they are, before the conversion.
+type lineSource struct {
+	reader  *bufio.Reader
+	text    textDecoder
+	decoder recordDecoder
+	line    int
+	offset  int64
+}
+
+// newLineSource reads the records of r, encoded in the given format, skipping the
+// first offset bytes of the uncompressed source, which hold its first line lines.
+// Plain sources that can seek jump right after them; compressed ones are read
+// and discarded up to there. The first record of CSV sources is read anyway,
+// since it may be the header that says where each column is.
+func newLineSource(r io.Reader, format Format, encoding Encoding, schema CSVSchema, offset int64, line int) (*lineSource, error) {
+	text, err := newTextDecoder(encoding)
+	if err != nil {
+		return nil, err
+	}
+	source := &lineSource{text: text, decoder: newCSVDecoder(schema)}
+	switch format {
+	case FormatAuto, FormatCSV:
+	case FormatCSVGz:
+		compressed, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("open gzip source: %w", err)
+		}
+		r = compressed
+	case FormatJSONL:
+		source.decoder = jsonDecoder{}
+	default:
+		return nil, fmt.Errorf("unknown input format %q", format)
+	}
+	source.reader = bufio.NewReader(r)
+	if offset == 0 {
+		return source, nil
+	}
+
+	if _, ok := source.decoder.(*csvDecoder); ok && schema.Header != HeaderAbsent {
+		for source.offset < offset {
+			record, err := source.Next()
+			if err != nil {
+				return nil, fmt.Errorf("read the header of the source: %w", err)
+			}
+			if record.Content != "" || record.Header {
+				break
+			}
+		}
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		source.reader.Reset(r)
+	} else if _, err := source.reader.Discard(int(offset - source.offset)); err != nil {
+		return nil, fmt.Errorf("skip the %d bytes already sent: %w", offset, err)
+	}
+	source.line, source.offset = line, offset
+	return source, nil
+}
+
+// Next reads the next record of the source.
+func (s *lineSource) Next() (Record, error) {
+	var content strings.Builder
+	for lines := 1; ; lines++ {
+		raw, err := s.reader.ReadString('\n')
+		if err != nil && (err != io.EOF || raw == "") {
+			if err == io.EOF && content.Len() > 0 {
+				// The source ends within the record, which is then incomplete
+				break
+			}
+			return Record{}, err
+		}
+		s.line++
+		s.offset += int64(len(raw))
+		content.WriteString(raw)
+		if err == io.EOF || s.decoder.Complete(content.String(), lines) {
+			break
+		}
+	}
+
+	record := Record{Line: s.line, Offset: s.offset, Content: strings.TrimSpace(content.String())}
+	if record.Content == "" {
+		return record, nil
+	}
+	text, err := s.text(record.Content)
+	if err != nil {
+		// Rejects reports and logs are UTF-8, so the bytes that can't be decoded are replaced
+		record.Content = strings.ToValidUTF8(record.Content, "\ufffd")
+		record.Err = err
+		return record, nil
+	}
+	record.Content = text
+
+	record.Bet, record.Header, record.Err = s.decoder.Decode(record.Content)
+	if record.Header {
+		if record.Err != nil {
+			return record, record.Err
+		}
+		record.Content = ""
+	}
+	return record, nil
+}
+
+// betSlice yields the given bets, the Line of each being its position.
+type betSlice struct {
+	bets []protocol.Bet
+	next int
+}
+
+// Next returns the next bet, validated.
+func (s *betSlice) Next() (Record, error) {
+	if s.next == len(s.bets) {
+		return Record{}, io.EOF
+	}
+	bet := s.bets[s.next]
+	s.next++
+	return Record{Line: s.next, Content: bet.String(), Bet: bet, Err: bet.Validate()}, nil
+}
@@ -0,0 +1,165 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLineSourceResumesCompressed(t *testing.T) {
+	const input = "Ana,Paz,1,1990-01-01,1\nLuis,Paz,2,1990-01-01,2\nEva,Paz,3,1990-01-01,3\n"
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(input))
+	writer.Close()
+
+	// Resume after the first line, at an offset of the uncompressed source
+	offset := int64(len("Ana,Paz,1,1990-01-01,1\n"))
+	source, err := newLineSource(bytes.NewReader(compressed.Bytes()), FormatCSVGz, EncodingUTF8, CSVSchema{}, offset, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var documents []string
+	for {
+		record, err := source.Next()
+		if err != nil {
+			break
+		}
+		if record.Err != nil {
+			t.Fatalf("record of line %d: %v", record.Line, record.Err)
+		}
+		if record.Line != len(documents)+2 {
+			t.Errorf("record line = %d, want %d", record.Line, len(documents)+2)
+		}
+		documents = append(documents, record.Bet.Document)
+	}
+	if strings.Join(documents, ",") != "2,3" {
+		t.Errorf("documents = %q, want those after the offset", documents)
+	}
+	if source.offset != int64(len(input)) {
+		t.Errorf("offset = %d, want %d", source.offset, len(input))
+	}
+}
+
+func TestSendFileResumesCompressed(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte("Ana,Paz,1,1990-01-01,1\nLuis,Paz,2,1990-01-01,2\nEva,Paz,3,1990-01-01,3\n"))
+	writer.Close()
+	hash := sha256.Sum256(compressed.Bytes())
+
+	server := startStubServer(t, 0, ackAll)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agency-1.csv.gz")
+	if err := os.WriteFile(path, compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(ClientConfig{
+		ID:            "1",
+		ServerAddress: server.listener.Addr().String(),
+		MaxBatch:      10,
+		StateDir:      dir,
+		Checkpoint:    true,
+	})
+	defer client.session.Close()
+
+	checkpoint := Checkpoint{
+		Source:     path,
+		SourceHash: hex.EncodeToString(hash[:]),
+		Offset:     int64(len("Ana,Paz,1,1990-01-01,1\n")),
+		Line:       1,
+		Sent:       1,
+	}
+	if err := checkpoint.Save(client.checkpointPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := client.SendFile(context.Background(), path)
+	if err != nil {
+		t.Fatalf("SendFile() = %v", err)
+	}
+	if upload.Stored != 3 {
+		t.Errorf("SendFile() = %d stored, want 3", upload.Stored)
+	}
+	payloads := server.received()
+	if len(payloads) != 1 || strings.Contains(payloads[0], ",1,") || strings.Count(payloads[0], "\n") != 3 {
+		t.Errorf("batches = %q, want one with lines 2-3", payloads)
+	}
+}
+
+func TestJSONLSourceRejectsMalformedLine(t *testing.T) {
+	const input = `{"first_name":"Ana","last_name":"Paz","document":"1","birthdate":"1990-01-01","number":1}` + "\n" +
+		"\n" +
+		`{"first_name":"Luis","last_name":"Paz","document":"2",` + "\n" +
+		`{"first_name":"Eva","last_name":"Paz","document":"3","birthdate":"1990-01-01","number":3}` + "\n"
+	source, err := NewBetSource(strings.NewReader(input), FormatJSONL, EncodingUTF8, CSVSchema{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(ClientConfig{ID: "1", MaxBatch: 10})
+	valid, rejected, err := client.Validate(source)
+	if err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	if valid != 2 || len(rejected) != 1 {
+		t.Fatalf("Validate() = %d valid, %+v rejected, want 2 valid and 1 rejected", valid, rejected)
+	}
+	if rejected[0].Line != 3 || !strings.Contains(rejected[0].Reason.Error(), "invalid JSON bet") {
+		t.Errorf("rejected bet = %+v, want line 3 as invalid JSON", rejected[0])
+	}
+}
+
+func TestSendFileStdinIgnoresCheckpoint(t *testing.T) {
+	server := startStubServer(t, 0, ackAll)
+	dir := t.TempDir()
+	client := NewClient(ClientConfig{
+		ID:            "1",
+		ServerAddress: server.listener.Addr().String(),
+		MaxBatch:      10,
+		StateDir:      dir,
+		Checkpoint:    true,
+	})
+	defer client.session.Close()
+
+	// A checkpoint of another upload, which the standard input must not resume
+	checkpoint := Checkpoint{Source: StdinPath, Offset: 23, Line: 1, Sent: 1}
+	if err := checkpoint.Save(client.checkpointPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	stdin, err := os.CreateTemp(dir, "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	if _, err := stdin.WriteString("Ana,Paz,1,1990-01-01,1\nLuis,Paz,2,1990-01-01,2\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stdin.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	previous := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = previous }()
+
+	upload, err := client.SendFile(context.Background(), StdinPath)
+	if err != nil {
+		t.Fatalf("SendFile() = %v", err)
+	}
+	if upload.Stored != 2 {
+		t.Errorf("SendFile() = %d stored, want both lines", upload.Stored)
+	}
+	saved, err := LoadCheckpoint(client.checkpointPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved == nil || saved.Line != 1 || saved.Sent != 1 {
+		t.Errorf("checkpoint = %+v, want it untouched", saved)
+	}
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// TLSFiles are the settings of a TLS connection to the server, as given in the
+// tls section of config.yaml.
+type TLSFiles struct {
+	CAFile     string // CA bundle the server certificate must be signed by, the system roots when empty
+	CertFile   string // client certificate, for servers that require mutual TLS
+	KeyFile    string // private key of the client certificate
+	ServerName string // name the server certificate must be valid for, the host of the server address when empty
+	MinVersion string // oldest TLS version accepted, "1.2" or "1.3", 1.2 when empty
+}
+
+// Config builds the TLS configuration of the client.
+func (f TLSFiles) Config() (*tls.Config, error) {
+	minVersion, err := protocol.ParseTLSVersion(f.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{ServerName: f.ServerName, MinVersion: minVersion}
+	if f.CAFile != "" {
+		if config.RootCAs, err = protocol.LoadCertPool(f.CAFile); err != nil {
+			return nil, fmt.Errorf("load TLS CA bundle: %w", err)
+		}
+	}
+	if (f.CertFile == "") != (f.KeyFile == "") {
+		return nil, errors.New("the TLS client certificate and key must be given together")
+	}
+	if f.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// handshake runs the TLS handshake over conn, which is closed if it fails.
+// Failures are wrapped with protocol.ErrTLS, except timeouts and cancellations.
+func handshake(ctx context.Context, conn net.Conn, address string, config *tls.Config) (net.Conn, error) {
+	if config.ServerName == "" {
+		config = config.Clone()
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = host
+		} else {
+			config.ServerName = address
+		}
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		var netErr net.Error
+		if ctx.Err() != nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", protocol.ErrTLS, err)
+	}
+	return tlsConn, nil
+}
+
+// tlsAlert wraps with protocol.ErrTLS the alerts the server sends after the
+// handshake, e.g. when it refuses the client certificate with TLS 1.3.
+func tlsAlert(err error) error {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		return fmt.Errorf("%w: %v", protocol.ErrTLS, err)
+	}
+	return err
+}
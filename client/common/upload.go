@@ -0,0 +1,404 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// Upload is the outcome of sending bets to the server.
+type Upload struct {
+	Stored   int           // bets acknowledged by the server, including those of resumed runs
+	Rejected []RejectedBet // bets that were not stored
+}
+
+// RejectedBet is a bet that was not stored, either because it is not valid or
+// because the server refused it even when sent on its own.
+type RejectedBet struct {
+	Line    int    // line of the bet in its source, starting at 1
+	Content string // the bet as read from the source
+	Reason  error
+}
+
+// SendFile sends the bets of the file at path, or of the standard input when
+// path is StdinPath. Unless ClientConfig.InputFormat says otherwise, the format
+// is detected from the extension of the file. When checkpoints are enabled the
+// progress is saved in the state dir, so an interrupted upload of the same file
+// resumes after the last acknowledged batch; the standard input can't be resumed.
+// Records that are not valid bets, or that the server rejects, are also written
+// to "agency-{ID}-rejects.txt" in the state dir.
+func (c *Client) SendFile(ctx context.Context, path string) (*Upload, error) {
+	report := c.newRejectsReport()
+	if report != nil {
+		defer report.Close()
+	}
+	if path == StdinPath {
+		source, err := NewBetSource(os.Stdin, c.inputFormat(path), c.config.InputEncoding, c.config.CSV)
+		if err != nil {
+			return nil, err
+		}
+		return c.sendReported(ctx, source, &Checkpoint{Source: path}, false, report)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	progress, err := c.loadProgress(file, path)
+	if err != nil {
+		return nil, err
+	}
+	if progress.Line > 0 {
+		clientLog.Infof("action: resume_upload | result: success | client_id: %v | line: %v | sent_bets: %v",
+			c.config.ID, progress.Line, progress.Sent)
+		if report != nil {
+			report.SetAppend(true)
+		}
+	}
+	source, err := newLineSource(file, c.inputFormat(path), c.config.InputEncoding, c.config.CSV, progress.Offset, progress.Line)
+	if err != nil {
+		return nil, err
+	}
+	// A resumed upload keeps its ID, so the batches it sends again are recognized.
+	// Sequences only grow, so new batches never reuse one this client already sent.
+	if progress.Upload != "" {
+		c.upload = progress.Upload
+	}
+	progress.Upload = c.upload
+	if last := progress.lastSequence(); last > c.lastSequence {
+		c.lastSequence = last
+	}
+
+	return c.sendReported(ctx, source, progress, c.config.Checkpoint, report)
+}
+
+// SendFrom sends the bets read from source, encoded in ClientConfig.InputFormat,
+// CSV by default. No checkpoint is kept, so an interrupted upload must be sent
+// again from the start.
+func (c *Client) SendFrom(ctx context.Context, source io.Reader) (*Upload, error) {
+	bets, err := NewBetSource(source, c.config.InputFormat, c.config.InputEncoding, c.config.CSV)
+	if err != nil {
+		return nil, err
+	}
+	return c.send(ctx, bets, &Checkpoint{}, false, nil)
+}
+
+// SendBets sends the given bets. The Line of the rejected ones is their
+// position in bets, starting at 1.
+func (c *Client) SendBets(ctx context.Context, bets []protocol.Bet) (*Upload, error) {
+	return c.send(ctx, &betSlice{bets: bets}, &Checkpoint{}, false, nil)
+}
+
+// inputFormat returns the format of the bets file at path.
+func (c *Client) inputFormat(path string) Format {
+	if c.config.InputFormat != FormatAuto {
+		return c.config.InputFormat
+	}
+	return DetectFormat(path)
+}
+
+// newRejectsReport returns the report of the rejected bets of the agency, or
+// nil when there is no state dir to write it to.
+func (c *Client) newRejectsReport() *RejectsReport {
+	if c.config.StateDir == "" {
+		return nil
+	}
+	return NewRejectsReport(filepath.Join(c.config.StateDir, fmt.Sprintf("agency-%s-rejects.txt", c.config.ID)))
+}
+
+// sendReported sends the bets of source like send, logging where the rejected
+// ones were reported.
+func (c *Client) sendReported(ctx context.Context, source BetSource, progress *Checkpoint, persist bool, report *RejectsReport) (*Upload, error) {
+	upload, err := c.send(ctx, source, progress, persist, report)
+	if report != nil && report.Count() > 0 {
+		clientLog.Warningf("action: rejected_bets | result: success | client_id: %v | rejected: %v | report: %s",
+			c.config.ID, report.Count(), report.Path())
+	}
+	return upload, err
+}
+
+// send reads the records of source, which starts after the part already covered
+// by progress. Records that are not valid bets are rejected and skipped
+// so they don't make the server reject a whole batch. Batches the server rejects
+// anyway are bisected, so only the offending bets are rejected. Rejected bets are
+// also written to report, if not nil.
+// Whenever the batch size is reached, or the next bet would take the encoded batch
+// over c.config.MaxBatchBytes, it hands the batch to a batchPipeline, which keeps
+// up to c.config.InFlight batches waiting for their ack, and starts a new batch
+// before continuing to read further lines. The batch size is c.config.MaxBatch, or
+// adapts to the ack latency when c.config.AdaptiveBatch is set.
+// With persist, whenever a contiguous run of batches is acknowledged the progress
+// is saved in a checkpoint, so a restarted client resumes right after it.
+// When ctx is done no more lines are read and the batches in flight get
+// c.config.ShutdownGrace to be acknowledged before they are abandoned.
+// The returned Upload counts the bets acknowledged even when an error is returned.
+func (c *Client) send(ctx context.Context, source BetSource, progress *Checkpoint, persist bool, report *RejectsReport) (*Upload, error) {
+	if err := c.negotiate(ctx); err != nil {
+		return &Upload{Stored: progress.Sent}, err
+	}
+	// Batches in flight when the previous run stopped are rebuilt with the same
+	// boundaries and sequences, since the server may have stored them.
+	replay := progress.Pending
+	progress.Pending = nil
+	trackPending := persist && c.config.Sequenced
+
+	sizer := newBatchSizer(c.config)
+	maxBytes := c.config.MaxBatchBytes
+	headerSize := c.batchHeaderSize()
+
+	sent := progress.Sent // bets acknowledged by previous runs
+	upload := &Upload{Stored: sent}
+	// reject records a bet that is not going to be stored
+	reject := func(bet RejectedBet) error {
+		upload.Rejected = append(upload.Rejected, bet)
+		if report == nil {
+			return nil
+		}
+		if err := report.Add(bet.Line, bet.Content, bet.Reason); err != nil {
+			return fmt.Errorf("write rejects report: %w", err)
+		}
+		return nil
+	}
+
+	sendCtx, cancelSend := withGrace(ctx, c.config.ShutdownGrace)
+	defer cancelSend()
+	pipeline := newBatchPipeline(sendCtx, c, c.config.InFlight, func(job *batchJob) error {
+		for _, bet := range job.rejected {
+			if err := reject(bet); err != nil {
+				return err
+			}
+		}
+		sizer.Observe(job.latency, len(job.rejected) > 0)
+		upload.Stored += len(job.request.Lines) - len(job.rejected)
+		if !persist {
+			return nil
+		}
+		if trackPending {
+			progress.Pending = progress.Pending[1:]
+		}
+		return c.saveProgress(progress, job.offset, job.line, job.request.Sequence, upload.Stored)
+	})
+	defer pipeline.Close()
+	// stored waits for the batches in flight and returns upload with the bets
+	// acknowledged so far. After a failure it counts more than the checkpoint
+	// covers, since batches acknowledged after the one that failed are stored too.
+	stored := func() *Upload {
+		pipeline.Close()
+		upload.Stored = sent + pipeline.Stored()
+		return upload
+	}
+
+	var batch []string
+	var batchLines []int
+	batchBytes := headerSize
+	lineNumber := progress.Line
+	offset := progress.Offset
+
+	// submit hands the current batch, which ends at the given line and offset, to
+	// the pipeline. A zero sequence gives the batch the next one of the upload.
+	submit := func(endOffset int64, endLine int, sequence uint64) error {
+		job := &batchJob{request: c.newBatchRequest(batch, sequence), lines: batchLines, offset: endOffset, line: endLine}
+		if trackPending {
+			// The boundary is recorded before sending, so it is known even if the
+			// client dies before the ack arrives.
+			progress.Pending = append(progress.Pending, PendingBatch{Line: endLine, Sequence: job.request.Sequence})
+			if err := c.saveCheckpoint(progress); err != nil {
+				return err
+			}
+		}
+		if err := pipeline.Submit(ctx, job); err != nil {
+			return err
+		}
+		// The pipeline keeps the slices until the batch is acknowledged.
+		batch, batchLines, batchBytes = nil, nil, headerSize
+		if c.config.ThinkTime > 0 {
+			sleepContext(ctx, c.config.ThinkTime)
+		}
+		return nil
+	}
+
+	for ctx.Err() == nil {
+		record, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stored(), err
+		}
+		previousOffset, previousLine := offset, lineNumber
+		lineNumber, offset = record.Line, record.Offset
+
+		if record.Content != "" {
+			encoded, err := c.encodeBet(record, headerSize)
+			betSize := len(encoded) + 1
+			if err != nil {
+				clientLog.Debugf("action: parse_bet | result: fail | line: %d | error: %v", lineNumber, err)
+				if err := reject(RejectedBet{Line: lineNumber, Content: record.Content, Reason: err}); err != nil {
+					return stored(), err
+				}
+			} else {
+				// If the bet doesn't fit in the batch, send the batch without it.
+				if len(replay) == 0 && maxBytes > 0 && len(batch) > 0 && batchBytes+betSize > maxBytes {
+					if err := submit(previousOffset, previousLine, 0); err != nil {
+						if ctx.Err() != nil {
+							break
+						}
+						return stored(), err
+					}
+				}
+				batch = append(batch, encoded)
+				batchLines = append(batchLines, lineNumber)
+				batchBytes += betSize
+			}
+		}
+
+		// If the batch is full, send it to the server.
+		full := len(batch) >= sizer.Size()
+		var sequence uint64
+		if len(replay) > 0 {
+			full = lineNumber == replay[0].Line
+			if full {
+				sequence = replay[0].Sequence
+				replay = replay[1:]
+			}
+		}
+		if full && len(batch) > 0 {
+			if err := submit(offset, lineNumber, sequence); err != nil {
+				if ctx.Err() != nil {
+					break
+				}
+				return stored(), err
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		// Wait for the batches in flight within the grace period. Whatever got
+		// acknowledged in order is already recorded in the checkpoint.
+		if err := pipeline.Close(); err != nil {
+			clientLog.Warningf("action: send_chunks | result: in_progress | client_id: %v | message: batches in flight abandoned | error: %v",
+				c.config.ID, err)
+		}
+		upload := stored()
+		clientLog.Infof("action: send_chunks | result: interrupted | client_id: %v | acked_bets: %v", c.config.ID, upload.Stored)
+		return upload, ctx.Err()
+	}
+
+	// Send the last partial batch (if any).
+	if len(batch) > 0 {
+		if err := submit(offset, lineNumber, 0); err != nil {
+			return stored(), err
+		}
+	}
+	if err := pipeline.Close(); err != nil {
+		return stored(), err
+	}
+	if persist {
+		if err := c.saveProgress(progress, offset, lineNumber, c.lastSequence, upload.Stored); err != nil {
+			return upload, err
+		}
+	}
+
+	if c.config.AdaptiveBatch {
+		clientLog.Infof("action: batch_size | result: success | client_id: %v | settled_size: %v", c.config.ID, sizer.Size())
+	}
+	clientLog.Infof("action: all_batches_sent | result: success | client_id: %v | total_bets: %v",
+		c.config.ID, upload.Stored)
+	return upload, nil
+}
+
+// ValidateFile checks the bets of the file at path, or of the standard input
+// when path is StdinPath, like Validate.
+func (c *Client) ValidateFile(path string) (int, []RejectedBet, error) {
+	file := os.Stdin
+	if path != StdinPath {
+		var err error
+		if file, err = os.Open(path); err != nil {
+			return 0, nil, err
+		}
+		defer file.Close()
+	}
+	source, err := NewBetSource(file, c.inputFormat(path), c.config.InputEncoding, c.config.CSV)
+	if err != nil {
+		return 0, nil, err
+	}
+	return c.Validate(source)
+}
+
+// ValidateFrom checks the bets read from r, encoded like SendFrom reads them,
+// like Validate.
+func (c *Client) ValidateFrom(r io.Reader) (int, []RejectedBet, error) {
+	source, err := NewBetSource(r, c.config.InputFormat, c.config.InputEncoding, c.config.CSV)
+	if err != nil {
+		return 0, nil, err
+	}
+	return c.Validate(source)
+}
+
+// Validate checks the bets of source the same way they are checked before being
+// sent, without contacting the server. Since the server may not read them, bets
+// with fields holding commas or quotes are rejected unless an earlier exchange
+// with the server said it does. It returns the amount of valid bets and the
+// rejected ones.
+func (c *Client) Validate(source BetSource) (int, []RejectedBet, error) {
+	headerSize := c.batchHeaderSize()
+	valid := 0
+	var rejected []RejectedBet
+	for {
+		record, err := source.Next()
+		if err == io.EOF {
+			return valid, rejected, nil
+		}
+		if err != nil {
+			return valid, rejected, err
+		}
+		if record.Content == "" {
+			continue
+		}
+		if _, err := c.encodeBet(record, headerSize); err != nil {
+			rejected = append(rejected, RejectedBet{Line: record.Line, Content: record.Content, Reason: err})
+			continue
+		}
+		valid++
+	}
+}
+
+// batchHeaderSize returns the size of the header of the longest possible batch,
+// so the room left for bets is c.config.MaxBatchBytes minus it.
+func (c *Client) batchHeaderSize() int {
+	return (&protocol.BatchRequest{AgencyID: c.config.ID, Upload: c.upload, Sequence: math.MaxUint64}).Size()
+}
+
+// encodeBet returns the bet of record as sent to the server. It fails if the
+// record is not a valid bet, if it has fields with commas or quotes and the
+// server is not known to read them, or if the bet can't fit in a batch of
+// c.config.MaxBatchBytes, given the size of the batch header.
+func (c *Client) encodeBet(record Record, headerSize int) (string, error) {
+	if record.Err != nil {
+		return "", record.Err
+	}
+	if record.Bet.Quoted() {
+		// Legacy servers split bet lines on every comma, so quoted fields are
+		// only sent once the hello exchange says the server reads them
+		if c.server == nil {
+			return "", fmt.Errorf("bet has fields with commas or quotes, which are only sent to servers that agree on them in the hello exchange")
+		}
+		if !c.server.Has(protocol.FeatureQuotedBets) {
+			return "", fmt.Errorf("bet has fields with commas or quotes, which the server can't read")
+		}
+	}
+	encoded := record.Bet.String()
+	betSize := len(encoded) + 1
+	if maxBytes := c.config.MaxBatchBytes; maxBytes > 0 && headerSize+betSize > maxBytes {
+		return "", fmt.Errorf("bet takes %d bytes, batches of batch.maxBytes (%d) only have room for %d",
+			betSize, maxBytes, maxBytes-headerSize)
+	}
+	return encoded, nil
+}
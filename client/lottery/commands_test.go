@@ -0,0 +1,55 @@
+package lottery_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+)
+
+func TestValidate(t *testing.T) {
+	// No server listens there: validating never contacts it
+	client, err := lottery.New("1", lottery.WithServer("127.0.0.1:1"), lottery.WithMaxBatchBytes(128))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	input := "Ana,Paz,1,1990-01-01,1\n" +
+		"Ana,Paz,2,17/03/1999,2\n" +
+		"\n" +
+		"Luis,Paz,3,1990-01-01,3\n" +
+		strings.Repeat("A", 128) + ",Paz,4,1990-01-01,4\n"
+	valid, rejected, err := client.Validate(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	if valid != 2 || len(rejected) != 2 || rejected[0].Line != 2 || rejected[1].Line != 5 {
+		t.Errorf("Validate() = %d, %+v, want 2 valid bets and lines 2 and 5 rejected", valid, rejected)
+	}
+}
+
+func TestPing(t *testing.T) {
+	server := startServer(t, 1)
+	client, err := lottery.New("1", lottery.WithServer(server.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Ping(context.Background()); err != nil {
+		t.Errorf("Ping() = %v", err)
+	}
+
+	server.Shutdown()
+	down, err := lottery.New("1", lottery.WithServer(server.Addr().String()),
+		lottery.WithDialRetry(lottery.RetryPolicy{MaxAttempts: 1, Multiplier: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+	if _, err := down.Ping(context.Background()); err == nil || errors.Is(err, context.Canceled) {
+		t.Errorf("Ping() of a stopped server = %v, want a connection error", err)
+	}
+}
@@ -0,0 +1,219 @@
+// Package lottery lets other programs send the bets of an agency to the lottery
+// server and read its winners, the same way the client binary does.
+//
+//	client, err := lottery.New("1", lottery.WithServer("server:12345"))
+//	if err != nil {
+//		return err
+//	}
+//	defer client.Close()
+//	ack, err := client.SubmitBets(ctx, bets)
+//	...
+//	if err := client.Finish(ctx); err != nil {
+//		return err
+//	}
+//	winners, err := client.Winners(ctx)
+//
+// Errors can be told apart with errors.Is and the Err* values of this package.
+package lottery
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// Bet is a single bet of an agency.
+type Bet = protocol.Bet
+
+// RejectedBet is a bet that was not stored, with the reason why.
+type RejectedBet = common.RejectedBet
+
+// RetryPolicy controls how an operation with the server is retried.
+type RetryPolicy = common.RetryPolicy
+
+// Metrics receives the outcome of every batch sent.
+type Metrics = common.Metrics
+
+// TLSFiles are the files and settings of a TLS connection to the server. Their
+// Config method builds the configuration taken by WithTLS.
+type TLSFiles = common.TLSFiles
+
+// Format is the encoding of a bets file or stream.
+type Format = common.Format
+
+// Formats of the bets, set with WithInputFormat.
+const (
+	FormatAuto  = common.FormatAuto  // detected from the file extension: .gz, .jsonl or .ndjson, otherwise CSV
+	FormatCSV   = common.FormatCSV   // "first_name,last_name,document,birthdate,number" lines
+	FormatCSVGz = common.FormatCSVGz // gzip compressed CSV
+	FormatJSONL = common.FormatJSONL // one JSON object per line, with the fields named as the CSV columns
+)
+
+// Encoding is the character set of bets files and streams, set with WithInputEncoding.
+type Encoding = common.Encoding
+
+// Encodings of the bets. Bets are converted to UTF-8 before being sent.
+const (
+	EncodingUTF8        = common.EncodingUTF8        // the default, bets that are not valid UTF-8 are rejected
+	EncodingWindows1252 = common.EncodingWindows1252 // as exported by most spreadsheets on Windows
+	EncodingLatin1      = common.EncodingLatin1      // ISO-8859-1
+	EncodingAuto        = common.EncodingAuto        // each bet is kept if valid UTF-8, read as Windows-1252 otherwise
+)
+
+// CSVSchema describes the layout of CSV bets, set with WithCSVSchema.
+type CSVSchema = common.CSVSchema
+
+// HeaderMode says whether CSV bets start with a header row.
+type HeaderMode = common.HeaderMode
+
+// Header modes of a CSVSchema.
+const (
+	HeaderAuto    = common.HeaderAuto    // the first row is a header if it has the names of the columns
+	HeaderPresent = common.HeaderPresent // the first row is always a header
+	HeaderAbsent  = common.HeaderAbsent  // there is no header, columns are found by position
+)
+
+// Stdin is the path that makes SubmitFile and ValidateFile read the standard input.
+const Stdin = common.StdinPath
+
+// Errors returned by the Client, wrapped, so they must be checked with errors.Is.
+var (
+	ErrServerClosed = protocol.ErrServerClosed // the server closed the connection before replying
+	ErrTimeout      = protocol.ErrTimeout      // the server did not answer in time
+	ErrProtocol     = protocol.ErrProtocol     // the server reply could not be parsed
+	ErrRejected     = protocol.ErrRejected     // the server refused the request
+	ErrDrawNotReady = protocol.ErrDrawNotReady // the draw was not done before polling gave up
+	ErrTLS          = protocol.ErrTLS          // the TLS handshake with the server failed
+	ErrUnauthorized = protocol.ErrUnauthorized // the server refused the signature of a request
+	ErrCorrupted    = protocol.ErrCorrupted    // a request or its ack did not match its digest, even after resending it
+)
+
+// Ack is the outcome of a submission.
+type Ack struct {
+	Stored   int           // bets acknowledged by the server, including those of resumed uploads
+	Rejected []RejectedBet // bets that were not stored
+}
+
+// Client talks to the lottery server on behalf of an agency. It is not safe
+// for concurrent use.
+type Client struct {
+	client *common.Client
+}
+
+// New creates a client for the given agency. The server address must be given
+// with WithServer; every other option has a default.
+func New(agencyID string, options ...Option) (*Client, error) {
+	if agencyID == "" {
+		return nil, errors.New("lottery: empty agency ID")
+	}
+	config := common.ClientConfig{
+		ID:        agencyID,
+		MaxBatch:  defaultBatchSize,
+		InFlight:  1,
+		Handshake: true,
+		DrawWait:  defaultDrawWait,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+	if config.ServerAddress == "" {
+		return nil, errors.New("lottery: no server address, set it with WithServer")
+	}
+	for _, policy := range []RetryPolicy{config.DialRetry, config.SendRetry, config.WinnersRetry} {
+		if policy == (RetryPolicy{}) {
+			continue
+		}
+		if err := policy.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	format, err := common.ParseFormat(string(config.InputFormat))
+	if err != nil {
+		return nil, err
+	}
+	config.InputFormat = format
+	if config.InputEncoding, err = common.ParseEncoding(string(config.InputEncoding)); err != nil {
+		return nil, err
+	}
+	if config.CSV.Header, err = common.ParseHeaderMode(string(config.CSV.Header)); err != nil {
+		return nil, err
+	}
+	if err := config.CSV.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Compression, err = common.ParseCompression(config.Compression); err != nil {
+		return nil, err
+	}
+	if config.Digest, err = common.ParseDigest(config.Digest); err != nil {
+		return nil, err
+	}
+	return &Client{client: common.NewClient(config)}, nil
+}
+
+// SubmitBets sends bets to the server. The Line of each rejected bet is its
+// position in bets, starting at 1.
+func (c *Client) SubmitBets(ctx context.Context, bets []Bet) (Ack, error) {
+	return ack(c.client.SendBets(ctx, bets))
+}
+
+// SubmitFrom sends the bets read from r, CSV unless set with WithInputFormat.
+// The Line of each rejected bet is its line in r.
+func (c *Client) SubmitFrom(ctx context.Context, r io.Reader) (Ack, error) {
+	return ack(c.client.SendFrom(ctx, r))
+}
+
+// SubmitFile sends the bets of the file at path, or of the standard input when
+// path is Stdin. The format is detected from the extension, unless set with
+// WithInputFormat. With WithCheckpoints the progress of files is checkpointed,
+// so an interrupted upload of the same file resumes where it stopped. With
+// WithStateDir rejected bets are also written to a report file.
+func (c *Client) SubmitFile(ctx context.Context, path string) (Ack, error) {
+	return ack(c.client.SendFile(ctx, path))
+}
+
+// Finish tells the server the agency sent all its bets.
+func (c *Client) Finish(ctx context.Context) error {
+	return c.client.NotifyFinished(ctx)
+}
+
+// Winners returns the documents of the winning bets of the agency, waiting for
+// the draw, which takes place once every agency called Finish.
+func (c *Client) Winners(ctx context.Context) ([]string, error) {
+	return c.client.Winners(ctx)
+}
+
+// Ping checks that the server answers and returns the round trip time. Servers
+// that don't support pings fail with ErrProtocol.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	return c.client.Ping(ctx)
+}
+
+// Validate checks the bets read from r, like SubmitFrom reads them, without
+// contacting the server. It returns the amount of valid bets and the ones
+// SubmitFrom would reject before sending them.
+func (c *Client) Validate(r io.Reader) (int, []RejectedBet, error) {
+	return c.client.ValidateFrom(r)
+}
+
+// ValidateFile checks the bets of the file at path, like SubmitFile reads them,
+// without contacting the server.
+func (c *Client) ValidateFile(path string) (int, []RejectedBet, error) {
+	return c.client.ValidateFile(path)
+}
+
+// Close closes the connection to the server, if any.
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+// ack converts the outcome of an upload.
+func ack(upload *common.Upload, err error) (Ack, error) {
+	if upload == nil {
+		return Ack{}, err
+	}
+	return Ack{Stored: upload.Stored, Rejected: upload.Rejected}, err
+}
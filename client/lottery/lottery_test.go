@@ -0,0 +1,219 @@
+package lottery_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/lotteryserver"
+)
+
+func TestMain(m *testing.M) {
+	logging.SetLevel(logging.ERROR, "")
+	os.Exit(m.Run())
+}
+
+// startServer runs a lottery server on a loopback port until the test ends.
+func startServer(t *testing.T, agencies int) *lotteryserver.Server {
+	t.Helper()
+	server := lotteryserver.NewServer(lotteryserver.Config{Address: "127.0.0.1:0", ExpectedAgencies: agencies})
+	if err := server.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve() }()
+	t.Cleanup(func() {
+		server.Shutdown()
+		<-done
+	})
+	return server
+}
+
+// batchRecorder acks every frame it gets as a batch and records their headers.
+type batchRecorder struct {
+	listener net.Listener
+	mu       sync.Mutex
+	headers  []string
+}
+
+func startBatchRecorder(t *testing.T) *batchRecorder {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	r := &batchRecorder{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.handle(conn)
+		}
+	}()
+	return r
+}
+
+func (r *batchRecorder) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		payload, err := protocol.ReadFrame(reader)
+		if err != nil {
+			return
+		}
+		lines := strings.Split(strings.TrimSuffix(string(payload), "\n"), "\n")
+		r.mu.Lock()
+		r.headers = append(r.headers, lines[0])
+		r.mu.Unlock()
+		if err := (&protocol.BatchAck{Success: true, Count: len(lines) - 1}).Encode(conn); err != nil {
+			return
+		}
+	}
+}
+
+func (r *batchRecorder) batches() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.headers...)
+}
+
+// bets returns count valid bet lines, the ones in winners with the winner number.
+func bets(count int, winners ...int) string {
+	var sb strings.Builder
+	for document := 1; document <= count; document++ {
+		number := document
+		for _, winner := range winners {
+			if document == winner {
+				number = lotteryserver.LotteryWinnerNumber
+			}
+		}
+		fmt.Fprintf(&sb, "Ana,Paz,%d,1990-01-01,%d\n", document, number)
+	}
+	return sb.String()
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		agency  string
+		options []lottery.Option
+		fails   bool
+	}{
+		{"server given", "1", []lottery.Option{lottery.WithServer("localhost:12345")}, false},
+		{"empty agency", "", []lottery.Option{lottery.WithServer("localhost:12345")}, true},
+		{"no server", "1", nil, true},
+		{
+			name:    "invalid retry policy",
+			agency:  "1",
+			options: []lottery.Option{lottery.WithServer("localhost:12345"), lottery.WithSendRetry(lottery.RetryPolicy{MaxAttempts: 3})},
+			fails:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := lottery.New(tt.agency, tt.options...)
+			if (err != nil) != tt.fails {
+				t.Fatalf("New() = %v, want failure %v", err, tt.fails)
+			}
+			if client != nil {
+				client.Close()
+			}
+		})
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	server := startBatchRecorder(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bets.csv")
+	if err := os.WriteFile(path, []byte(bets(65)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client, err := lottery.New("1", lottery.WithServer(server.listener.Addr().String()), lottery.WithStateDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ack, err := client.SubmitFile(context.Background(), path)
+	if err != nil || ack.Stored != 65 {
+		t.Fatalf("SubmitFile() = %+v, %v, want 65 bets stored", ack, err)
+	}
+	// A hello, which the recorder doesn't understand, then batches of 64 bets, unsequenced
+	if got := server.batches(); len(got) != 3 || !strings.HasPrefix(got[0], "hello|") ||
+		strings.Join(got[1:], ",") != "agency_ID|1,agency_ID|1" {
+		t.Errorf("frame headers = %q, want a hello and two unsequenced batches", got)
+	}
+	// Checkpoints are opt-in, even with a state dir
+	if _, err := os.Stat(filepath.Join(dir, "agency-1.checkpoint")); !os.IsNotExist(err) {
+		t.Errorf("checkpoint saved without WithCheckpoints: %v", err)
+	}
+}
+
+func TestSubmitFromRejectsBadRows(t *testing.T) {
+	server := startServer(t, 1)
+	client, err := lottery.New("1", lottery.WithServer(server.Addr().String()), lottery.WithBatchSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	input := "Ana,Paz,1,1990-01-01,1\n" +
+		"Ana,Paz,2,1990-01-01\n" +
+		"Luis,Paz,3,1990-01-01,3\n"
+	ack, err := client.SubmitFrom(context.Background(), strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("SubmitFrom() = %v", err)
+	}
+	if ack.Stored != 2 || len(ack.Rejected) != 1 {
+		t.Fatalf("SubmitFrom() = %+v, want 2 bets stored and 1 rejected", ack)
+	}
+	if rejected := ack.Rejected[0]; rejected.Line != 2 || rejected.Content != "Ana,Paz,2,1990-01-01" || rejected.Reason == nil {
+		t.Errorf("rejected bet = %+v, want line 2 with its reason", rejected)
+	}
+	if n := server.Store().Len(); n != 2 {
+		t.Errorf("stored bets = %d, want 2", n)
+	}
+}
+
+func TestWinnersBeforeFinish(t *testing.T) {
+	server := startServer(t, 1)
+	client, err := lottery.New("1",
+		lottery.WithServer(server.Addr().String()),
+		lottery.WithWinnersRetry(lottery.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, Multiplier: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	if _, err := client.SubmitFrom(ctx, strings.NewReader(bets(3, 2))); err != nil {
+		t.Fatalf("SubmitFrom() = %v", err)
+	}
+	// The draw waits for the agency to finish
+	if winners, err := client.Winners(ctx); !errors.Is(err, lottery.ErrDrawNotReady) {
+		t.Fatalf("Winners() before Finish = %v, %v, want %v", winners, err, lottery.ErrDrawNotReady)
+	}
+	if err := client.Finish(ctx); err != nil {
+		t.Fatalf("Finish() = %v", err)
+	}
+	winners, err := client.Winners(ctx)
+	if err != nil || len(winners) != 1 || winners[0] != "2" {
+		t.Errorf("Winners() = %v, %v, want document 2", winners, err)
+	}
+}
@@ -0,0 +1,248 @@
+package lottery
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// defaultBatchSize is the amount of bets per batch when WithBatchSize is not used.
+const defaultBatchSize = 64
+
+// defaultDrawWait is how long the server holds a winners query until the draw
+// when WithDrawWait is not used.
+const defaultDrawWait = 30 * time.Second
+
+// Option configures a Client created by New.
+type Option func(config *common.ClientConfig)
+
+// WithServer sets the "host:port" address of the server.
+func WithServer(address string) Option {
+	return func(config *common.ClientConfig) {
+		config.ServerAddress = address
+	}
+}
+
+// WithBatchSize sets the amount of bets per batch, 64 by default. With adaptive
+// sizing it is the initial size.
+func WithBatchSize(bets int) Option {
+	return func(config *common.ClientConfig) {
+		config.MaxBatch = bets
+	}
+}
+
+// WithMaxBatchBytes bounds the encoded size of each batch. Bets that don't fit
+// in a batch on their own are rejected.
+func WithMaxBatchBytes(bytes int) Option {
+	return func(config *common.ClientConfig) {
+		config.MaxBatchBytes = bytes
+	}
+}
+
+// WithAdaptiveBatchSize makes the batch size grow, up to max bets, while acks
+// arrive within targetLatency, and shrink, down to min bets, when they take
+// longer or the server rejects a batch.
+func WithAdaptiveBatchSize(min int, max int, targetLatency time.Duration) Option {
+	return func(config *common.ClientConfig) {
+		config.AdaptiveBatch = true
+		config.AdaptiveMinBatch = min
+		config.AdaptiveMaxBatch = max
+		config.AdaptiveTargetLatency = targetLatency
+	}
+}
+
+// WithInFlight sets how many batches are sent without waiting for the ack of
+// the previous ones, 1 by default.
+func WithInFlight(batches int) Option {
+	return func(config *common.ClientConfig) {
+		config.InFlight = batches
+	}
+}
+
+// WithPersistentConnection makes the client reuse a single connection for every
+// message, instead of opening one per message. The server must keep connections open.
+func WithPersistentConnection(enabled bool) Option {
+	return func(config *common.ClientConfig) {
+		config.Persistent = enabled
+	}
+}
+
+// WithSequencedBatches numbers the batches, so the server stores each of them
+// only once even if it is sent again. The server must support sequenced batches.
+func WithSequencedBatches(enabled bool) Option {
+	return func(config *common.ClientConfig) {
+		config.Sequenced = enabled
+	}
+}
+
+// WithTLS makes the client talk to the server over TLS with the given
+// configuration, e.g. built with TLSFiles.Config. The server must expect TLS.
+func WithTLS(config *tls.Config) Option {
+	return func(clientConfig *common.ClientConfig) {
+		clientConfig.TLS = config
+	}
+}
+
+// WithAuthKey signs every request with the secret key the agency shares with
+// the server, so the server can tell it comes from the agency. Servers that
+// don't check signatures accept signed requests as if they were not signed.
+func WithAuthKey(key []byte) Option {
+	return func(clientConfig *common.ClientConfig) {
+		clientConfig.AuthKey = key
+	}
+}
+
+// WithHandshake enables or disables the hello exchange that agrees on the
+// protocol version, features and limits with the server before the first
+// message, enabled by default. Features the server lacks, such as sequenced
+// batches or persistent connections, are then left unused, and servers that
+// don't understand the hello are spoken to with the legacy protocol.
+func WithHandshake(enabled bool) Option {
+	return func(clientConfig *common.ClientConfig) {
+		clientConfig.Handshake = enabled
+	}
+}
+
+// WithCompression compresses the batches of at least threshold bytes with
+// algorithm, "gzip" or "flate", when the server agrees on it in the hello
+// exchange (see WithHandshake). "none" or empty disables it, the default.
+func WithCompression(algorithm string, threshold int) Option {
+	return func(clientConfig *common.ClientConfig) {
+		clientConfig.Compression = algorithm
+		clientConfig.CompressionThreshold = threshold
+	}
+}
+
+// WithDigest adds a digest of algorithm, "crc32c" or "sha256", to every
+// request when the server agrees on it in the hello exchange (see
+// WithHandshake). The server refuses requests damaged in transit and echoes
+// the digest in batch acks, and batches whose ack doesn't match are sent
+// again, which WithSequencedBatches keeps from storing them twice. "none" or
+// empty disables it, the default.
+func WithDigest(algorithm string) Option {
+	return func(clientConfig *common.ClientConfig) {
+		clientConfig.Digest = algorithm
+	}
+}
+
+// WithDialRetry sets how connecting to the server is retried.
+func WithDialRetry(policy RetryPolicy) Option {
+	return func(config *common.ClientConfig) {
+		config.DialRetry = policy
+	}
+}
+
+// WithSendRetry sets how sending a batch is retried.
+func WithSendRetry(policy RetryPolicy) Option {
+	return func(config *common.ClientConfig) {
+		config.SendRetry = policy
+	}
+}
+
+// WithWinnersRetry sets how the winners are polled while the draw is not done.
+func WithWinnersRetry(policy RetryPolicy) Option {
+	return func(config *common.ClientConfig) {
+		config.WinnersRetry = policy
+	}
+}
+
+// WithDrawWait makes the server hold each winners query until the draw is
+// done, for up to wait, when it agrees on it in the hello exchange (see
+// WithHandshake), instead of polling as WithWinnersRetry says. Zero disables it.
+func WithDrawWait(wait time.Duration) Option {
+	return func(config *common.ClientConfig) {
+		config.DrawWait = wait
+	}
+}
+
+// WithTimeouts bounds connecting to the server and each write and read on the
+// connection. Zero means no timeout.
+func WithTimeouts(dial time.Duration, write time.Duration, read time.Duration) Option {
+	return func(config *common.ClientConfig) {
+		config.DialTimeout = dial
+		config.WriteTimeout = write
+		config.ReadTimeout = read
+	}
+}
+
+// WithHeartbeat pings persistent connections that stay idle for interval, so a
+// dead server is noticed before the next message. Zero disables it.
+func WithHeartbeat(interval time.Duration) Option {
+	return func(config *common.ClientConfig) {
+		config.HeartbeatInterval = interval
+	}
+}
+
+// WithShutdownGrace sets how long the batches in flight may still take to be
+// acknowledged once the context of a submission is done.
+func WithShutdownGrace(grace time.Duration) Option {
+	return func(config *common.ClientConfig) {
+		config.ShutdownGrace = grace
+	}
+}
+
+// WithInputFormat sets the format of the bets read by SubmitFile, SubmitFrom
+// and the validations, instead of detecting it from the file extension.
+func WithInputFormat(format Format) Option {
+	return func(config *common.ClientConfig) {
+		config.InputFormat = format
+	}
+}
+
+// WithInputEncoding sets the character set of the bets read by SubmitFile,
+// SubmitFrom and the validations, UTF-8 by default. Bets that can't be decoded
+// are rejected.
+func WithInputEncoding(encoding Encoding) Option {
+	return func(config *common.ClientConfig) {
+		config.InputEncoding = encoding
+	}
+}
+
+// WithCSVSchema sets the layout of CSV bets: whether they have a header and
+// where each field is. By default a header is detected by the column names and
+// the columns are first_name,last_name,document,birthdate,number.
+func WithCSVSchema(schema CSVSchema) Option {
+	return func(config *common.ClientConfig) {
+		config.CSV = schema
+	}
+}
+
+// WithStateDir sets the directory where SubmitFile keeps the upload checkpoint
+// and the report of rejected bets.
+func WithStateDir(dir string) Option {
+	return func(config *common.ClientConfig) {
+		config.StateDir = dir
+	}
+}
+
+// WithCheckpoints enables or disables the upload checkpoint of SubmitFile,
+// disabled by default. It is kept in the directory set by WithStateDir.
+func WithCheckpoints(enabled bool) Option {
+	return func(config *common.ClientConfig) {
+		config.Checkpoint = enabled
+	}
+}
+
+// WithRestartFromScratch makes SubmitFile discard its checkpoint and send the
+// file again from the first line.
+func WithRestartFromScratch(restart bool) Option {
+	return func(config *common.ClientConfig) {
+		config.RestartFromScratch = restart
+	}
+}
+
+// WithThinkTime pauses after handing each batch to the sender, e.g. to simulate
+// slower agencies.
+func WithThinkTime(pause time.Duration) Option {
+	return func(config *common.ClientConfig) {
+		config.ThinkTime = pause
+	}
+}
+
+// WithMetrics sets a receiver of the outcome of every batch.
+func WithMetrics(metrics Metrics) Option {
+	return func(config *common.ClientConfig) {
+		config.Metrics = metrics
+	}
+}
@@ -1,26 +1,83 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/op/go-logging"
-	"github.com/pkg/errors"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
 	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
 )
 
 var log = logging.MustGetLogger("log")
 
+// Exit codes of the client process
+const (
+	ExitFailure      = 1   // any failure not covered by the codes below, e.g. a missing bets file
+	ExitUsage        = 2   // unknown command, wrong flags or arguments, or a configuration that could not be loaded
+	ExitServerClosed = 3   // the server closed the connection before replying
+	ExitTimeout      = 4   // the server did not answer in time
+	ExitProtocol     = 5   // the server sent a reply that could not be parsed
+	ExitRejected     = 6   // the server refused a batch or the winners query
+	ExitDrawNotReady = 7   // the draw was still not done when winners polling gave up
+	ExitInvalidBets  = 8   // validate found bets that would be rejected
+	ExitTLS          = 9   // the TLS handshake with the server failed
+	ExitUnauthorized = 10  // the server refused the signature of a request
+	ExitCorrupted    = 11  // a request or its ack kept not matching its digest
+	ExitInterrupted  = 130 // the run was stopped by SIGTERM or SIGINT before completing
+)
+
+// ErrInvalidBets is returned by the validate command when the file has invalid bets.
+var ErrInvalidBets = errors.New("invalid bets found")
+
+// exitCode returns the exit code that describes why the run failed with err.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, common.ErrInterrupted):
+		return ExitInterrupted
+	case errors.Is(err, protocol.ErrServerClosed):
+		return ExitServerClosed
+	case errors.Is(err, protocol.ErrTimeout):
+		return ExitTimeout
+	case errors.Is(err, protocol.ErrProtocol):
+		return ExitProtocol
+	case errors.Is(err, protocol.ErrRejected):
+		return ExitRejected
+	case errors.Is(err, protocol.ErrDrawNotReady):
+		return ExitDrawNotReady
+	case errors.Is(err, protocol.ErrTLS):
+		return ExitTLS
+	case errors.Is(err, protocol.ErrUnauthorized):
+		return ExitUnauthorized
+	case errors.Is(err, protocol.ErrCorrupted):
+		return ExitCorrupted
+	case errors.Is(err, ErrInvalidBets):
+		return ExitInvalidBets
+	}
+	return ExitFailure
+}
+
 // InitConfig Function that uses viper library to parse configuration parameters.
 // Viper is configured to read variables from both environment variables and the
-// config file ./config.yaml. Environment variables takes precedence over parameters
-// defined in the configuration file. If some of the variables cannot be parsed,
+// config file given with --config, ./config.yaml by default. Environment variables
+// takes precedence over parameters defined in the configuration file, and the flags
+// set in the command line over both. If some of the variables cannot be parsed,
 // an error is returned
-func InitConfig() (*viper.Viper, error) {
+func InitConfig(flags *pflag.FlagSet) (*viper.Viper, error) {
 	v := viper.New()
 
 	// Configure viper to read env variables with the CLI_ prefix
@@ -37,12 +94,58 @@ func InitConfig() (*viper.Viper, error) {
 	v.BindEnv("loop", "period")
 	v.BindEnv("loop", "amount")
 	v.BindEnv("log", "level")
+	v.BindEnv("data.file")
+	v.BindEnv("input.format")
+	v.BindEnv("input.encoding")
+	v.BindEnv("input.csv.header")
+	v.BindEnv("input.csv.delimiter")
+	for _, field := range common.BetFields {
+		v.BindEnv("input.csv.columns." + field)
+	}
+	v.BindEnv("batch.inFlight")
+	v.BindEnv("batch.maxBytes")
+	v.BindEnv("batch.adaptive.enabled")
+	v.BindEnv("batch.adaptive.min")
+	v.BindEnv("batch.adaptive.max")
+	v.BindEnv("batch.adaptive.targetLatency")
+	v.BindEnv("batch.sequenced")
+	v.BindEnv("connection.persistent")
+	v.BindEnv("state.dir")
+	v.BindEnv("checkpoint.enabled")
+	v.BindEnv("shutdown.grace")
+	v.BindEnv("timeouts.dial")
+	v.BindEnv("timeouts.write")
+	v.BindEnv("timeouts.read")
+	v.BindEnv("heartbeat.interval")
+	v.BindEnv("winners.wait")
+	for _, key := range []string{"enabled", "ca", "cert", "key", "serverName", "minVersion"} {
+		v.BindEnv("tls." + key)
+	}
+	v.BindEnv("protocol.hello")
+	v.BindEnv("compression.algorithm")
+	v.BindEnv("compression.threshold")
+	v.BindEnv("integrity.digest")
+	v.BindEnv("auth.secret")
+	v.BindEnv("auth.secretFile")
+	for _, operation := range retryOperations {
+		for _, field := range []string{"maxAttempts", "baseDelay", "maxDelay", "multiplier", "jitter", "deadline"} {
+			v.BindEnv("retry." + operation + "." + field)
+		}
+	}
+
+	// Command line flags take precedence over env variables and the config file
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if key, ok := flagKeys[flag.Name]; ok && flag.Changed {
+			v.BindPFlag(key, flag)
+		}
+	})
 
 	// Try to read configuration from config file. If config file
 	// does not exists then ReadInConfig will fail but configuration
 	// can be loaded from the environment variables so we shouldn't
 	// return an error in that case
-	v.SetConfigFile("./config.yaml")
+	configFile, _ := flags.GetString("config")
+	v.SetConfigFile(configFile)
 	if err := v.ReadInConfig(); err != nil {
 		fmt.Printf("Configuration could not be read from config file. Using env variables instead")
 	}
@@ -50,7 +153,28 @@ func InitConfig() (*viper.Viper, error) {
 	// Parse time.Duration variables and return an error if those variables cannot be parsed
 
 	if _, err := time.ParseDuration(v.GetString("loop.period")); err != nil {
-		return nil, errors.Wrapf(err, "Could not parse CLI_LOOP_PERIOD env var as time.Duration.")
+		return nil, pkgerrors.Wrapf(err, "Could not parse CLI_LOOP_PERIOD env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("shutdown.grace")); v.IsSet("shutdown.grace") && err != nil {
+		return nil, pkgerrors.Wrapf(err, "Could not parse CLI_SHUTDOWN_GRACE env var as time.Duration.")
+	}
+
+	for _, key := range []string{"timeouts.dial", "timeouts.write", "timeouts.read", "heartbeat.interval", "batch.adaptive.targetLatency"} {
+		if _, err := time.ParseDuration(v.GetString(key)); v.IsSet(key) && err != nil {
+			return nil, pkgerrors.Wrapf(err, "Could not parse CLI_%s env var as time.Duration.",
+				strings.ToUpper(strings.ReplaceAll(key, ".", "_")))
+		}
+	}
+
+	if delimiter := []rune(v.GetString("input.csv.delimiter")); len(delimiter) > 1 {
+		return nil, pkgerrors.Errorf("Invalid CLI_INPUT_CSV_DELIMITER %q: it must be a single character.", string(delimiter))
+	}
+
+	for _, operation := range retryOperations {
+		if _, err := loadRetryPolicy(v, operation); err != nil {
+			return nil, pkgerrors.Wrapf(err, "Invalid retry.%s configuration.", operation)
+		}
 	}
 
 	return v, nil
@@ -78,39 +202,226 @@ func InitLogger(logLevel string) error {
 	return nil
 }
 
+// retryOperations are the operations with their own retry policy, configured
+// under retry.<operation> in config.yaml or CLI_RETRY_<OPERATION>_<FIELD> env vars.
+var retryOperations = []string{"dial", "send", "winners"}
+
+// defaultRetryPolicies holds the policy used for the fields of each operation left unset.
+var defaultRetryPolicies = map[string]common.RetryPolicy{
+	"dial":    common.DefaultDialRetry,
+	"send":    common.DefaultSendRetry,
+	"winners": common.DefaultWinnersRetry,
+}
+
+// loadRetryPolicy reads the retry policy of the given operation, taking the
+// fields that are not set from its default policy.
+func loadRetryPolicy(v *viper.Viper, operation string) (common.RetryPolicy, error) {
+	policy := defaultRetryPolicies[operation]
+	key := func(field string) string { return "retry." + operation + "." + field }
+
+	if v.IsSet(key("maxAttempts")) {
+		policy.MaxAttempts = v.GetInt(key("maxAttempts"))
+	}
+	if v.IsSet(key("multiplier")) {
+		policy.Multiplier = v.GetFloat64(key("multiplier"))
+	}
+	if v.IsSet(key("jitter")) {
+		policy.Jitter = v.GetBool(key("jitter"))
+	}
+	durations := map[string]*time.Duration{
+		"baseDelay": &policy.BaseDelay,
+		"maxDelay":  &policy.MaxDelay,
+		"deadline":  &policy.Deadline,
+	}
+	for field, value := range durations {
+		if !v.IsSet(key(field)) {
+			continue
+		}
+		duration, err := time.ParseDuration(v.GetString(key(field)))
+		if err != nil {
+			return policy, pkgerrors.Wrapf(err, "Could not parse %s as time.Duration.", key(field))
+		}
+		*value = duration
+	}
+	return policy, policy.Validate()
+}
+
+// retryPolicy returns the retry policy of the given operation. The configuration
+// was already validated by InitConfig.
+func retryPolicy(v *viper.Viper, operation string) common.RetryPolicy {
+	policy, _ := loadRetryPolicy(v, operation)
+	return policy
+}
+
+// csvSchema reads the layout of CSV bets from the input.csv section of the configuration.
+func csvSchema(v *viper.Viper) lottery.CSVSchema {
+	schema := lottery.CSVSchema{Header: lottery.HeaderMode(v.GetString("input.csv.header"))}
+	if delimiter := []rune(v.GetString("input.csv.delimiter")); len(delimiter) == 1 {
+		schema.Delimiter = delimiter[0]
+	}
+	for _, field := range common.BetFields {
+		column := v.GetString("input.csv.columns." + field)
+		if column == "" {
+			continue
+		}
+		if schema.Columns == nil {
+			schema.Columns = map[string]string{}
+		}
+		schema.Columns[field] = column
+	}
+	return schema
+}
+
+// tlsFiles reads the TLS settings from the tls section of the configuration.
+func tlsFiles(v *viper.Viper) lottery.TLSFiles {
+	return lottery.TLSFiles{
+		CAFile:     v.GetString("tls.ca"),
+		CertFile:   v.GetString("tls.cert"),
+		KeyFile:    v.GetString("tls.key"),
+		ServerName: v.GetString("tls.serverName"),
+		MinVersion: v.GetString("tls.minVersion"),
+	}
+}
+
+// authKey returns the secret key of the agency, given in auth.secret or read
+// from auth.secretFile, or nil when requests must not be signed.
+func authKey(v *viper.Viper) ([]byte, error) {
+	secret, file := v.GetString("auth.secret"), v.GetString("auth.secretFile")
+	switch {
+	case secret != "" && file != "":
+		return nil, errors.New("auth.secret and auth.secretFile are mutually exclusive")
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		secret = strings.TrimSpace(string(data))
+		if secret == "" {
+			return nil, fmt.Errorf("auth secret file %s is empty", file)
+		}
+	}
+	if secret == "" {
+		return nil, nil
+	}
+	return []byte(secret), nil
+}
+
 // PrintConfig Print all the configuration parameters of the program.
 // For debugging purposes only
 func PrintConfig(v *viper.Viper) {
-	log.Infof("action: config | result: success | client_id: %s | server_address: %s | loop_amount: %v | loop_period: %v | log_level: %s",
+	log.Infof("action: config | result: success | client_id: %s | server_address: %s | loop_amount: %v | loop_period: %v | log_level: %s | sequenced_batches: %v | persistent_connection: %v | tls: %v | auth: %v",
 		v.GetString("id"),
 		v.GetString("server.address"),
 		v.GetInt("loop.amount"),
 		v.GetDuration("loop.period"),
 		v.GetString("log.level"),
+		v.GetBool("batch.sequenced"),
+		v.GetBool("connection.persistent"),
+		v.GetBool("tls.enabled"),
+		v.GetString("auth.secret") != "" || v.GetString("auth.secretFile") != "",
 	)
 }
 
 func main() {
-	v, err := InitConfig()
+	cmd, arguments, err := findCommand(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		printCommands()
+		os.Exit(ExitUsage)
+	}
+	flags := cmd.flagSet()
+	if err := flags.Parse(arguments); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		flags.Usage()
+		os.Exit(ExitUsage)
+	}
+	if flags.NArg() != cmd.nArgs {
+		fmt.Fprintf(os.Stderr, "expected %d arguments, got %d\n", cmd.nArgs, flags.NArg())
+		flags.Usage()
+		os.Exit(ExitUsage)
+	}
+
+	v, err := InitConfig(flags)
 	if err != nil {
 		log.Criticalf("%s", err)
+		os.Exit(ExitUsage)
 	}
 
 	if err := InitLogger(v.GetString("log.level")); err != nil {
 		log.Criticalf("%s", err)
+		os.Exit(ExitUsage)
 	}
 
 	// Print program config with debugging purposes
 	PrintConfig(v)
 
-	clientConfig := common.ClientConfig{
-		ServerAddress: v.GetString("server.address"),
-		ID:            v.GetString("id"),
-		LoopAmount:    v.GetInt("loop.amount"),
-		LoopPeriod:    v.GetDuration("loop.period"),
-		MaxBatch:      v.GetInt("batch.maxAmount"),
+	options := []lottery.Option{
+		lottery.WithServer(v.GetString("server.address")),
+		lottery.WithBatchSize(v.GetInt("batch.maxAmount")),
+		lottery.WithMaxBatchBytes(v.GetInt("batch.maxBytes")),
+		lottery.WithInFlight(v.GetInt("batch.inFlight")),
+		lottery.WithSequencedBatches(v.GetBool("batch.sequenced")),
+		lottery.WithPersistentConnection(v.GetBool("connection.persistent")),
+		lottery.WithHandshake(v.GetBool("protocol.hello")),
+		lottery.WithCompression(v.GetString("compression.algorithm"), v.GetInt("compression.threshold")),
+		lottery.WithDigest(v.GetString("integrity.digest")),
+		lottery.WithDialRetry(retryPolicy(v, "dial")),
+		lottery.WithSendRetry(retryPolicy(v, "send")),
+		lottery.WithWinnersRetry(retryPolicy(v, "winners")),
+		lottery.WithDrawWait(v.GetDuration("winners.wait")),
+		lottery.WithTimeouts(v.GetDuration("timeouts.dial"), v.GetDuration("timeouts.write"), v.GetDuration("timeouts.read")),
+		lottery.WithHeartbeat(v.GetDuration("heartbeat.interval")),
+		lottery.WithShutdownGrace(v.GetDuration("shutdown.grace")),
+		lottery.WithInputFormat(lottery.Format(v.GetString("input.format"))),
+		lottery.WithInputEncoding(lottery.Encoding(v.GetString("input.encoding"))),
+		lottery.WithCSVSchema(csvSchema(v)),
+		lottery.WithStateDir(v.GetString("state.dir")),
+		lottery.WithCheckpoints(v.GetBool("checkpoint.enabled")),
+		lottery.WithRestartFromScratch(v.GetBool("checkpoint.restart")),
+	}
+	if v.GetBool("batch.adaptive.enabled") {
+		options = append(options, lottery.WithAdaptiveBatchSize(v.GetInt("batch.adaptive.min"),
+			v.GetInt("batch.adaptive.max"), v.GetDuration("batch.adaptive.targetLatency")))
+	}
+	if v.GetBool("tls.enabled") {
+		tlsConfig, err := tlsFiles(v).Config()
+		if err != nil {
+			log.Criticalf("action: tls_config | result: fail | error: %v", err)
+			os.Exit(ExitFailure)
+		}
+		options = append(options, lottery.WithTLS(tlsConfig))
+	}
+	if key, err := authKey(v); err != nil {
+		log.Criticalf("action: auth_config | result: fail | error: %v", err)
+		os.Exit(ExitFailure)
+	} else if key != nil {
+		options = append(options, lottery.WithAuthKey(key))
+	}
+	client, err := lottery.New(v.GetString("id"), options...)
+	if err != nil {
+		log.Criticalf("%s", err)
+		os.Exit(ExitUsage)
+	}
+
+	// Retry waits are jittered, so every agency must draw different ones
+	rand.Seed(time.Now().UnixNano())
+
+	ctx, stop := shutdownContext()
+	defer stop()
+
+	err = cmd.run(ctx, client, v, flags.Args())
+	client.Close()
+	if err != nil {
+		stop()
+		os.Exit(exitCode(err))
 	}
+}
 
-	client := common.NewClient(clientConfig)
-	client.StartClientBatch()
+// shutdownContext returns a context canceled by SIGTERM or SIGINT, so they
+// stop the run wherever it is.
+func shutdownContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/spf13/viper"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+func TestMain(m *testing.M) {
+	logging.SetLevel(logging.ERROR, "")
+	os.Exit(m.Run())
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, 0},
+		{"interrupted", common.ErrInterrupted, ExitInterrupted},
+		{"wrapped interruption", fmt.Errorf("send: %w", common.ErrInterrupted), ExitInterrupted},
+		{"server closed", fmt.Errorf("send: %w", protocol.ErrServerClosed), ExitServerClosed},
+		{"timeout", &common.TimeoutError{Op: "read", Duration: time.Second, Err: os.ErrDeadlineExceeded}, ExitTimeout},
+		{"protocol", fmt.Errorf("%w: unexpected response", protocol.ErrProtocol), ExitProtocol},
+		{"rejected", fmt.Errorf("%w: fail|0", protocol.ErrRejected), ExitRejected},
+		{"draw not ready", fmt.Errorf("gave up: %w", protocol.ErrDrawNotReady), ExitDrawNotReady},
+		{"interrupted over transport", fmt.Errorf("%w: %v", common.ErrInterrupted, protocol.ErrServerClosed), ExitInterrupted},
+		{"invalid bets", ErrInvalidBets, ExitInvalidBets},
+		{"failure", errors.New("connection refused"), ExitFailure},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("%s: exitCode(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+// startSilentServer accepts connections and reads their frames without ever
+// answering but to the hello, so batches stay in flight. Every other frame
+// read is announced on the returned channel.
+func startSilentServer(t *testing.T) (net.Listener, <-chan struct{}) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	frames := make(chan struct{}, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					payload, err := protocol.ReadFrame(reader)
+					if err != nil {
+						return
+					}
+					if strings.HasPrefix(string(payload), "hello|") {
+						ack := &protocol.HelloAck{Version: protocol.Version, Features: protocol.Features}
+						if err := ack.Encode(conn); err != nil {
+							return
+						}
+						continue
+					}
+					select {
+					case frames <- struct{}{}:
+					default:
+					}
+				}
+			}()
+		}
+	}()
+	return listener, frames
+}
+
+func TestShutdownSignal(t *testing.T) {
+	const grace = 200 * time.Millisecond
+	for _, signal := range []syscall.Signal{syscall.SIGTERM, syscall.SIGINT} {
+		t.Run(signal.String(), func(t *testing.T) {
+			listener, frames := startSilentServer(t)
+			dir := t.TempDir()
+			data := filepath.Join(dir, "agency-1.csv")
+			if err := os.WriteFile(data, []byte("Ana,Paz,1,1990-01-01,1\nLuis,Paz,2,1990-01-01,2\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			client, err := lottery.New("1",
+				lottery.WithServer(listener.Addr().String()),
+				lottery.WithBatchSize(1),
+				lottery.WithInFlight(2),
+				lottery.WithPersistentConnection(true),
+				lottery.WithShutdownGrace(grace),
+				lottery.WithStateDir(dir),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, stop := shutdownContext()
+			defer stop()
+			done := make(chan error, 1)
+			defer client.Close()
+			v := viper.New()
+			v.Set("id", "1")
+			v.Set("data.file", data)
+			go func() { done <- run(ctx, client, v, nil) }()
+
+			select {
+			case <-frames:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no batch reached the server")
+			}
+			sent := time.Now()
+			if err := syscall.Kill(os.Getpid(), signal); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case err := <-done:
+				// The batches in flight get the grace period and are then abandoned
+				if elapsed := time.Since(sent); elapsed < grace || elapsed > grace+2*time.Second {
+					t.Errorf("run stopped %v after the signal, want about %v", elapsed, grace)
+				}
+				if !errors.Is(err, common.ErrInterrupted) {
+					t.Errorf("run() = %v, want %v", err, common.ErrInterrupted)
+				}
+				if code := exitCode(err); code != 130 {
+					t.Errorf("exit code = %d, want 130", code)
+				}
+			case <-time.After(grace + 5*time.Second):
+				t.Fatal("the run did not stop after the signal")
+			}
+		})
+	}
+}
+
+func TestLoadRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		settings  map[string]interface{}
+		want      common.RetryPolicy
+		invalid   bool
+	}{
+		{name: "defaults", operation: "send", want: common.DefaultSendRetry},
+		{
+			name:      "fields override the defaults",
+			operation: "dial",
+			settings: map[string]interface{}{
+				"retry.dial.maxAttempts": 5,
+				"retry.dial.baseDelay":   "10ms",
+				"retry.dial.jitter":      false,
+			},
+			want: common.RetryPolicy{
+				MaxAttempts: 5,
+				BaseDelay:   10 * time.Millisecond,
+				MaxDelay:    common.DefaultDialRetry.MaxDelay,
+				Multiplier:  common.DefaultDialRetry.Multiplier,
+			},
+		},
+		{
+			name:      "deadline instead of attempts",
+			operation: "winners",
+			settings:  map[string]interface{}{"retry.winners.maxAttempts": 0, "retry.winners.deadline": "1m"},
+			want: func() common.RetryPolicy {
+				policy := common.DefaultWinnersRetry
+				policy.MaxAttempts = 0
+				policy.Deadline = time.Minute
+				return policy
+			}(),
+		},
+		{name: "unparsable duration", operation: "send", settings: map[string]interface{}{"retry.send.maxDelay": "soon"}, invalid: true},
+		{name: "no bound", operation: "dial", settings: map[string]interface{}{"retry.dial.maxAttempts": 0}, invalid: true},
+		{name: "shrinking delays", operation: "send", settings: map[string]interface{}{"retry.send.multiplier": 0.5}, invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			for key, value := range tt.settings {
+				v.Set(key, value)
+			}
+			policy, err := loadRetryPolicy(v, tt.operation)
+			if tt.invalid {
+				if err == nil {
+					t.Errorf("loadRetryPolicy() = %+v, want an error", policy)
+				}
+				return
+			}
+			if err != nil || policy != tt.want {
+				t.Errorf("loadRetryPolicy() = %+v, %v, want %+v", policy, err, tt.want)
+			}
+		})
+	}
+}
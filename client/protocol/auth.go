@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authPrefix starts the line that signs a request frame.
+const authPrefix = "auth|"
+
+// nonceSize is the amount of random bytes of each nonce.
+const nonceSize = 16
+
+// Signer authenticates the request frames of an agency with HMAC-SHA256 and the
+// secret key the agency shares with the server.
+//
+// A signed frame carries an "auth|<agency>|<timestamp>|<nonce>|<mac>" line
+// before the payload of the request, where the timestamp is in Unix seconds,
+// the nonce is random and the MAC, in hex, covers the agency, the timestamp,
+// the nonce and the payload. Servers check that the timestamp is recent and
+// that no nonce is used twice, so captured frames can't be sent again.
+type Signer struct {
+	AgencyID string
+	Key      []byte
+}
+
+// Sign returns payload prefixed with its signature line.
+func (s *Signer) Sign(payload []byte) ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	frame := &SignedFrame{
+		AgencyID:  s.AgencyID,
+		Timestamp: time.Now().Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+		Payload:   payload,
+	}
+	frame.MAC = frame.mac(s.Key)
+
+	line := authPrefix + strings.Join([]string{
+		frame.AgencyID, strconv.FormatInt(frame.Timestamp, 10), frame.Nonce, hex.EncodeToString(frame.MAC),
+	}, "|") + "\n"
+	signed := make([]byte, 0, len(line)+len(payload))
+	signed = append(signed, line...)
+	return append(signed, payload...), nil
+}
+
+// SignedFrame is a request frame along with its signature.
+type SignedFrame struct {
+	AgencyID  string
+	Timestamp int64 // Unix seconds
+	Nonce     string
+	MAC       []byte
+	Payload   []byte // the request, without the signature line
+}
+
+// IsSigned reports whether the frame payload starts with a signature line.
+func IsSigned(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte(authPrefix))
+}
+
+// ParseSignedFrame splits a signed frame payload into its signature and request.
+func ParseSignedFrame(payload []byte) (*SignedFrame, error) {
+	end := bytes.IndexByte(payload, '\n')
+	if !IsSigned(payload) || end < 0 {
+		return nil, protocolErrorf("missing signature line")
+	}
+	line := string(payload[:end])
+	fields := strings.Split(strings.TrimPrefix(line, authPrefix), "|")
+	if len(fields) != 4 || fields[0] == "" || fields[2] == "" {
+		return nil, protocolErrorf("invalid signature line: %q", line)
+	}
+	timestamp, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, protocolErrorf("invalid signature timestamp: %q", line)
+	}
+	mac, err := hex.DecodeString(fields[3])
+	if err != nil || len(mac) != sha256.Size {
+		return nil, protocolErrorf("invalid signature MAC: %q", line)
+	}
+	return &SignedFrame{
+		AgencyID:  fields[0],
+		Timestamp: timestamp,
+		Nonce:     fields[2],
+		MAC:       mac,
+		Payload:   payload[end+1:],
+	}, nil
+}
+
+// Verify reports whether the frame was signed with key.
+func (f *SignedFrame) Verify(key []byte) bool {
+	return hmac.Equal(f.MAC, f.mac(key))
+}
+
+// mac computes the MAC of the frame with key.
+func (f *SignedFrame) mac(key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(f.AgencyID + "|" + strconv.FormatInt(f.Timestamp, 10) + "|" + f.Nonce + "\n"))
+	h.Write(f.Payload)
+	return h.Sum(nil)
+}
+
+// Unauthorized is the reply to a request whose signature the server refused,
+// after which the server closes the connection. Decoding the reply of any
+// request fails with ErrUnauthorized when the server sent this one instead.
+type Unauthorized struct {
+	Reason string
+}
+
+// Encode writes the "unauthorized|<reason>" line.
+func (m *Unauthorized) Encode(w io.Writer) error {
+	return writeLine(w, unauthorizedPrefix+m.Reason)
+}
+
+// Decode reads an "unauthorized|<reason>" line from r.
+func (m *Unauthorized) Decode(r io.Reader) error {
+	line, err := readLine(r)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, unauthorizedPrefix) {
+		return protocolErrorf("unexpected response: %s", line)
+	}
+	m.Reason = strings.TrimPrefix(line, unauthorizedPrefix)
+	return nil
+}
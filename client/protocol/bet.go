@@ -0,0 +1,201 @@
+package protocol
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// BirthdateLayout is the ISO format the server expects for birthdates.
+const BirthdateLayout = "2006-01-02"
+
+// betFields is the amount of comma separated fields of a bet line.
+const betFields = 5
+
+// forbiddenChars can't appear in any field because they are delimiters of the
+// wire format: '|' separates header values and line breaks separate bets.
+const forbiddenChars = "|\n\r"
+
+// Bet mirrors the server side lottery bet registry.
+type Bet struct {
+	FirstName string
+	LastName  string
+	Document  string
+	Birthdate time.Time
+	Number    int
+}
+
+// ParseBet parses a "first_name,last_name,document,birthdate,number" line and
+// validates it with the same rules the server applies, so invalid bets are
+// detected before they are sent. Lines with quotes are read as CSV records, so
+// quoted fields may hold commas.
+func ParseBet(line string) (Bet, error) {
+	if !strings.Contains(line, `"`) {
+		return ParseBetFields(strings.Split(line, ","))
+	}
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	fields, err := reader.Read()
+	if err != nil {
+		return Bet{}, fmt.Errorf("invalid bet line: %v", err)
+	}
+	return ParseBetFields(fields)
+}
+
+// ParseBetFields parses the first_name, last_name, document, birthdate and
+// number fields of a bet, in that order, and validates it like ParseBet.
+func ParseBetFields(fields []string) (Bet, error) {
+	if len(fields) != betFields {
+		return Bet{}, fmt.Errorf("expected %d fields, got %d", betFields, len(fields))
+	}
+	fields = append([]string(nil), fields...)
+	for i, field := range fields {
+		fields[i] = strings.TrimSpace(field)
+	}
+
+	birthdate, err := time.Parse(BirthdateLayout, fields[3])
+	if err != nil {
+		return Bet{}, fmt.Errorf("invalid birthdate %q: expected YYYY-MM-DD", fields[3])
+	}
+	number, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return Bet{}, fmt.Errorf("invalid number %q: not an integer", fields[4])
+	}
+
+	bet := Bet{
+		FirstName: fields[0],
+		LastName:  fields[1],
+		Document:  fields[2],
+		Birthdate: birthdate,
+		Number:    number,
+	}
+	if err := bet.Validate(); err != nil {
+		return Bet{}, err
+	}
+	return bet, nil
+}
+
+// jsonBet is a bet encoded as a JSON object, with the fields named as the
+// columns of the CSV format.
+type jsonBet struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Document  string `json:"document"`
+	Birthdate string `json:"birthdate"`
+	Number    *int   `json:"number"`
+}
+
+// ParseJSONBet parses a bet encoded as a JSON object such as
+// {"first_name":"Ana","last_name":"Gómez","document":"30904465","birthdate":"1999-03-17","number":7574}
+// and validates it like ParseBet.
+func ParseJSONBet(line string) (Bet, error) {
+	var fields jsonBet
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return Bet{}, fmt.Errorf("invalid JSON bet: %v", err)
+	}
+	birthdate, err := time.Parse(BirthdateLayout, strings.TrimSpace(fields.Birthdate))
+	if err != nil {
+		return Bet{}, fmt.Errorf("invalid birthdate %q: expected YYYY-MM-DD", fields.Birthdate)
+	}
+	if fields.Number == nil {
+		return Bet{}, fmt.Errorf("missing number")
+	}
+
+	bet := Bet{
+		FirstName: strings.TrimSpace(fields.FirstName),
+		LastName:  strings.TrimSpace(fields.LastName),
+		Document:  strings.TrimSpace(fields.Document),
+		Birthdate: birthdate,
+		Number:    *fields.Number,
+	}
+	if err := bet.Validate(); err != nil {
+		return Bet{}, err
+	}
+	return bet, nil
+}
+
+// Validate checks the bet fields can be sent and will be accepted by the server.
+func (b Bet) Validate() error {
+	textFields := []struct {
+		name  string
+		value string
+	}{
+		{"first_name", b.FirstName},
+		{"last_name", b.LastName},
+		{"document", b.Document},
+	}
+	for _, field := range textFields {
+		if field.value == "" {
+			return fmt.Errorf("empty %s", field.name)
+		}
+		if !utf8.ValidString(field.value) {
+			return fmt.Errorf("invalid UTF-8 in %s %q", field.name, field.value)
+		}
+		if strings.ContainsAny(field.value, forbiddenChars) {
+			return fmt.Errorf("forbidden character in %s %q", field.name, field.value)
+		}
+	}
+	if !isDigits(b.Document) {
+		return fmt.Errorf("invalid document %q: not numeric", b.Document)
+	}
+	if b.Birthdate.IsZero() {
+		return fmt.Errorf("empty birthdate")
+	}
+	if b.Number < 0 {
+		return fmt.Errorf("invalid number %d: negative", b.Number)
+	}
+	return nil
+}
+
+// String formats the bet as the line sent inside a BatchRequest: a CSV record
+// whose fields are quoted when they hold commas or quotes. Bets without them
+// are plain comma separated lines, which every server reads; the rest can only
+// be sent to servers that agreed on FeatureQuotedBets (see Quoted).
+func (b Bet) String() string {
+	fields := b.fields()
+	for i, field := range fields {
+		if strings.ContainsAny(field, `,"`) {
+			fields[i] = `"` + strings.ReplaceAll(field, `"`, `""`) + `"`
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// Quoted reports whether String quotes some field of the bet.
+func (b Bet) Quoted() bool {
+	for _, field := range b.fields() {
+		if strings.ContainsAny(field, `,"`) {
+			return true
+		}
+	}
+	return false
+}
+
+// fields returns the fields of the bet in the order of a bet line.
+func (b Bet) fields() []string {
+	return []string{
+		b.FirstName,
+		b.LastName,
+		b.Document,
+		b.Birthdate.Format(BirthdateLayout),
+		strconv.Itoa(b.Number),
+	}
+}
+
+// isDigits reports whether s is a non empty string of decimal digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestParseBet(t *testing.T) {
+	want := Bet{FirstName: "Santiago Lionel", LastName: "Lorca", Document: "30904465",
+		Birthdate: time.Date(1999, 3, 17, 0, 0, 0, 0, time.UTC), Number: 7574}
+	for _, line := range []string{
+		"Santiago Lionel,Lorca,30904465,1999-03-17,7574",
+		" Santiago Lionel , Lorca ,30904465, 1999-03-17 ,7574 ",
+	} {
+		bet, err := ParseBet(line)
+		if err != nil {
+			t.Fatalf("ParseBet(%q) = %v", line, err)
+		}
+		if bet != want {
+			t.Errorf("ParseBet(%q) = %+v, want %+v", line, bet, want)
+		}
+	}
+	if line := want.String(); line != "Santiago Lionel,Lorca,30904465,1999-03-17,7574" {
+		t.Errorf("String() = %q", line)
+	}
+}
+
+func TestParseBetInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"missing field", "Ana,Paz,1234,1999-03-17"},
+		{"extra field", "Ana,Paz,1234,1999-03-17,12,13"},
+		{"bad birthdate", "Ana,Paz,1234,17/03/1999,12"},
+		{"bad number", "Ana,Paz,1234,1999-03-17,twelve"},
+		{"negative number", "Ana,Paz,1234,1999-03-17,-1"},
+		{"empty name", ",Paz,1234,1999-03-17,12"},
+		{"document not numeric", "Ana,Paz,12A4,1999-03-17,12"},
+		{"pipe in a field", "Ana|1,Paz,1234,1999-03-17,12"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if bet, err := ParseBet(tt.line); err == nil {
+				t.Errorf("ParseBet(%q) = %+v, want an error", tt.line, bet)
+			}
+		})
+	}
+}
+
+func TestQuotedBetRoundTrip(t *testing.T) {
+	birthdate := time.Date(1999, 3, 17, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		bet    Bet
+		line   string
+		quoted bool
+	}{
+		{
+			name: "comma in first name",
+			bet:  Bet{FirstName: "Pérez, Juan", LastName: "Gómez", Document: "30904465", Birthdate: birthdate, Number: 7574},
+			line: `"Pérez, Juan",Gómez,30904465,1999-03-17,7574`, quoted: true,
+		},
+		{
+			name: "quote in last name",
+			bet:  Bet{FirstName: "Ana", LastName: `O"Neil`, Document: "1234", Birthdate: birthdate, Number: 12},
+			line: `Ana,"O""Neil",1234,1999-03-17,12`, quoted: true,
+		},
+		{
+			name: "plain",
+			bet:  Bet{FirstName: "Santiago Lionel", LastName: "Lorca", Document: "30904465", Birthdate: birthdate, Number: 2201},
+			line: "Santiago Lionel,Lorca,30904465,1999-03-17,2201",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.bet.Validate(); err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			line := tt.bet.String()
+			if line != tt.line {
+				t.Errorf("String() = %q, want %q", line, tt.line)
+			}
+			if tt.bet.Quoted() != tt.quoted {
+				t.Errorf("Quoted() = %v, want %v", tt.bet.Quoted(), tt.quoted)
+			}
+			parsed, err := ParseBet(line)
+			if err != nil {
+				t.Fatalf("ParseBet(%q) = %v", line, err)
+			}
+			if parsed != tt.bet {
+				t.Errorf("ParseBet(%q) = %+v, want %+v", line, parsed, tt.bet)
+			}
+		})
+	}
+}
+
+func TestQuotedBetInBatch(t *testing.T) {
+	bet := Bet{FirstName: "Pérez, Juan", LastName: "Gómez", Document: "30904465",
+		Birthdate: time.Date(1999, 3, 17, 0, 0, 0, 0, time.UTC), Number: 7574}
+	var stream bytes.Buffer
+	if err := (&BatchRequest{AgencyID: "1", Lines: []string{bet.String()}}).Encode(&stream); err != nil {
+		t.Fatalf("Encode() = %v", err)
+	}
+
+	request, err := ReadRequest(&stream)
+	if err != nil {
+		t.Fatalf("ReadRequest() = %v", err)
+	}
+	batch, ok := request.(*BatchRequest)
+	if !ok || len(batch.Lines) != 1 {
+		t.Fatalf("ReadRequest() = %#v, want a batch of one bet", request)
+	}
+	parsed, err := ParseBet(batch.Lines[0])
+	if err != nil {
+		t.Fatalf("ParseBet(%q) = %v", batch.Lines[0], err)
+	}
+	if parsed != bet {
+		t.Errorf("bet = %+v, want %+v", parsed, bet)
+	}
+}
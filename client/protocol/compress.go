@@ -0,0 +1,180 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Compression algorithms, advertised as features in the Hello exchange.
+const (
+	FeatureGzip  = "gzip"
+	FeatureFlate = "flate"
+)
+
+// compressedPrefix starts the line that announces a compressed frame.
+const compressedPrefix = "compressed|"
+
+// Compressed sends Message with its frame payload compressed with Algorithm,
+// FeatureGzip or FeatureFlate, as "compressed|<algorithm>|<size>" followed by
+// a line break and the compressed bytes, where size is the length of the
+// original payload. Payloads shorter than Threshold, or that don't shrink, are
+// sent as they are. Servers must have agreed on the algorithm in the Hello.
+type Compressed struct {
+	Message   Message
+	Algorithm string // no compression when empty
+	Threshold int    // size in bytes from which payloads are compressed
+
+	// Set by Encode
+	RawSize int  // size of the original payload
+	Size    int  // size of the payload sent
+	Applied bool // whether the payload was sent compressed
+}
+
+// Encode writes the frame of Message, compressed if it is worth it.
+func (m *Compressed) Encode(w io.Writer) error {
+	capture := &frameCapture{}
+	if err := m.Message.Encode(capture); err != nil {
+		return err
+	}
+	payload := capture.payload
+	m.RawSize, m.Size, m.Applied = len(payload), len(payload), false
+	if m.Algorithm == "" || len(payload) < m.Threshold {
+		return WriteFrame(w, payload)
+	}
+
+	var compressed bytes.Buffer
+	compressed.WriteString(compressedPrefix + m.Algorithm + "|" + strconv.Itoa(len(payload)) + "\n")
+	writer, err := newCompressor(&compressed, m.Algorithm)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(payload); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if compressed.Len() >= len(payload) {
+		return WriteFrame(w, payload)
+	}
+	m.Size, m.Applied = compressed.Len(), true
+	return WriteFrame(w, compressed.Bytes())
+}
+
+// Decode reads a frame, compressed or not, into Message.
+func (m *Compressed) Decode(r io.Reader) error {
+	payload, err := ReadFrame(r)
+	if err != nil {
+		return err
+	}
+	m.RawSize, m.Size, m.Applied = len(payload), len(payload), IsCompressed(payload)
+	if m.Applied {
+		if payload, err = Decompress(payload, 0); err != nil {
+			return err
+		}
+		m.RawSize = len(payload)
+	}
+	var frame bytes.Buffer
+	if err := WriteFrame(&frame, payload); err != nil {
+		return err
+	}
+	return m.Message.Decode(&frame)
+}
+
+// Ratio returns the size of the payload sent relative to the original one.
+func (m *Compressed) Ratio() float64 {
+	if m.RawSize == 0 {
+		return 1
+	}
+	return float64(m.Size) / float64(m.RawSize)
+}
+
+// IsCompressed reports whether a frame payload is compressed.
+func IsCompressed(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte(compressedPrefix))
+}
+
+// Decompress returns the original payload of a compressed frame. It fails
+// without decompressing anything when the payload announces more than maxSize
+// bytes, unless maxSize is 0.
+func Decompress(payload []byte, maxSize int) ([]byte, error) {
+	end := bytes.IndexByte(payload, '\n')
+	if !IsCompressed(payload) || end < 0 {
+		return nil, protocolErrorf("missing compression line")
+	}
+	line := string(payload[:end])
+	fields := strings.Split(strings.TrimPrefix(line, compressedPrefix), "|")
+	if len(fields) != 2 {
+		return nil, protocolErrorf("invalid compression line: %q", line)
+	}
+	size, err := strconv.Atoi(fields[1])
+	if err != nil || size < 0 {
+		return nil, protocolErrorf("invalid compressed size: %q", line)
+	}
+	if maxSize > 0 && size > maxSize {
+		return nil, protocolErrorf("compressed payload of %d bytes exceeds the limit of %d", size, maxSize)
+	}
+
+	reader, err := newDecompressor(bytes.NewReader(payload[end+1:]), fields[0])
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, protocolErrorf("invalid %s payload: %v", fields[0], err)
+	}
+	// The stream must end right after the announced size
+	if n, err := reader.Read(make([]byte, 1)); n > 0 || (err != nil && err != io.EOF) {
+		return nil, protocolErrorf("%s payload longer than the announced %d bytes", fields[0], size)
+	}
+	return data, nil
+}
+
+// newCompressor returns a writer compressing to w with algorithm.
+func newCompressor(w io.Writer, algorithm string) (io.WriteCloser, error) {
+	switch algorithm {
+	case FeatureGzip:
+		return gzip.NewWriter(w), nil
+	case FeatureFlate:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	}
+	return nil, fmt.Errorf("unknown compression algorithm %q", algorithm)
+}
+
+// newDecompressor returns a reader decompressing r with algorithm.
+func newDecompressor(r io.Reader, algorithm string) (io.ReadCloser, error) {
+	switch algorithm {
+	case FeatureGzip:
+		reader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, protocolErrorf("invalid gzip payload: %v", err)
+		}
+		return reader, nil
+	case FeatureFlate:
+		return flate.NewReader(r), nil
+	}
+	return nil, protocolErrorf("unknown compression algorithm %q", algorithm)
+}
+
+// frameCapture keeps the payload of the frame written to it instead of sending it.
+type frameCapture struct {
+	payload []byte
+}
+
+// WriteFrame implements FrameWriter.
+func (c *frameCapture) WriteFrame(payload []byte) error {
+	c.payload = payload
+	return nil
+}
+
+// Write fails, since only whole frames can be captured.
+func (c *frameCapture) Write(b []byte) (int, error) {
+	return 0, errors.New("frameCapture only captures frames")
+}
@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// compressedPayload returns the payload of a compressed frame announcing size
+// bytes and carrying data compressed with algorithm.
+func compressedPayload(t *testing.T, algorithm string, size int, data []byte) []byte {
+	t.Helper()
+	var payload bytes.Buffer
+	payload.WriteString(compressedPrefix + algorithm + "|" + strconv.Itoa(size) + "\n")
+	writer, err := newCompressor(&payload, algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return payload.Bytes()
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	lines := make([]string, 100)
+	for i := range lines {
+		lines[i] = "Santiago Lionel,Lorca," + strconv.Itoa(30904465+i) + ",1999-03-17,7574"
+	}
+	for _, algorithm := range []string{FeatureGzip, FeatureFlate} {
+		t.Run(algorithm, func(t *testing.T) {
+			sent := &Compressed{Message: &BatchRequest{AgencyID: "1", Lines: lines}, Algorithm: algorithm}
+			var frame bytes.Buffer
+			if err := sent.Encode(&frame); err != nil {
+				t.Fatalf("Encode() = %v", err)
+			}
+			if !sent.Applied || sent.Ratio() >= 1 {
+				t.Errorf("Encode() applied = %v with ratio %.2f, want a smaller payload", sent.Applied, sent.Ratio())
+			}
+
+			received := &Compressed{Message: &BatchRequest{}}
+			if err := received.Decode(&frame); err != nil {
+				t.Fatalf("Decode() = %v", err)
+			}
+			batch := received.Message.(*BatchRequest)
+			if batch.AgencyID != "1" || strings.Join(batch.Lines, "\n") != strings.Join(lines, "\n") {
+				t.Errorf("Decode() = agency %q with %d lines, want the batch sent", batch.AgencyID, len(batch.Lines))
+			}
+		})
+	}
+}
+
+func TestCompressedSkipsSmallPayloads(t *testing.T) {
+	sent := &Compressed{Message: &NotifyFinished{AgencyID: "1"}, Algorithm: FeatureGzip}
+	var frame bytes.Buffer
+	if err := sent.Encode(&frame); err != nil {
+		t.Fatalf("Encode() = %v", err)
+	}
+	if sent.Applied || IsCompressed(frame.Bytes()) {
+		t.Errorf("Encode() compressed a payload that does not shrink: %q", frame.String())
+	}
+}
+
+func TestCompressedSkipsPayloadsBelowThreshold(t *testing.T) {
+	lines := make([]string, 20)
+	for i := range lines {
+		lines[i] = "Santiago Lionel,Lorca,30904465,1999-03-17,7574"
+	}
+	request := &BatchRequest{AgencyID: "1", Lines: lines}
+	tests := []struct {
+		name      string
+		threshold int
+		applied   bool
+	}{
+		{"below the threshold", request.Size() + 1, false},
+		{"at the threshold", request.Size(), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := &Compressed{Message: request, Algorithm: FeatureGzip, Threshold: tt.threshold}
+			var frame bytes.Buffer
+			if err := sent.Encode(&frame); err != nil {
+				t.Fatalf("Encode() = %v", err)
+			}
+			payload, err := ReadFrame(&frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sent.Applied != tt.applied || IsCompressed(payload) != tt.applied {
+				t.Errorf("Encode() applied = %v, payload %q, want compressed %v", sent.Applied, payload, tt.applied)
+			}
+			if !tt.applied && !strings.HasPrefix(string(payload), "agency_ID|1\n") {
+				t.Errorf("payload = %q, want the plain batch", payload)
+			}
+		})
+	}
+}
+
+func TestDecompressBounds(t *testing.T) {
+	const limit = 1 << 20
+	bomb := make([]byte, 16<<20) // zeros, compressed to a few KB
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"announces more than the limit", compressedPayload(t, FeatureGzip, len(bomb), bomb)},
+		{"announces less than it holds", compressedPayload(t, FeatureGzip, 100, bomb)},
+		{"flate announcing less than it holds", compressedPayload(t, FeatureFlate, limit, bomb)},
+		{"holds less than it announces", compressedPayload(t, FeatureGzip, 100, bomb[:10])},
+		{"negative size", compressedPayload(t, FeatureGzip, -1, bomb[:10])},
+		{"unknown algorithm", []byte(compressedPrefix + "zstd|10\n0123456789")},
+		{"not compressed", []byte("0123456789")},
+		{"truncated stream", compressedPayload(t, FeatureGzip, 1000, bomb[:1000])[:30]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := Decompress(tt.payload, limit)
+			if err == nil {
+				t.Fatalf("Decompress() = %d bytes, want an error", len(data))
+			}
+			if !errors.Is(err, ErrProtocol) && !strings.Contains(err.Error(), "unknown compression") {
+				t.Errorf("Decompress() = %v, want %v", err, ErrProtocol)
+			}
+		})
+	}
+
+	data, err := Decompress(compressedPayload(t, FeatureGzip, limit, bomb[:limit]), limit)
+	if err != nil || len(data) != limit {
+		t.Errorf("Decompress() at the limit = %d bytes, %v, want %d bytes", len(data), err, limit)
+	}
+}
@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// Digest algorithms, advertised as features in the Hello exchange.
+const (
+	FeatureCRC32C = "crc32c"
+	FeatureSHA256 = "sha256"
+)
+
+const (
+	digestPrefix  = "digest|"
+	corruptPrefix = "corrupt|"
+)
+
+// castagnoli is the CRC32C table.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// AddDigest returns payload prefixed with a "digest|<algorithm>:<hex>" line,
+// FeatureCRC32C or FeatureSHA256, along with the "<algorithm>:<hex>" digest,
+// which servers echo in the ack of batches. The digest covers the payload as
+// sent, after any compression or signature.
+func AddDigest(payload []byte, algorithm string) ([]byte, string, error) {
+	digest, err := computeDigest(algorithm, payload)
+	if err != nil {
+		return nil, "", err
+	}
+	line := digestPrefix + digest + "\n"
+	digested := make([]byte, 0, len(line)+len(payload))
+	digested = append(digested, line...)
+	return append(digested, payload...), digest, nil
+}
+
+// IsDigested reports whether a frame payload starts with a digest line.
+func IsDigested(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte(digestPrefix))
+}
+
+// CheckDigest splits a frame payload with a digest line into the payload it
+// covers and the digest, failing with ErrCorrupted if they don't match.
+func CheckDigest(payload []byte) ([]byte, string, error) {
+	end := bytes.IndexByte(payload, '\n')
+	if !IsDigested(payload) || end < 0 {
+		return nil, "", protocolErrorf("missing digest line")
+	}
+	digest := strings.TrimPrefix(string(payload[:end]), digestPrefix)
+	algorithm := strings.SplitN(digest, ":", 2)[0]
+	body := payload[end+1:]
+	actual, err := computeDigest(algorithm, body)
+	if err != nil {
+		return nil, "", err
+	}
+	if actual != digest {
+		return nil, digest, fmt.Errorf("%w: payload digest is %s, the frame says %s", ErrCorrupted, actual, digest)
+	}
+	return body, digest, nil
+}
+
+// computeDigest returns the "<algorithm>:<hex>" digest of data.
+func computeDigest(algorithm string, data []byte) (string, error) {
+	var h hash.Hash
+	switch algorithm {
+	case FeatureCRC32C:
+		h = crc32.New(castagnoli)
+	case FeatureSHA256:
+		h = sha256.New()
+	default:
+		return "", protocolErrorf("unknown digest algorithm %q", algorithm)
+	}
+	h.Write(data)
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Corrupted is the reply to a request whose frame does not match its digest,
+// after which the server closes the connection, since the stream may be out of
+// sync. Decoding the reply of any request fails with ErrCorrupted when the
+// server sent this one instead, so the request can be sent again.
+type Corrupted struct {
+	Reason string
+}
+
+// Encode writes the "corrupt|<reason>" line.
+func (m *Corrupted) Encode(w io.Writer) error {
+	return writeLine(w, corruptPrefix+m.Reason)
+}
+
+// Decode reads a "corrupt|<reason>" line from r.
+func (m *Corrupted) Decode(r io.Reader) error {
+	line, err := readLine(r)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, corruptPrefix) {
+		return protocolErrorf("unexpected response: %s", line)
+	}
+	m.Reason = strings.TrimPrefix(line, corruptPrefix)
+	return nil
+}
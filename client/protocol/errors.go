@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+)
+
+// Errors that classify why an exchange with the server failed. They are
+// returned wrapped, so they must be checked with errors.Is.
+var (
+	// ErrServerClosed means the server closed or reset the connection before the
+	// whole reply arrived.
+	ErrServerClosed = errors.New("server closed the connection")
+	// ErrTimeout means the server did not answer in time.
+	ErrTimeout = errors.New("timeout")
+	// ErrProtocol means a message could not be parsed.
+	ErrProtocol = errors.New("protocol error")
+	// ErrRejected means the server understood the request but refused it, e.g.
+	// with "fail|N" for a batch.
+	ErrRejected = errors.New("rejected by the server")
+	// ErrDrawNotReady means the winners were queried before the draw took place.
+	ErrDrawNotReady = errors.New("draw (sorteo) not ready")
+	// ErrTLS means the TLS handshake with the server failed, e.g. because its
+	// certificate is not trusted or it refused the client certificate.
+	ErrTLS = errors.New("TLS handshake failed")
+	// ErrUnauthorized means the server refused the signature of a request, e.g.
+	// because the agency key is wrong.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrHelloUnsupported means the server answered a Hello as a request it
+	// doesn't understand, so it only speaks the legacy protocol.
+	ErrHelloUnsupported = errors.New("hello not supported by the server")
+	// ErrCorrupted means a frame or its ack did not match its digest, so it was
+	// damaged in transit and must be sent again.
+	ErrCorrupted = errors.New("corrupted in transit")
+)
+
+// protocolErrorf formats an error wrapping ErrProtocol.
+func protocolErrorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrProtocol, fmt.Sprintf(format, args...))
+}
+
+// connectionError wraps err with ErrServerClosed when it means the peer closed
+// or reset the connection, and returns any other error as is.
+func connectionError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return fmt.Errorf("%w: %v", ErrServerClosed, err)
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestConnectionError(t *testing.T) {
+	other := errors.New("no route to host")
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"end of stream", io.EOF, ErrServerClosed},
+		{"truncated", io.ErrUnexpectedEOF, ErrServerClosed},
+		{"reset", syscall.ECONNRESET, ErrServerClosed},
+		{"broken pipe", syscall.EPIPE, ErrServerClosed},
+		{"other", other, other},
+	}
+	for _, tt := range tests {
+		if err := connectionError(tt.err); !errors.Is(err, tt.want) {
+			t.Errorf("%s: connectionError(%v) = %v, want %v", tt.name, tt.err, err, tt.want)
+		}
+	}
+}
+
+func TestReplyErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  error
+	}{
+		{"closed before replying", "", ErrServerClosed},
+		{"closed in the middle of the reply", "succ", ErrServerClosed},
+		{"unknown status", "maybe|3\n", ErrProtocol},
+		{"count not a number", "success|many\n", ErrProtocol},
+	}
+	for _, tt := range tests {
+		var ack BatchAck
+		if err := ack.Decode(strings.NewReader(tt.reply)); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Decode(%q) = %v, want %v", tt.name, tt.reply, err, tt.want)
+		}
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	for _, payload := range []string{"", "hello|1\n", "agency_ID|1|seq|0\n"} {
+		if _, err := ParseRequest(payload); !errors.Is(err, ErrProtocol) {
+			t.Errorf("ParseRequest(%q) = %v, want %v", payload, err, ErrProtocol)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Package protocol implements the messages exchanged between the client and the
+// lottery server.
+//
+// Requests are sent as length-prefixed frames: the payload length in bytes written
+// in decimal, a ';' delimiter and then the payload itself ("N;payload").
+// Responses are plain text lines terminated by '\n'.
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// frameDelimiter separates the length header from the payload of a frame.
+const frameDelimiter = ';'
+
+// maxHeaderLength bounds the length header so garbage input is detected early.
+const maxHeaderLength = 10
+
+// MaxFrameLength bounds the payload of the frames read by ReadFrame.
+const MaxFrameLength = 64 << 20
+
+// FrameWriter is implemented by writers that transform the payload of every
+// frame before writing it, e.g. to sign it. WriteFrame hands them the payload
+// instead of framing it itself.
+type FrameWriter interface {
+	WriteFrame(payload []byte) error
+}
+
+// WriteFrame writes payload to w prefixed with its length header, or passes it
+// to w.WriteFrame if w is a FrameWriter.
+func WriteFrame(w io.Writer, payload []byte) error {
+	if fw, ok := w.(FrameWriter); ok {
+		return fw.WriteFrame(payload)
+	}
+	header := strconv.Itoa(len(payload)) + string(frameDelimiter)
+	frame := make([]byte, 0, len(header)+len(payload))
+	frame = append(frame, header...)
+	frame = append(frame, payload...)
+	return writeFull(w, frame)
+}
+
+// ReadFrame reads a single length-prefixed frame from r and returns its payload,
+// which can't be longer than MaxFrameLength. Callers reading several frames
+// from the same stream must pass the same *bufio.Reader every time so buffered
+// bytes are not lost.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	return ReadFrameLimit(r, MaxFrameLength)
+}
+
+// ReadFrameLimit is ReadFrame for frames whose payload is at most maxLength
+// bytes. Longer frames fail before anything is allocated for them, so peers
+// can't make the reader take more memory than that.
+func ReadFrameLimit(r io.Reader, maxLength int) ([]byte, error) {
+	reader := bufio.NewReader(r)
+
+	length, err := readFrameHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxLength {
+		return nil, protocolErrorf("frame of %d bytes exceeds the limit of %d", length, maxLength)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// readFrameHeader reads the length header of a frame, delimiter included. It
+// is read byte by byte, so a header that never ends fails after
+// maxHeaderLength digits instead of being buffered whole.
+func readFrameHeader(reader *bufio.Reader) (int, error) {
+	header := make([]byte, 0, maxHeaderLength)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b == frameDelimiter {
+			break
+		}
+		if b < '0' || b > '9' || len(header) == maxHeaderLength {
+			return 0, protocolErrorf("invalid frame header: %q", append(header, b))
+		}
+		header = append(header, b)
+	}
+	if len(header) == 0 {
+		return 0, protocolErrorf("invalid frame header: %q", header)
+	}
+	return strconv.Atoi(string(header))
+}
+
+// writeFull ensures that the entire data slice is written to w.
+// It loops until all bytes have been sent or an error occurs.
+func writeFull(w io.Writer, data []byte) error {
+	totalWritten := 0
+	for totalWritten < len(data) {
+		n, err := w.Write(data[totalWritten:])
+		if err != nil {
+			return connectionError(err)
+		}
+		totalWritten += n
+	}
+	return nil
+}
+
+// writeLine writes a single response line to w.
+func writeLine(w io.Writer, line string) error {
+	return writeFull(w, []byte(line+"\n"))
+}
+
+// readReply reads the first line of a reply, failing with ErrUnauthorized when
+// the server refused the signature of the request, or with ErrCorrupted when
+// the request did not match its digest.
+func readReply(r io.Reader) (string, error) {
+	line, err := readLine(r)
+	switch {
+	case err != nil:
+		return "", err
+	case strings.HasPrefix(line, unauthorizedPrefix):
+		return "", fmt.Errorf("%w: %s", ErrUnauthorized, strings.TrimPrefix(line, unauthorizedPrefix))
+	case strings.HasPrefix(line, corruptPrefix):
+		return "", fmt.Errorf("%w: %s", ErrCorrupted, strings.TrimPrefix(line, corruptPrefix))
+	}
+	return line, nil
+}
+
+// readLine reads a single response line from r and returns it without the
+// trailing line break. Replies are always terminated by '\n', so a connection
+// closed before the whole line arrived fails with ErrServerClosed instead of
+// returning the partial line.
+func readLine(r io.Reader) (string, error) {
+	reader := bufio.NewReader(r)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			return "", fmt.Errorf("%w: partial response %q", ErrServerClosed, line)
+		}
+		return "", connectionError(err)
+	}
+	return strings.TrimSpace(line), nil
+}
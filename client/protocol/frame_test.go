@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	payloads := []string{"", "x", "agency_ID|1\nAna,Paz,1,1990-01-01,1", strings.Repeat("a", 1<<16)}
+	var stream bytes.Buffer
+	for _, payload := range payloads {
+		if err := WriteFrame(&stream, []byte(payload)); err != nil {
+			t.Fatalf("WriteFrame() = %v", err)
+		}
+	}
+	if !strings.HasPrefix(stream.String(), "0;1;x") {
+		t.Errorf("stream starts with %q, want %q", stream.String()[:5], "0;1;x")
+	}
+
+	reader := bufio.NewReader(&stream)
+	for _, want := range payloads {
+		payload, err := ReadFrame(reader)
+		if err != nil {
+			t.Fatalf("ReadFrame() = %v", err)
+		}
+		if string(payload) != want {
+			t.Errorf("ReadFrame() = %d bytes, want %d", len(payload), len(want))
+		}
+	}
+	if _, err := ReadFrame(reader); err != io.EOF {
+		t.Errorf("ReadFrame() at the end = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestReadFrameLimit(t *testing.T) {
+	if payload, err := ReadFrameLimit(strings.NewReader("4;abcd"), 4); err != nil || string(payload) != "abcd" {
+		t.Errorf("ReadFrameLimit() at the limit = %q, %v, want %q", payload, err, "abcd")
+	}
+	if _, err := ReadFrameLimit(strings.NewReader("5;abcde"), 4); !errors.Is(err, ErrProtocol) {
+		t.Errorf("ReadFrameLimit() over the limit = %v, want %v", err, ErrProtocol)
+	}
+	// The length is refused before the payload is allocated or read
+	if _, err := ReadFrame(strings.NewReader("9999999999;")); !errors.Is(err, ErrProtocol) {
+		t.Errorf("ReadFrame() over MaxFrameLength = %v, want %v", err, ErrProtocol)
+	}
+}
+
+func TestReadFrameInvalidHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+	}{
+		{"empty length", ";abc"},
+		{"signed length", "-5;abcde"},
+		{"not a number", "abc;"},
+		{"space in length", " 3;abc"},
+		{"too many digits", "12345678901;"},
+		{"no delimiter", strings.Repeat("9", 100)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadFrame(strings.NewReader(tt.frame))
+			if !errors.Is(err, ErrProtocol) {
+				t.Errorf("ReadFrame(%q) = %v, want %v", tt.frame, err, ErrProtocol)
+			}
+		})
+	}
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	for _, frame := range []string{"", "12", "5;abc"} {
+		if _, err := ReadFrame(strings.NewReader(frame)); err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.Errorf("ReadFrame(%q) = %v, want an end of stream error", frame, err)
+		}
+	}
+}
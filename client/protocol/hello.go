@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Protocol versions. Version 1 is the legacy text protocol, spoken without a
+// hello; later versions are agreed on with the Hello exchange.
+const (
+	LegacyVersion = 1
+	Version       = 2 // newest version this package speaks
+)
+
+// Features a peer may support on top of the legacy protocol, as advertised in
+// the Hello exchange.
+const (
+	FeatureSequenced  = "sequenced"   // sequenced batches, stored at most once
+	FeaturePersistent = "persistent"  // connections stay open after each reply
+	FeaturePing       = "ping"        // heartbeats answered with "pong"
+	FeatureWaitDraw   = "wait_draw"   // WaitDraw requests, held until the draw is done
+	FeatureQuotedBets = "quoted_bets" // bet lines are read as CSV records, so quoted fields may hold commas
+)
+
+// Features lists every feature this package supports.
+var Features = []string{FeatureSequenced, FeaturePersistent, FeaturePing, FeatureWaitDraw, FeatureQuotedBets,
+	FeatureGzip, FeatureFlate, FeatureCRC32C, FeatureSHA256}
+
+const (
+	helloPrefix         = "hello|"
+	limitMaxBatchBytes  = "max_batch_bytes"
+	featureSeparator    = ","
+	limitSeparator      = ","
+	limitValueSeparator = "="
+)
+
+// Hello opens a connection: the client tells the server the newest protocol
+// version it speaks, its agency and the features it supports, as the frame
+// "hello|<version>|<agency>|<feature>,<feature>,...".
+//
+// Servers that don't know it answer as to any request they don't understand,
+// which ReadHelloReply reports as ErrHelloUnsupported.
+type Hello struct {
+	Version  int
+	AgencyID string
+	Features []string
+}
+
+// Encode writes the hello frame.
+func (m *Hello) Encode(w io.Writer) error {
+	return WriteFrame(w, []byte(helloPrefix+strconv.Itoa(m.Version)+"|"+m.AgencyID+"|"+
+		strings.Join(m.Features, featureSeparator)+"\n"))
+}
+
+// Decode reads a hello frame from r.
+func (m *Hello) Decode(r io.Reader) error {
+	return decodeRequest(r, m)
+}
+
+// parseHello parses the fields of a hello frame, without its prefix.
+func parseHello(data string) (*Hello, error) {
+	fields := strings.Split(data, "|")
+	if len(fields) != 3 {
+		return nil, protocolErrorf("invalid hello: %q", data)
+	}
+	version, err := strconv.Atoi(fields[0])
+	if err != nil || version < Version {
+		return nil, protocolErrorf("invalid hello version: %q", fields[0])
+	}
+	return &Hello{Version: version, AgencyID: strings.TrimSpace(fields[1]), Features: splitFeatures(fields[2])}, nil
+}
+
+// HelloAck is the reply to a Hello: the version both peers speak, the features
+// of the Hello the server supports too, and the limits of the server, as the
+// line "hello|<version>|<feature>,...|max_batch_bytes=<n>,...". Limits the
+// server doesn't have are left out, so MaxBatchBytes is 0 when unbounded.
+type HelloAck struct {
+	Version       int
+	Features      []string
+	MaxBatchBytes int // bound of the encoded payload of each batch, 0 means no bound
+}
+
+// Has reports whether the feature was agreed on.
+func (m *HelloAck) Has(feature string) bool {
+	for _, f := range m.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Encode writes the hello reply line.
+func (m *HelloAck) Encode(w io.Writer) error {
+	var limits []string
+	if m.MaxBatchBytes > 0 {
+		limits = append(limits, limitMaxBatchBytes+limitValueSeparator+strconv.Itoa(m.MaxBatchBytes))
+	}
+	return writeLine(w, helloPrefix+strconv.Itoa(m.Version)+"|"+strings.Join(m.Features, featureSeparator)+"|"+
+		strings.Join(limits, limitSeparator))
+}
+
+// Decode reads a hello reply from r. It fails with ErrHelloUnsupported if the
+// server answered with anything else.
+func (m *HelloAck) Decode(r io.Reader) error {
+	line, err := readReply(r)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, helloPrefix) {
+		return fmt.Errorf("%w: server answered %q", ErrHelloUnsupported, line)
+	}
+	fields := strings.Split(strings.TrimPrefix(line, helloPrefix), "|")
+	if len(fields) != 3 {
+		return protocolErrorf("invalid hello reply: %s", line)
+	}
+	version, err := strconv.Atoi(fields[0])
+	if err != nil || version < LegacyVersion {
+		return protocolErrorf("invalid version in hello reply: %s", line)
+	}
+	*m = HelloAck{Version: version, Features: splitFeatures(fields[1])}
+	for _, limit := range strings.Split(fields[2], limitSeparator) {
+		if limit == "" {
+			continue
+		}
+		parts := strings.SplitN(limit, limitValueSeparator, 2)
+		value, err := strconv.Atoi(parts[len(parts)-1])
+		if len(parts) != 2 || err != nil || value < 0 {
+			return protocolErrorf("invalid limit in hello reply: %q", limit)
+		}
+		// Limits added by newer servers are ignored
+		if parts[0] == limitMaxBatchBytes {
+			m.MaxBatchBytes = value
+		}
+	}
+	return nil
+}
+
+// splitFeatures parses a comma separated list of features.
+func splitFeatures(list string) []string {
+	var features []string
+	for _, feature := range strings.Split(list, featureSeparator) {
+		if feature = strings.TrimSpace(feature); feature != "" {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
@@ -0,0 +1,478 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is implemented by every value exchanged with the server. Encode writes
+// the message to the stream and Decode reads one message of the same kind from it.
+type Message interface {
+	Encode(w io.Writer) error
+	Decode(r io.Reader) error
+}
+
+const (
+	batchHeaderPrefix    = "agency_ID|"
+	batchSequenceField   = "|seq|"
+	batchUploadField     = "|upload|"
+	notifyFinishedPrefix = "notify_finished|"
+	queryWinnersPrefix   = "query_winners|"
+	waitDrawPrefix       = "wait_draw|"
+	pingRequest          = "ping"
+
+	batchSuccess     = "success"
+	batchFail        = "fail"
+	batchDuplicate   = "duplicate"
+	notifyAckLine    = "ack_notify"
+	drawNotReadyLine = "in_progress-sorteo_no_listo"
+	winnersPrefix    = "ok"
+	queryFailPrefix  = "fail-"
+	pongLine         = "pong"
+
+	unauthorizedPrefix = "unauthorized|"
+)
+
+// BatchRequest carries a chunk of bets of a single agency. Each line is a bet
+// already formatted as "first_name,last_name,document,birthdate,number".
+//
+// Sequence identifies the batch among the batches of the agency. A server that
+// supports sequenced batches stores each (agency, sequence) pair at most once:
+// when a batch with an already stored sequence arrives again, e.g. because the
+// ack of the first attempt was lost, it is not stored again and the server
+// answers "duplicate|N" with the amount of bets stored the first time. Rejected
+// batches are not recorded, so they can be sent again with the same sequence.
+// A zero Sequence sends a legacy unsequenced batch, which every server accepts.
+//
+// Upload scopes the sequences to a single upload of the agency, so a later
+// upload that numbers its batches from 1 again is not taken for a resend of
+// the first one. Retries and resumed uploads must keep the same Upload.
+type BatchRequest struct {
+	AgencyID string
+	Upload   string // ID of the upload the sequence belongs to, only sent with sequenced batches
+	Sequence uint64
+	Lines    []string
+}
+
+// Encode writes the batch as a frame: the "agency_ID|<id>" header line, extended
+// to "agency_ID|<id>|upload|<upload>|seq|<n>" for sequenced batches, or to
+// "agency_ID|<id>|seq|<n>" when they have no Upload, followed by one line per bet.
+func (m *BatchRequest) Encode(w io.Writer) error {
+	var sb strings.Builder
+	sb.Grow(m.Size())
+	sb.WriteString(m.header())
+	for _, line := range m.Lines {
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	return WriteFrame(w, []byte(sb.String()))
+}
+
+// Size returns the length in bytes of the encoded payload of the batch, without
+// the frame length header.
+func (m *BatchRequest) Size() int {
+	size := len(m.header())
+	for _, line := range m.Lines {
+		size += len(line) + 1
+	}
+	return size
+}
+
+// header returns the header line of the batch, including its line break.
+func (m *BatchRequest) header() string {
+	header := batchHeaderPrefix + m.AgencyID
+	if m.Sequence != 0 {
+		if m.Upload != "" {
+			header += batchUploadField + m.Upload
+		}
+		header += batchSequenceField + strconv.FormatUint(m.Sequence, 10)
+	}
+	return header + "\n"
+}
+
+// Decode reads a batch frame from r.
+func (m *BatchRequest) Decode(r io.Reader) error {
+	return decodeRequest(r, m)
+}
+
+// NotifyFinished tells the server the agency finished sending its bets.
+type NotifyFinished struct {
+	AgencyID string
+}
+
+// Encode writes the "notify_finished|<id>" frame.
+func (m *NotifyFinished) Encode(w io.Writer) error {
+	return WriteFrame(w, []byte(notifyFinishedPrefix+m.AgencyID+"\n"))
+}
+
+// Decode reads a notify_finished frame from r.
+func (m *NotifyFinished) Decode(r io.Reader) error {
+	return decodeRequest(r, m)
+}
+
+// QueryWinners asks the server for the winners of the agency.
+type QueryWinners struct {
+	AgencyID string
+}
+
+// Encode writes the "query_winners|<id>" frame.
+func (m *QueryWinners) Encode(w io.Writer) error {
+	return WriteFrame(w, []byte(queryWinnersPrefix+m.AgencyID+"\n"))
+}
+
+// Decode reads a query_winners frame from r.
+func (m *QueryWinners) Decode(r io.Reader) error {
+	return decodeRequest(r, m)
+}
+
+// WaitDraw asks the server for the winners of the agency like QueryWinners, but
+// the server holds the reply until the draw is done or Timeout passes, and then
+// answers as to QueryWinners. It saves agencies from polling while the draw is
+// not ready, and is only sent to servers that agreed on FeatureWaitDraw.
+type WaitDraw struct {
+	AgencyID string
+	Timeout  time.Duration
+}
+
+// Encode writes the "wait_draw|<id>|<timeout in milliseconds>" frame.
+func (m *WaitDraw) Encode(w io.Writer) error {
+	return WriteFrame(w, []byte(waitDrawPrefix+m.AgencyID+"|"+strconv.FormatInt(m.Timeout.Milliseconds(), 10)+"\n"))
+}
+
+// Decode reads a wait_draw frame from r.
+func (m *WaitDraw) Decode(r io.Reader) error {
+	return decodeRequest(r, m)
+}
+
+// Ping is a heartbeat sent over idle persistent connections to check that the
+// server is still there. Only servers that keep connections open support it.
+type Ping struct{}
+
+// Encode writes the "ping" frame.
+func (m *Ping) Encode(w io.Writer) error {
+	return WriteFrame(w, []byte(pingRequest+"\n"))
+}
+
+// Decode reads a ping frame from r.
+func (m *Ping) Decode(r io.Reader) error {
+	return decodeRequest(r, m)
+}
+
+// ReadRequest reads a frame from r and returns the request it carries, which is
+// one of *BatchRequest, *NotifyFinished, *QueryWinners, *WaitDraw, *Ping or
+// *Hello.
+func ReadRequest(r io.Reader) (Message, error) {
+	payload, err := ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRequest(string(payload))
+}
+
+// ParseRequest interprets the payload of a request frame.
+func ParseRequest(payload string) (Message, error) {
+	data := strings.TrimRight(payload, "\n")
+	if data == "" {
+		return nil, protocolErrorf("empty request")
+	}
+
+	if strings.HasPrefix(data, notifyFinishedPrefix) {
+		return &NotifyFinished{AgencyID: strings.TrimSpace(strings.TrimPrefix(data, notifyFinishedPrefix))}, nil
+	}
+	if strings.HasPrefix(data, queryWinnersPrefix) {
+		return &QueryWinners{AgencyID: strings.TrimSpace(strings.TrimPrefix(data, queryWinnersPrefix))}, nil
+	}
+	if data == pingRequest {
+		return &Ping{}, nil
+	}
+	if strings.HasPrefix(data, waitDrawPrefix) {
+		fields := strings.Split(strings.TrimPrefix(data, waitDrawPrefix), "|")
+		if len(fields) != 2 {
+			return nil, protocolErrorf("invalid wait_draw: %q", data)
+		}
+		timeout, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || timeout < 0 {
+			return nil, protocolErrorf("invalid wait_draw timeout: %q", data)
+		}
+		return &WaitDraw{AgencyID: strings.TrimSpace(fields[0]), Timeout: time.Duration(timeout) * time.Millisecond}, nil
+	}
+	if strings.HasPrefix(data, helloPrefix) {
+		return parseHello(strings.TrimPrefix(data, helloPrefix))
+	}
+
+	lines := strings.Split(data, "\n")
+	if !strings.HasPrefix(lines[0], batchHeaderPrefix) {
+		return nil, protocolErrorf("unknown request: %q", lines[0])
+	}
+	request := &BatchRequest{
+		AgencyID: strings.TrimSpace(strings.TrimPrefix(lines[0], batchHeaderPrefix)),
+		Lines:    lines[1:],
+	}
+	if i := strings.Index(request.AgencyID, batchSequenceField); i >= 0 {
+		sequence, err := strconv.ParseUint(request.AgencyID[i+len(batchSequenceField):], 10, 64)
+		if err != nil || sequence == 0 {
+			return nil, protocolErrorf("invalid batch sequence: %q", lines[0])
+		}
+		request.AgencyID = request.AgencyID[:i]
+		request.Sequence = sequence
+		if i := strings.Index(request.AgencyID, batchUploadField); i >= 0 {
+			request.Upload = request.AgencyID[i+len(batchUploadField):]
+			request.AgencyID = request.AgencyID[:i]
+			if request.Upload == "" {
+				return nil, protocolErrorf("empty batch upload: %q", lines[0])
+			}
+		}
+	}
+	return request, nil
+}
+
+// decodeRequest reads a request frame from r and stores it in target, failing
+// if the frame carries a different kind of request.
+func decodeRequest(r io.Reader, target Message) error {
+	request, err := ReadRequest(r)
+	if err != nil {
+		return err
+	}
+	switch t := target.(type) {
+	case *BatchRequest:
+		if m, ok := request.(*BatchRequest); ok {
+			*t = *m
+			return nil
+		}
+	case *NotifyFinished:
+		if m, ok := request.(*NotifyFinished); ok {
+			*t = *m
+			return nil
+		}
+	case *QueryWinners:
+		if m, ok := request.(*QueryWinners); ok {
+			*t = *m
+			return nil
+		}
+	case *Ping:
+		if _, ok := request.(*Ping); ok {
+			return nil
+		}
+	case *WaitDraw:
+		if m, ok := request.(*WaitDraw); ok {
+			*t = *m
+			return nil
+		}
+	case *Hello:
+		if m, ok := request.(*Hello); ok {
+			*t = *m
+			return nil
+		}
+	}
+	return protocolErrorf("unexpected request %T, expected %T", request, target)
+}
+
+// BatchAck is the reply to a BatchRequest: "success|N" when the N bets were
+// stored, "duplicate|N" when a sequenced batch had already been stored with N
+// bets, or "fail|N" when the batch was rejected. Duplicate acks are successful.
+// When the batch frame carried a digest (see AddDigest) the server echoes it as
+// a third field, "success|N|<algorithm>:<hex>", so the client can tell the ack
+// belongs to the batch it sent.
+type BatchAck struct {
+	Success   bool
+	Duplicate bool
+	Count     int
+	Digest    string // digest of the acknowledged frame, empty when it had none
+}
+
+// Encode writes the ack line.
+func (m *BatchAck) Encode(w io.Writer) error {
+	status := batchFail
+	switch {
+	case m.Success && m.Duplicate:
+		status = batchDuplicate
+	case m.Success:
+		status = batchSuccess
+	}
+	line := fmt.Sprintf("%s|%d", status, m.Count)
+	if m.Digest != "" {
+		line += "|" + m.Digest
+	}
+	return writeLine(w, line)
+}
+
+// Decode reads an ack line from r.
+func (m *BatchAck) Decode(r io.Reader) error {
+	line, err := readReply(r)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(line, "|")
+	if len(parts) < 2 || len(parts) > 3 || (parts[0] != batchSuccess && parts[0] != batchFail && parts[0] != batchDuplicate) {
+		return protocolErrorf("invalid server response: %s", line)
+	}
+	count, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return protocolErrorf("invalid count in server response: %s", line)
+	}
+	m.Success = parts[0] != batchFail
+	m.Duplicate = parts[0] == batchDuplicate
+	m.Count = count
+	m.Digest = ""
+	if len(parts) == 3 {
+		m.Digest = parts[2]
+	}
+	return nil
+}
+
+// NotifyAck is the reply to a NotifyFinished request.
+type NotifyAck struct{}
+
+// Encode writes the "ack_notify" line.
+func (m *NotifyAck) Encode(w io.Writer) error {
+	return writeLine(w, notifyAckLine)
+}
+
+// Decode reads an "ack_notify" line from r.
+func (m *NotifyAck) Decode(r io.Reader) error {
+	line, err := readReply(r)
+	if err != nil {
+		return err
+	}
+	if line != notifyAckLine {
+		return protocolErrorf("unexpected response: %s", line)
+	}
+	return nil
+}
+
+// Pong is the reply to a Ping.
+type Pong struct{}
+
+// Encode writes the "pong" line.
+func (m *Pong) Encode(w io.Writer) error {
+	return writeLine(w, pongLine)
+}
+
+// Decode reads a "pong" line from r.
+func (m *Pong) Decode(r io.Reader) error {
+	line, err := readReply(r)
+	if err != nil {
+		return err
+	}
+	if line != pongLine {
+		return protocolErrorf("unexpected response: %s", line)
+	}
+	return nil
+}
+
+// DrawNotReady is the reply to a QueryWinners request sent before the draw
+// (sorteo) took place.
+type DrawNotReady struct{}
+
+// Encode writes the "in_progress-sorteo_no_listo" line.
+func (m *DrawNotReady) Encode(w io.Writer) error {
+	return writeLine(w, drawNotReadyLine)
+}
+
+// Decode reads an "in_progress-sorteo_no_listo" line from r.
+func (m *DrawNotReady) Decode(r io.Reader) error {
+	line, err := readReply(r)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, drawNotReadyLine) {
+		return protocolErrorf("unexpected response: %s", line)
+	}
+	return nil
+}
+
+// QueryFailed is the reply to a QueryWinners request the server refused to answer.
+type QueryFailed struct {
+	Reason string
+}
+
+// Encode writes the "fail-<reason>" line.
+func (m *QueryFailed) Encode(w io.Writer) error {
+	return writeLine(w, queryFailPrefix+m.Reason)
+}
+
+// Decode reads a "fail-<reason>" line from r.
+func (m *QueryFailed) Decode(r io.Reader) error {
+	line, err := readReply(r)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, queryFailPrefix) {
+		return protocolErrorf("unexpected response: %s", line)
+	}
+	m.Reason = strings.TrimPrefix(line, queryFailPrefix)
+	return nil
+}
+
+// WinnersResponse is the reply to a QueryWinners request once the draw is done:
+// an "ok|<count>" line followed by one line per winning document.
+type WinnersResponse struct {
+	Documents []string
+}
+
+// Encode writes the header line and the winning documents.
+func (m *WinnersResponse) Encode(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s|%d\n", winnersPrefix, len(m.Documents)))
+	for _, document := range m.Documents {
+		sb.WriteString(document)
+		sb.WriteString("\n")
+	}
+	return writeFull(w, []byte(sb.String()))
+}
+
+// Decode reads the header line and the winning documents from r.
+func (m *WinnersResponse) Decode(r io.Reader) error {
+	line, err := readReply(r)
+	if err != nil {
+		return err
+	}
+	return m.decodeBody(r, line)
+}
+
+// decodeBody parses the already read header line and reads the documents it announces.
+func (m *WinnersResponse) decodeBody(r io.Reader, header string) error {
+	parts := strings.Split(header, "|")
+	if len(parts) != 2 || parts[0] != winnersPrefix {
+		return protocolErrorf("invalid response from server: %s", header)
+	}
+	count, err := strconv.Atoi(parts[1])
+	if err != nil || count < 0 {
+		return protocolErrorf("invalid count in response: %s", parts[1])
+	}
+
+	m.Documents = make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		document, err := readLine(r)
+		if err != nil {
+			return fmt.Errorf("failed reading winner %d: %w", i+1, err)
+		}
+		m.Documents = append(m.Documents, document)
+	}
+	return nil
+}
+
+// ReadWinnersReply reads the reply to a QueryWinners or WaitDraw request from r. It returns
+// a *WinnersResponse, a *DrawNotReady or a *QueryFailed.
+func ReadWinnersReply(r io.Reader) (Message, error) {
+	line, err := readReply(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasPrefix(line, drawNotReadyLine):
+		return &DrawNotReady{}, nil
+	case strings.HasPrefix(line, queryFailPrefix):
+		return &QueryFailed{Reason: strings.TrimPrefix(line, queryFailPrefix)}, nil
+	}
+
+	response := &WinnersResponse{}
+	if err := response.decodeBody(r, line); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
@@ -0,0 +1,125 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		request Message
+		wire    string
+	}{
+		{
+			name:    "batch",
+			request: &BatchRequest{AgencyID: "1", Lines: []string{"Ana,Paz,1,1990-01-01,1", "Luis,Paz,2,1990-01-01,2"}},
+			wire:    "59;agency_ID|1\nAna,Paz,1,1990-01-01,1\nLuis,Paz,2,1990-01-01,2\n",
+		},
+		{
+			name:    "sequenced batch",
+			request: &BatchRequest{AgencyID: "1", Upload: "ab12", Sequence: 7, Lines: []string{"Ana,Paz,1,1990-01-01,1"}},
+			wire:    "53;agency_ID|1|upload|ab12|seq|7\nAna,Paz,1,1990-01-01,1\n",
+		},
+		{
+			name:    "sequenced batch without upload",
+			request: &BatchRequest{AgencyID: "1", Sequence: 7, Lines: []string{"Ana,Paz,1,1990-01-01,1"}},
+			wire:    "41;agency_ID|1|seq|7\nAna,Paz,1,1990-01-01,1\n",
+		},
+		{name: "notify finished", request: &NotifyFinished{AgencyID: "3"}, wire: "18;notify_finished|3\n"},
+		{name: "query winners", request: &QueryWinners{AgencyID: "5"}, wire: "16;query_winners|5\n"},
+		{name: "ping", request: &Ping{}, wire: "5;ping\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			if err := tt.request.Encode(&stream); err != nil {
+				t.Fatalf("Encode() = %v", err)
+			}
+			if stream.String() != tt.wire {
+				t.Errorf("Encode() wrote %q, want %q", stream.String(), tt.wire)
+			}
+			request, err := ReadRequest(&stream)
+			if err != nil {
+				t.Fatalf("ReadRequest() = %v", err)
+			}
+			if !reflect.DeepEqual(request, tt.request) {
+				t.Errorf("ReadRequest() = %#v, want %#v", request, tt.request)
+			}
+		})
+	}
+}
+
+func TestParseRequestInvalid(t *testing.T) {
+	payloads := []string{
+		"",
+		"\n",
+		"hello|1\n",
+		"agency|1\nAna,Paz,1,1990-01-01,1\n",
+		"agency_ID|1|seq|0\nAna,Paz,1,1990-01-01,1\n",
+		"agency_ID|1|seq|two\nAna,Paz,1,1990-01-01,1\n",
+		"agency_ID|1|upload||seq|2\nAna,Paz,1,1990-01-01,1\n",
+	}
+	for _, payload := range payloads {
+		if request, err := ParseRequest(payload); err == nil {
+			t.Errorf("ParseRequest(%q) = %#v, want an error", payload, request)
+		}
+	}
+}
+
+func TestWinnersReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply Message
+	}{
+		{"winners", &WinnersResponse{Documents: []string{"30904465", "12345678"}}},
+		{"no winners", &WinnersResponse{Documents: []string{}}},
+		{"draw not ready", &DrawNotReady{}},
+		{"query failed", &QueryFailed{Reason: "agencia_no_encontrada"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			if err := tt.reply.Encode(&stream); err != nil {
+				t.Fatalf("Encode() = %v", err)
+			}
+			reply, err := ReadWinnersReply(bufio.NewReader(&stream))
+			if err != nil {
+				t.Fatalf("ReadWinnersReply() = %v", err)
+			}
+			if !reflect.DeepEqual(reply, tt.reply) {
+				t.Errorf("ReadWinnersReply() = %#v, want %#v", reply, tt.reply)
+			}
+		})
+	}
+}
+
+func TestBatchAckDecode(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    BatchAck
+		invalid bool
+	}{
+		{line: "success|3\n", want: BatchAck{Success: true, Count: 3}},
+		{line: "fail|0\n", want: BatchAck{Success: false, Count: 0}},
+		{line: "duplicate|3\n", want: BatchAck{Success: true, Duplicate: true, Count: 3}},
+		{line: "success\n", invalid: true},
+		{line: "success|many\n", invalid: true},
+		{line: "maybe|3\n", invalid: true},
+	}
+	for _, tt := range tests {
+		var ack BatchAck
+		err := ack.Decode(bytes.NewBufferString(tt.line))
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("Decode(%q) = %+v, want an error", tt.line, ack)
+			}
+			continue
+		}
+		if err != nil || ack != tt.want {
+			t.Errorf("Decode(%q) = %+v, %v, want %+v", tt.line, ack, err, tt.want)
+		}
+	}
+}
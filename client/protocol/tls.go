@@ -0,0 +1,34 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ParseTLSVersion parses a TLS version such as "1.2" or "1.3". Empty means 1.2,
+// the oldest version accepted.
+func ParseTLSVersion(name string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "tls") {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q, expected 1.2 or 1.3", name)
+}
+
+// LoadCertPool reads the PEM encoded certificates of the CA bundle at path.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return pool, nil
+}
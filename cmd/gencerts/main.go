@@ -0,0 +1,149 @@
+// Command gencerts writes throwaway certificates to try TLS between the client
+// and cmd/lottery-server locally: a CA (ca.pem), a server certificate signed by
+// it (server.pem, server-key.pem) and a client certificate for mutual TLS
+// (client.pem, client-key.pem). Running it twice on different directories gives
+// two unrelated CAs, handy to check that foreign client certificates are refused.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// keyPair is a certificate along with its private key.
+type keyPair struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+// issue creates a certificate from template, signed by parent or self-signed
+// when parent is nil.
+func issue(template *x509.Certificate, parent *keyPair) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{cert: cert, der: der, key: key}, nil
+}
+
+// write stores the certificate as name.pem and, when withKey is set, its key
+// as name-key.pem, readable by the owner only.
+func (p *keyPair) write(dir, name string, withKey bool) error {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.der})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0644); err != nil {
+		return err
+	}
+	if !withKey {
+		return nil
+	}
+	keyDER, err := x509.MarshalECPrivateKey(p.key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600)
+}
+
+func run(dir string, hosts []string, clientName string, validity time.Duration) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	notBefore := time.Now().Add(-time.Minute)
+	notAfter := notBefore.Add(validity)
+
+	ca, err := issue(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "lottery test CA"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("create CA: %w", err)
+	}
+
+	serverTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: hosts[0]},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			serverTemplate.IPAddresses = append(serverTemplate.IPAddresses, ip)
+		} else {
+			serverTemplate.DNSNames = append(serverTemplate.DNSNames, host)
+		}
+	}
+	server, err := issue(serverTemplate, ca)
+	if err != nil {
+		return fmt.Errorf("create server certificate: %w", err)
+	}
+
+	client, err := issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: clientName},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	if err != nil {
+		return fmt.Errorf("create client certificate: %w", err)
+	}
+
+	if err := ca.write(dir, "ca", false); err != nil {
+		return err
+	}
+	if err := server.write(dir, "server", true); err != nil {
+		return err
+	}
+	return client.write(dir, "client", true)
+}
+
+func main() {
+	dir := pflag.String("dir", "certs", "directory where the PEM files are written")
+	hosts := pflag.StringSlice("hosts", nil, "extra names and IPs the server certificate is valid for")
+	clientName := pflag.String("client-name", "agency", "common name of the client certificate")
+	validity := pflag.Duration("validity", 30*24*time.Hour, "how long the certificates are valid")
+	pflag.Parse()
+
+	all := append([]string{"localhost", "127.0.0.1", "::1", "server"}, *hosts...)
+	if err := run(*dir, all, *clientName, *validity); err != nil {
+		fmt.Fprintf(os.Stderr, "gencerts: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("wrote ca.pem, server.pem, server-key.pem, client.pem and client-key.pem to %s for %s\n", *dir, strings.Join(all, ", "))
+}
@@ -0,0 +1,198 @@
+// Command loadgen simulates many agencies sending their bets to the lottery
+// server at the same time. Every virtual agency runs as a goroutine on top of
+// lottery.Client, with its own ID and bets file, and a summary of throughput,
+// batch latency, retries and failures is printed when all of them are done.
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/spf13/pflag"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+)
+
+var log = logging.MustGetLogger("log")
+
+// options holds the load test parameters.
+type options struct {
+	server        string
+	agencies      int
+	firstID       int
+	data          string
+	dataFiles     int
+	batchSize     int
+	batchBytes    int
+	adaptive      bool
+	targetLatency time.Duration
+	inFlight      int
+	persistent    bool
+	sequenced     bool
+	rampUp        time.Duration
+	startJitter   time.Duration
+	thinkTime     time.Duration
+	stateDir      string
+	logLevel      string
+}
+
+func parseOptions() options {
+	var o options
+	pflag.StringVar(&o.server, "server", "localhost:12345", "server address")
+	pflag.IntVar(&o.agencies, "agencies", 5, "amount of virtual agencies")
+	pflag.IntVar(&o.firstID, "first-id", 1, "ID of the first agency, the rest use consecutive IDs")
+	pflag.StringVar(&o.data, "data", ".data/agency-%d.csv", "bets file of each agency, %d is replaced by the file number")
+	pflag.IntVar(&o.dataFiles, "data-files", 5, "amount of bets files to cycle through, 0 uses the agency ID as file number")
+	pflag.IntVar(&o.batchSize, "batch-size", 64, "bets per batch, initial size with --adaptive")
+	pflag.IntVar(&o.batchBytes, "batch-bytes", 0, "upper bound in bytes of each encoded batch, 0 means no bound")
+	pflag.BoolVar(&o.adaptive, "adaptive", false, "adapt the bets per batch to the ack latency")
+	pflag.DurationVar(&o.targetLatency, "target-latency", 100*time.Millisecond, "ack latency the adaptive batch size aims for")
+	pflag.IntVar(&o.inFlight, "in-flight", 1, "batches each agency sends without waiting for acks")
+	pflag.BoolVar(&o.persistent, "persistent", false, "reuse a single connection per agency")
+	pflag.BoolVar(&o.sequenced, "sequenced", false, "send sequenced batches")
+	pflag.DurationVar(&o.rampUp, "ramp-up", 0, "time over which agency starts are evenly spread")
+	pflag.DurationVar(&o.startJitter, "start-jitter", 0, "random extra delay, up to this value, before each agency starts")
+	pflag.DurationVar(&o.thinkTime, "think-time", 0, "pause of each agency after every batch")
+	pflag.StringVar(&o.stateDir, "state-dir", os.TempDir(), "directory for the rejects reports of the agencies")
+	pflag.StringVar(&o.logLevel, "log-level", "WARNING", "client log level")
+	pflag.Parse()
+	return o
+}
+
+// InitLogger sets the go-logging backend with the given level, using the same
+// format as the client.
+func InitLogger(logLevel string) error {
+	baseBackend := logging.NewLogBackend(os.Stderr, "", 0)
+	format := logging.MustStringFormatter(
+		`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
+	)
+	backendFormatter := logging.NewBackendFormatter(baseBackend, format)
+
+	backendLeveled := logging.AddModuleLevel(backendFormatter)
+	logLevelCode, err := logging.LogLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	backendLeveled.SetLevel(logLevelCode, "")
+
+	logging.SetBackend(backendLeveled)
+	return nil
+}
+
+// dataFile returns the bets file of the n-th agency (zero based).
+func (o options) dataFile(n int, id int) string {
+	fileNumber := id
+	if o.dataFiles > 0 {
+		fileNumber = n%o.dataFiles + 1
+	}
+	if strings.Contains(o.data, "%d") {
+		return fmt.Sprintf(o.data, fileNumber)
+	}
+	return o.data
+}
+
+// startDelay returns how long the n-th agency waits before starting.
+func (o options) startDelay(n int) time.Duration {
+	var delay time.Duration
+	if o.rampUp > 0 && o.agencies > 1 {
+		delay = o.rampUp * time.Duration(n) / time.Duration(o.agencies-1)
+	}
+	if o.startJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(o.startJitter)))
+	}
+	return delay
+}
+
+// runAgency sends the bets file of an agency, notifies the server and waits
+// for its winners, as the client binary does.
+func runAgency(ctx context.Context, agencyID string, dataFile string, options []lottery.Option) error {
+	client, err := lottery.New(agencyID, options...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ack, err := client.SubmitFile(ctx, dataFile)
+	if err != nil {
+		return err
+	}
+	if ack.Stored == 0 {
+		return nil
+	}
+	if err := client.Finish(ctx); err != nil {
+		return err
+	}
+	_, err = client.Winners(ctx)
+	return err
+}
+
+func main() {
+	o := parseOptions()
+	if err := InitLogger(o.logLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid log level: %v\n", err)
+		os.Exit(1)
+	}
+	rand.Seed(time.Now().UnixNano())
+
+	// SIGTERM and SIGINT stop every agency, the summary covers what was sent
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	metrics := &recorder{}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+
+	start := time.Now()
+	for n := 0; n < o.agencies; n++ {
+		id := o.firstID + n
+		options := []lottery.Option{
+			lottery.WithServer(o.server),
+			lottery.WithBatchSize(o.batchSize),
+			lottery.WithMaxBatchBytes(o.batchBytes),
+			lottery.WithInFlight(o.inFlight),
+			lottery.WithSequencedBatches(o.sequenced),
+			lottery.WithPersistentConnection(o.persistent),
+			lottery.WithStateDir(o.stateDir),
+			lottery.WithCheckpoints(false),
+			lottery.WithThinkTime(o.thinkTime),
+			lottery.WithMetrics(metrics),
+		}
+		if o.adaptive {
+			options = append(options, lottery.WithAdaptiveBatchSize(1, 4096, o.targetLatency))
+		}
+		agencyID := fmt.Sprint(id)
+		dataFile := o.dataFile(n, id)
+		delay := o.startDelay(n)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+			if err := runAgency(ctx, agencyID, dataFile, options); err != nil {
+				log.Errorf("action: agency_run | result: fail | client_id: %s | error: %v", agencyID, err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	metrics.summarize(o.agencies, failed, time.Since(start)).print(os.Stdout)
+	if failed > 0 {
+		stop()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// recorder collects the outcome of every batch sent by the virtual agencies.
+// It implements common.Metrics and is shared by every agency.
+type recorder struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	bets      int
+	retries   int
+	failures  int
+}
+
+// BatchAcked records an acknowledged batch.
+func (r *recorder) BatchAcked(size int, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies = append(r.latencies, latency)
+	r.bets += size
+}
+
+// BatchRetried records a failed attempt that is going to be retried.
+func (r *recorder) BatchRetried(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retries++
+}
+
+// BatchFailed records a batch given up after every attempt failed.
+func (r *recorder) BatchFailed(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures++
+}
+
+// summary holds the figures printed at the end of a load test.
+type summary struct {
+	agencies       int
+	failedAgencies int
+	elapsed        time.Duration
+	batches        int
+	bets           int
+	retries        int
+	failures       int
+	p50            time.Duration
+	p90            time.Duration
+	p99            time.Duration
+	max            time.Duration
+}
+
+// summarize computes the load test summary from the recorded batches.
+func (r *recorder) summarize(agencies int, failedAgencies int, elapsed time.Duration) summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	latencies := append([]time.Duration(nil), r.latencies...)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	s := summary{
+		agencies:       agencies,
+		failedAgencies: failedAgencies,
+		elapsed:        elapsed,
+		batches:        len(latencies),
+		bets:           r.bets,
+		retries:        r.retries,
+		failures:       r.failures,
+		p50:            percentile(latencies, 50),
+		p90:            percentile(latencies, 90),
+		p99:            percentile(latencies, 99),
+	}
+	if len(latencies) > 0 {
+		s.max = latencies[len(latencies)-1]
+	}
+	return s
+}
+
+// percentile returns the p-th percentile of the sorted latencies using the
+// nearest rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// print writes the summary in a human readable form.
+func (s summary) print(w io.Writer) {
+	seconds := s.elapsed.Seconds()
+	if seconds == 0 {
+		seconds = 1
+	}
+	fmt.Fprintf(w, "agencies:        %d (%d failed)\n", s.agencies, s.failedAgencies)
+	fmt.Fprintf(w, "elapsed:         %v\n", s.elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "bets acked:      %d (%.1f bets/s)\n", s.bets, float64(s.bets)/seconds)
+	fmt.Fprintf(w, "batches acked:   %d (%.1f batches/s)\n", s.batches, float64(s.batches)/seconds)
+	fmt.Fprintf(w, "batch latency:   p50 %v | p90 %v | p99 %v | max %v\n",
+		s.p50.Round(time.Microsecond), s.p90.Round(time.Microsecond),
+		s.p99.Round(time.Microsecond), s.max.Round(time.Microsecond))
+	fmt.Fprintf(w, "retries:         %d\n", s.retries)
+	fmt.Fprintf(w, "failed batches:  %d\n", s.failures)
+}
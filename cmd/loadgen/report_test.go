@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ms returns the given amounts of milliseconds as durations.
+func ms(values ...int) []time.Duration {
+	durations := make([]time.Duration, len(values))
+	for i, value := range values {
+		durations[i] = time.Duration(value) * time.Millisecond
+	}
+	return durations
+}
+
+func TestPercentile(t *testing.T) {
+	hundred := make([]int, 100)
+	for i := range hundred {
+		hundred[i] = i + 1
+	}
+	tests := []struct {
+		name   string
+		sorted []time.Duration
+		p      int
+		want   time.Duration
+	}{
+		{"no latencies", nil, 50, 0},
+		{"single latency", ms(7), 99, 7 * time.Millisecond},
+		{"median of an odd amount", ms(1, 2, 3, 4, 5), 50, 3 * time.Millisecond},
+		{"median of an even amount", ms(1, 2, 3, 4), 50, 2 * time.Millisecond},
+		{"p90 of a hundred", ms(hundred...), 90, 90 * time.Millisecond},
+		{"p99 of a hundred", ms(hundred...), 99, 99 * time.Millisecond},
+		{"p99 of a few rounds up to the max", ms(1, 2, 3), 99, 3 * time.Millisecond},
+		{"p0 is the min", ms(1, 2, 3), 0, 1 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.sorted, tt.p); got != tt.want {
+			t.Errorf("%s: percentile(%d) = %v, want %v", tt.name, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestRecorderSummary(t *testing.T) {
+	r := &recorder{}
+	for i, latency := range ms(40, 10, 30, 20) {
+		r.BatchAcked(i+1, latency)
+	}
+	r.BatchRetried(errors.New("timeout"))
+	r.BatchRetried(errors.New("timeout"))
+	r.BatchFailed(errors.New("failed to send batch"))
+
+	got := r.summarize(3, 1, 2*time.Second)
+	want := summary{
+		agencies:       3,
+		failedAgencies: 1,
+		elapsed:        2 * time.Second,
+		batches:        4,
+		bets:           10,
+		retries:        2,
+		failures:       1,
+		p50:            20 * time.Millisecond,
+		p90:            40 * time.Millisecond,
+		p99:            40 * time.Millisecond,
+		max:            40 * time.Millisecond,
+	}
+	if got != want {
+		t.Errorf("summarize() = %+v, want %+v", got, want)
+	}
+
+	var out bytes.Buffer
+	got.print(&out)
+	for _, line := range []string{
+		"agencies:        3 (1 failed)",
+		"elapsed:         2s",
+		"bets acked:      10 (5.0 bets/s)",
+		"batches acked:   4 (2.0 batches/s)",
+		"batch latency:   p50 20ms | p90 40ms | p99 40ms | max 40ms",
+		"retries:         2",
+		"failed batches:  1",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("report has no line %q:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestEmptySummary(t *testing.T) {
+	// A run where nothing was acked must not divide by zero or index an empty slice
+	s := (&recorder{}).summarize(1, 1, 0)
+	if s.batches != 0 || s.p50 != 0 || s.max != 0 {
+		t.Errorf("summarize() = %+v, want no batches", s)
+	}
+	var out bytes.Buffer
+	s.print(&out)
+	if !strings.Contains(out.String(), "bets acked:      0 (0.0 bets/s)") {
+		t.Errorf("report = %q", out.String())
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/spf13/pflag"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/lotteryserver"
+)
+
+var log = logging.MustGetLogger("log")
+
+// envOr returns the value of the env variable key, or fallback if it is not set.
+// Env variables use the same names as the Python server so both can be started
+// from the same docker compose definitions.
+func envOr(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+// envIntOr is envOr for integer parameters.
+func envIntOr(key string, fallback int) int {
+	value, err := strconv.Atoi(envOr(key, strconv.Itoa(fallback)))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// envDurationOr is envOr for duration parameters.
+func envDurationOr(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(envOr(key, fallback.String()))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// InitLogger sets the go-logging backend with the given level, using the same
+// format as the client.
+func InitLogger(logLevel string) error {
+	baseBackend := logging.NewLogBackend(os.Stdout, "", 0)
+	format := logging.MustStringFormatter(
+		`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
+	)
+	backendFormatter := logging.NewBackendFormatter(baseBackend, format)
+
+	backendLeveled := logging.AddModuleLevel(backendFormatter)
+	logLevelCode, err := logging.LogLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	backendLeveled.SetLevel(logLevelCode, "")
+
+	logging.SetBackend(backendLeveled)
+	return nil
+}
+
+func main() {
+	port := pflag.Int("port", envIntOr("SERVER_PORT", 12345), "port to listen on (env SERVER_PORT)")
+	agencies := pflag.Int("agencies", envIntOr("TOTAL_CLIENTES", 5), "agencies that must notify before the draw (env TOTAL_CLIENTES)")
+	storage := pflag.String("storage", envOr("STORAGE_FILEPATH", ""), "CSV file where bets are appended, empty to keep them in memory only (env STORAGE_FILEPATH)")
+	maxBatchBytes := pflag.Int("max-batch-bytes", envIntOr("MAX_BATCH_BYTES", 1<<20), "bound of the payload of each batch, advertised to clients, 0 means no bound (env MAX_BATCH_BYTES)")
+	logLevel := pflag.String("log-level", envOr("LOGGING_LEVEL", "INFO"), "log level (env LOGGING_LEVEL)")
+	var tlsFiles lotteryserver.TLSFiles
+	pflag.StringVar(&tlsFiles.CertFile, "tls-cert", envOr("TLS_CERT", ""), "server certificate, accepting TLS connections only when set (env TLS_CERT)")
+	pflag.StringVar(&tlsFiles.KeyFile, "tls-key", envOr("TLS_KEY", ""), "private key of the server certificate (env TLS_KEY)")
+	pflag.StringVar(&tlsFiles.ClientCAFile, "tls-client-ca", envOr("TLS_CLIENT_CA", ""), "CA bundle that verifies client certificates (env TLS_CLIENT_CA)")
+	pflag.BoolVar(&tlsFiles.RequireClientCert, "tls-require-client-cert", envOr("TLS_REQUIRE_CLIENT_CERT", "") == "true", "reject clients without a valid certificate (env TLS_REQUIRE_CLIENT_CERT)")
+	pflag.StringVar(&tlsFiles.MinVersion, "tls-min-version", envOr("TLS_MIN_VERSION", "1.2"), "oldest TLS version accepted, 1.2 or 1.3 (env TLS_MIN_VERSION)")
+	authKeys := pflag.String("auth-keys", envOr("AUTH_KEYS_FILE", ""), "file with \"<agency> <secret>\" lines, requiring requests signed by their agency when set (env AUTH_KEYS_FILE)")
+	authMaxSkew := pflag.Duration("auth-max-skew", envDurationOr("AUTH_MAX_SKEW", lotteryserver.DefaultMaxSkew), "how far from the server clock signed requests may be (env AUTH_MAX_SKEW)")
+	pflag.Parse()
+
+	if err := InitLogger(*logLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid log level: %v\n", err)
+		os.Exit(1)
+	}
+
+	log.Debugf("action: config | result: success | port: %d | agencies: %d | storage: %s | log_level: %s",
+		*port, *agencies, *storage, *logLevel)
+
+	config := lotteryserver.Config{
+		Address:          fmt.Sprintf(":%d", *port),
+		ExpectedAgencies: *agencies,
+		StoragePath:      *storage,
+		MaxBatchBytes:    *maxBatchBytes,
+	}
+	if tlsFiles.CertFile != "" {
+		tlsConfig, err := tlsFiles.Config()
+		if err != nil {
+			log.Criticalf("action: tls_config | result: fail | error: %v", err)
+			os.Exit(1)
+		}
+		config.TLS = tlsConfig
+	}
+	if *authKeys != "" {
+		keyring, err := lotteryserver.LoadKeyring(*authKeys)
+		if err != nil {
+			log.Criticalf("action: auth_config | result: fail | error: %v", err)
+			os.Exit(1)
+		}
+		keyring.MaxSkew = *authMaxSkew
+		log.Infof("action: auth_config | result: success | agencies: %d | max_skew: %v", keyring.Agencies(), *authMaxSkew)
+		config.Auth = keyring
+	}
+	server := lotteryserver.NewServer(config)
+	if err := server.Listen(); err != nil {
+		log.Criticalf("action: server_start | result: fail | error: %v", err)
+		os.Exit(1)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	shutdownDone := make(chan struct{})
+	go func() {
+		<-sigChan
+		log.Infof("action: shutdown_signal | result: in_progress | message: signal received")
+		server.Shutdown()
+		close(shutdownDone)
+	}()
+
+	if err := server.Serve(); err != nil {
+		log.Criticalf("action: serve | result: fail | error: %v", err)
+		os.Exit(1)
+	}
+	<-shutdownDone
+}
@@ -0,0 +1,228 @@
+package lotteryserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// maxKeysPerAgency is the amount of keys an agency can sign with at the same
+// time, so its key can be rotated: the new one is added to the server, then
+// handed to the agency, and the old one is removed once no longer used.
+const maxKeysPerAgency = 2
+
+// DefaultMaxSkew is how far from the server clock the timestamp of a signed
+// request may be when the Keyring does not say otherwise.
+const DefaultMaxSkew = 5 * time.Minute
+
+// Reasons why the signature of a request is refused, sent to the client in the
+// "unauthorized|<reason>" reply.
+var (
+	errUnsigned      = errors.New("unsigned request")
+	errUnknownAgency = errors.New("unknown agency")
+	errBadSignature  = errors.New("bad signature")
+	errStale         = errors.New("stale timestamp")
+	errReplayed      = errors.New("replayed nonce")
+	errAgencyChanged = errors.New("request agency does not match the signature")
+)
+
+// Keyring holds the secret keys of every agency and checks the signatures of
+// their requests. It remembers the nonces used within the accepted clock skew,
+// so a request captured on the wire is refused if sent again.
+type Keyring struct {
+	MaxSkew time.Duration // DefaultMaxSkew when zero
+
+	keys map[string][][]byte
+
+	mu   sync.Mutex
+	seen map[string]*nonceWindow
+}
+
+// NewKeyring returns an empty keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string][][]byte), seen: make(map[string]*nonceWindow)}
+}
+
+// LoadKeyring reads the keys of a file with "<agency> <secret>" lines. An agency
+// may appear in two lines while its key is being rotated. Blank lines and lines
+// starting with '#' are ignored.
+func LoadKeyring(path string) (*Keyring, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keyring := NewKeyring()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<agency> <secret>\"", path, line)
+		}
+		if err := keyring.Add(fields[0], []byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keyring, nil
+}
+
+// Add adds a key of the agency, which can have up to two.
+func (k *Keyring) Add(agency string, key []byte) error {
+	if len(key) == 0 {
+		return fmt.Errorf("empty key for agency %s", agency)
+	}
+	if len(k.keys[agency]) == maxKeysPerAgency {
+		return fmt.Errorf("agency %s already has %d keys", agency, maxKeysPerAgency)
+	}
+	k.keys[agency] = append(k.keys[agency], key)
+	return nil
+}
+
+// Agencies returns the amount of agencies with keys.
+func (k *Keyring) Agencies() int {
+	return len(k.keys)
+}
+
+// Verify checks that frame was signed with a key of its agency, recently and
+// with a nonce not seen before.
+func (k *Keyring) Verify(frame *protocol.SignedFrame, now time.Time) error {
+	keys, ok := k.keys[frame.AgencyID]
+	if !ok {
+		return errUnknownAgency
+	}
+	valid := false
+	for _, key := range keys {
+		if frame.Verify(key) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return errBadSignature
+	}
+
+	maxSkew := k.MaxSkew
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	skew := now.Sub(time.Unix(frame.Timestamp, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return errStale
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	window, ok := k.seen[frame.AgencyID]
+	if !ok {
+		window = &nonceWindow{nonces: make(map[string]struct{})}
+		k.seen[frame.AgencyID] = window
+	}
+	// A timestamp is accepted until maxSkew after it, and it is at most maxSkew
+	// ahead of now, so nonces must be remembered for twice the skew
+	if !window.add(frame.Nonce, now, 2*maxSkew) {
+		return errReplayed
+	}
+	return nil
+}
+
+// nonceWindow holds the nonces an agency used recently, in arrival order.
+type nonceWindow struct {
+	nonces map[string]struct{}
+	queue  []seenNonce
+}
+
+type seenNonce struct {
+	nonce   string
+	expires time.Time
+}
+
+// add records nonce, forgetting the ones older than ttl first. It returns false
+// if nonce was already recorded.
+func (w *nonceWindow) add(nonce string, now time.Time, ttl time.Duration) bool {
+	expired := 0
+	for expired < len(w.queue) && !w.queue[expired].expires.After(now) {
+		delete(w.nonces, w.queue[expired].nonce)
+		expired++
+	}
+	w.queue = w.queue[expired:]
+
+	if _, ok := w.nonces[nonce]; ok {
+		return false
+	}
+	w.nonces[nonce] = struct{}{}
+	w.queue = append(w.queue, seenNonce{nonce: nonce, expires: now.Add(ttl)})
+	return true
+}
+
+// unauthorizedError is returned by authenticate when the signature of a
+// request is refused.
+type unauthorizedError struct {
+	agency string
+	reason error
+}
+
+func (e *unauthorizedError) Error() string {
+	return fmt.Sprintf("agency %q: %v", e.agency, e.reason)
+}
+
+// authenticate parses the request carried by payload, as decode does. When the server has a
+// keyring the request must be signed by its agency; otherwise signatures are
+// stripped without checking them, so clients can start signing before the
+// server enforces it.
+func (s *Server) authenticate(payload []byte) (protocol.Message, error) {
+	if !protocol.IsSigned(payload) {
+		if s.config.Auth != nil {
+			return nil, &unauthorizedError{reason: errUnsigned}
+		}
+		return s.decode(payload)
+	}
+
+	frame, err := protocol.ParseSignedFrame(payload)
+	if err != nil {
+		return nil, err
+	}
+	if s.config.Auth != nil {
+		if err := s.config.Auth.Verify(frame, time.Now()); err != nil {
+			return nil, &unauthorizedError{agency: frame.AgencyID, reason: err}
+		}
+	}
+	request, err := s.decode(frame.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if agency, ok := requestAgency(request); ok && agency != frame.AgencyID && s.config.Auth != nil {
+		return nil, &unauthorizedError{agency: frame.AgencyID, reason: errAgencyChanged}
+	}
+	return request, nil
+}
+
+// requestAgency returns the agency a request is sent on behalf of, if any.
+func requestAgency(request protocol.Message) (string, bool) {
+	switch r := request.(type) {
+	case *protocol.BatchRequest:
+		return r.AgencyID, true
+	case *protocol.NotifyFinished:
+		return r.AgencyID, true
+	case *protocol.QueryWinners:
+		return r.AgencyID, true
+	case *protocol.WaitDraw:
+		return r.AgencyID, true
+	case *protocol.Hello:
+		return r.AgencyID, true
+	}
+	return "", false
+}
@@ -0,0 +1,192 @@
+package lotteryserver
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// payload returns the frame payload message is sent in.
+func payload(t *testing.T, message protocol.Message) []byte {
+	t.Helper()
+	var stream bytes.Buffer
+	if err := message.Encode(&stream); err != nil {
+		t.Fatalf("Encode() = %v", err)
+	}
+	payload, err := protocol.ReadFrame(bufio.NewReader(&stream))
+	if err != nil {
+		t.Fatalf("ReadFrame() = %v", err)
+	}
+	return payload
+}
+
+// sign signs the payload of message as agency with key.
+func sign(t *testing.T, agency string, key string, message protocol.Message) []byte {
+	t.Helper()
+	signer := &protocol.Signer{AgencyID: agency, Key: []byte(key)}
+	signed, err := signer.Sign(payload(t, message))
+	if err != nil {
+		t.Fatalf("Sign() = %v", err)
+	}
+	return signed
+}
+
+// signedFrame signs message as agency with key and parses it back, as the
+// server does.
+func signedFrame(t *testing.T, agency string, key string, message protocol.Message) *protocol.SignedFrame {
+	t.Helper()
+	frame, err := protocol.ParseSignedFrame(sign(t, agency, key, message))
+	if err != nil {
+		t.Fatalf("ParseSignedFrame() = %v", err)
+	}
+	return frame
+}
+
+func TestKeyringVerify(t *testing.T) {
+	keyring := NewKeyring()
+	keyring.MaxSkew = time.Minute
+	if err := keyring.Add("1", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Add("1", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	notify := &protocol.NotifyFinished{AgencyID: "1"}
+	batch := &protocol.BatchRequest{AgencyID: "1", Upload: "u1", Sequence: 1, Lines: []string{"Ana,Paz,1,1990-01-01,1"}}
+
+	tests := []struct {
+		name  string
+		frame *protocol.SignedFrame
+		now   time.Time
+		want  error
+	}{
+		{"old key", signedFrame(t, "1", "old", notify), now, nil},
+		{"new key", signedFrame(t, "1", "new", batch), now, nil},
+		{"wrong key", signedFrame(t, "1", "other", batch), now, errBadSignature},
+		{"unknown agency", signedFrame(t, "2", "old", &protocol.NotifyFinished{AgencyID: "2"}), now, errUnknownAgency},
+		{"too old", signedFrame(t, "1", "new", notify), now.Add(2 * time.Minute), errStale},
+		{"from the future", signedFrame(t, "1", "new", notify), now.Add(-2 * time.Minute), errStale},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := keyring.Verify(tt.frame, tt.now); !errors.Is(err, tt.want) {
+				t.Errorf("Verify() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyringRejectsTamperedPayload(t *testing.T) {
+	keyring := NewKeyring()
+	if err := keyring.Add("1", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	signed := sign(t, "1", "secret", &protocol.BatchRequest{AgencyID: "1", Lines: []string{"Ana,Paz,1,1990-01-01,1"}})
+	tampered := bytes.Replace(signed, []byte(",1\n"), []byte(",7\n"), 1)
+	frame, err := protocol.ParseSignedFrame(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Verify(frame, time.Now()); !errors.Is(err, errBadSignature) {
+		t.Errorf("Verify() of a tampered batch = %v, want %v", err, errBadSignature)
+	}
+}
+
+func TestKeyringRejectsReplay(t *testing.T) {
+	keyring := NewKeyring()
+	keyring.MaxSkew = time.Minute
+	if err := keyring.Add("1", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	notify := &protocol.NotifyFinished{AgencyID: "1"}
+	frame := signedFrame(t, "1", "secret", notify)
+	now := time.Unix(frame.Timestamp, 0)
+
+	if err := keyring.Verify(frame, now); err != nil {
+		t.Fatalf("Verify() = %v", err)
+	}
+	// The replay is refused for as long as the timestamp is accepted
+	for _, later := range []time.Duration{0, time.Second, time.Minute} {
+		if err := keyring.Verify(frame, now.Add(later)); !errors.Is(err, errReplayed) {
+			t.Errorf("Verify() of a replay %v later = %v, want %v", later, err, errReplayed)
+		}
+	}
+	if err := keyring.Verify(frame, now.Add(time.Minute+time.Second)); !errors.Is(err, errStale) {
+		t.Errorf("Verify() of a replay after the skew = %v, want %v", err, errStale)
+	}
+	// A fresh nonce of the same agency is still accepted
+	if err := keyring.Verify(signedFrame(t, "1", "secret", notify), now); err != nil {
+		t.Errorf("Verify() of a new frame = %v", err)
+	}
+}
+
+func TestNonceWindowForgetsExpired(t *testing.T) {
+	window := &nonceWindow{nonces: make(map[string]struct{})}
+	start := time.Now()
+	ttl := 2 * time.Minute
+
+	if !window.add("a", start, ttl) || !window.add("b", start.Add(time.Minute), ttl) {
+		t.Fatal("add() refused a new nonce")
+	}
+	if window.add("a", start.Add(ttl-time.Second), ttl) {
+		t.Error("add() accepted a nonce before it expired")
+	}
+	if !window.add("a", start.Add(ttl), ttl) {
+		t.Error("add() refused a nonce after it expired")
+	}
+	if window.add("b", start.Add(ttl), ttl) {
+		t.Error("add() forgot a nonce that had not expired")
+	}
+	if len(window.queue) != 2 || len(window.nonces) != 2 {
+		t.Errorf("window holds %d nonces in a queue of %d, want 2", len(window.nonces), len(window.queue))
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	keyring := NewKeyring()
+	for _, agency := range []string{"1", "2"} {
+		if err := keyring.Add(agency, []byte("secret-"+agency)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := NewServer(Config{Auth: keyring})
+	batch := func(agency string) protocol.Message {
+		return &protocol.BatchRequest{AgencyID: agency, Lines: []string{"Ana,Paz,1,1990-01-01,1"}}
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+		want    error // reason of the refusal
+	}{
+		{"own batch", sign(t, "1", "secret-1", batch("1")), nil},
+		{"own winners query", sign(t, "2", "secret-2", &protocol.QueryWinners{AgencyID: "2"}), nil},
+		{"batch of another agency", sign(t, "1", "secret-1", batch("2")), errAgencyChanged},
+		{"notify of another agency", sign(t, "1", "secret-1", &protocol.NotifyFinished{AgencyID: "2"}), errAgencyChanged},
+		{"key of another agency", sign(t, "1", "secret-2", batch("1")), errBadSignature},
+		{"unsigned", payload(t, batch("1")), errUnsigned},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := server.authenticate(tt.payload)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("authenticate() = %v", err)
+				}
+				if _, ok := requestAgency(request); !ok {
+					t.Errorf("authenticate() = %#v, want the signed request", request)
+				}
+				return
+			}
+			var unauthorized *unauthorizedError
+			if !errors.As(err, &unauthorized) || unauthorized.reason != tt.want {
+				t.Errorf("authenticate() = %v, %v, want refused with %v", request, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package lotteryserver_test
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/lotteryserver"
+)
+
+func TestBisectIsolatesRejectedBets(t *testing.T) {
+	server := startServer(t, lotteryserver.Config{ExpectedAgencies: 1})
+
+	// The proxy rejects every batch with the bet of document 3, as a server
+	// would with a bet it can't store, and records the sequences it forwards
+	var mu sync.Mutex
+	var sequences []uint64
+	uploads := map[string]bool{}
+	request := func(payload []byte) ([]byte, string) {
+		if !isBatch(payload) {
+			return payload, ""
+		}
+		message, err := protocol.ParseRequest(string(payload))
+		if err != nil {
+			t.Errorf("ParseRequest() = %v", err)
+			return payload, ""
+		}
+		batch := message.(*protocol.BatchRequest)
+		mu.Lock()
+		sequences = append(sequences, batch.Sequence)
+		uploads[batch.Upload] = true
+		mu.Unlock()
+		for _, line := range batch.Lines {
+			if strings.Contains(line, ",3,") {
+				return nil, "fail|0\n"
+			}
+		}
+		return payload, ""
+	}
+	proxy := startProxy(t, server, request, nil)
+
+	client, err := lottery.New("1",
+		lottery.WithServer(proxy.Addr()),
+		lottery.WithBatchSize(4),
+		lottery.WithSequencedBatches(true),
+		lottery.WithPersistentConnection(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	input := bet("1", 1) + "\n" + bet("2", 2) + "\n" + bet("3", 3) + "\n" + bet("4", 4) + "\n"
+	ack, err := client.SubmitFrom(context.Background(), strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("SubmitFrom() = %v", err)
+	}
+	if ack.Stored != 3 || len(ack.Rejected) != 1 || ack.Rejected[0].Line != 3 {
+		t.Errorf("SubmitFrom() = %+v, want 3 bets stored and line 3 rejected", ack)
+	}
+	if n := server.Store().Len(); n != 3 {
+		t.Errorf("stored bets = %d, want 3", n)
+	}
+
+	// The whole batch (1), its halves (2 and 3) and the halves of the second
+	// one (6 and 7), all within the upload of the batch
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sequences) != 5 || sequences[0] != 1 {
+		t.Fatalf("sequences = %x, want batch 1 and its 4 parts", sequences)
+	}
+	parts := append([]uint64(nil), sequences[1:]...)
+	sort.Slice(parts, func(i, j int) bool { return parts[i] < parts[j] })
+	for i, node := range []uint64{2, 3, 6, 7} {
+		if want := uint64(1)<<63 | 1<<20 | node; parts[i] != want {
+			t.Errorf("sequence of part %d = %x, want %x", node, parts[i], want)
+		}
+	}
+	if len(uploads) != 1 || uploads[""] {
+		t.Errorf("uploads = %v, want the one of the batch", uploads)
+	}
+}
@@ -0,0 +1,164 @@
+package lotteryserver_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/lotteryserver"
+)
+
+// newClient creates a client of agency against server, sending sequenced
+// batches of two bets over a persistent connection.
+func newClient(t *testing.T, server *lotteryserver.Server, agency string, options ...lottery.Option) *lottery.Client {
+	t.Helper()
+	fast := lottery.RetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, Multiplier: 1}
+	options = append([]lottery.Option{
+		lottery.WithServer(server.Addr().String()),
+		lottery.WithBatchSize(2),
+		lottery.WithSequencedBatches(true),
+		lottery.WithPersistentConnection(true),
+		lottery.WithDialRetry(fast),
+		lottery.WithSendRetry(fast),
+	}, options...)
+	client, err := lottery.New(agency, options...)
+	if err != nil {
+		t.Fatalf("lottery.New() = %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// testContext returns a context that ends with the test, or after a while.
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestResumeReplaysBatchesInFlight(t *testing.T) {
+	server := startServer(t, lotteryserver.Config{ExpectedAgencies: 1})
+	stateDir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "bets.csv")
+	var lines strings.Builder
+	for document := 1; document <= 10; document++ {
+		fmt.Fprintf(&lines, "Ana,Paz,%d,1990-01-01,%d\n", document, document)
+	}
+	if err := os.WriteFile(path, []byte(lines.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The proxy lets the server store the first three batches, but only the
+	// ack of the first one gets back, and then the upload is interrupted
+	ctx, cancel := context.WithCancel(testContext(t))
+	var mu sync.Mutex
+	batches, acks := 0, 0
+	request := func(payload []byte) ([]byte, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !isBatch(payload) {
+			return payload, ""
+		}
+		if batches++; batches > 3 {
+			return nil, ""
+		}
+		if batches == 3 {
+			defer cancel()
+		}
+		return payload, ""
+	}
+	reply := func(line string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasPrefix(line, "success|") {
+			if acks++; acks > 1 {
+				return ""
+			}
+		}
+		return line
+	}
+	proxy := startProxy(t, server, request, reply)
+	interrupted := newClient(t, server, "1",
+		lottery.WithServer(proxy.Addr()),
+		lottery.WithInFlight(4),
+		lottery.WithStateDir(stateDir),
+		lottery.WithCheckpoints(true),
+		lottery.WithShutdownGrace(50*time.Millisecond))
+
+	if _, err := interrupted.SubmitFile(ctx, path); !errors.Is(err, context.Canceled) {
+		t.Fatalf("SubmitFile() = %v, want %v", err, context.Canceled)
+	}
+	if n := server.Store().Len(); n != 6 {
+		t.Fatalf("stored bets after the interruption = %d, want 6", n)
+	}
+	checkpoint, err := common.LoadCheckpoint(filepath.Join(stateDir, "agency-1.checkpoint"))
+	if err != nil || checkpoint == nil {
+		t.Fatalf("LoadCheckpoint() = %+v, %v, want the checkpoint of the interrupted upload", checkpoint, err)
+	}
+	if len(checkpoint.Pending) < 2 {
+		t.Fatalf("checkpoint = %+v, want the batches in flight pending", checkpoint)
+	}
+
+	// The resumed upload sends the pending batches again with the same lines
+	// and sequences, so the server takes the stored ones for duplicates
+	resumed := newClient(t, server, "1", lottery.WithInFlight(4), lottery.WithStateDir(stateDir), lottery.WithCheckpoints(true))
+	ack, err := resumed.SubmitFile(testContext(t), path)
+	if err != nil {
+		t.Fatalf("SubmitFile() resumed = %v", err)
+	}
+	if ack.Stored != 10 {
+		t.Errorf("SubmitFile() resumed = %+v, want 10 bets stored", ack)
+	}
+	if n := server.Store().Len(); n != 10 {
+		t.Errorf("stored bets = %d, want 10", n)
+	}
+}
+
+func TestQuotedBetStored(t *testing.T) {
+	server := startServer(t, lotteryserver.Config{ExpectedAgencies: 1})
+	client := newClient(t, server, "1")
+
+	input := "\"Pérez, Juan\",Paz,1,1990-01-01,1\n" + bet("2", 2) + "\n"
+	ack, err := client.SubmitFrom(testContext(t), strings.NewReader(input))
+	if err != nil || ack.Stored != 2 {
+		t.Fatalf("SubmitFrom() = %+v, %v, want 2 bets stored", ack, err)
+	}
+	found := false
+	for _, stored := range server.Store().All() {
+		found = found || stored.Bet.FirstName == "Pérez, Juan"
+	}
+	if !found {
+		t.Errorf("stored bets = %+v, want the one with a comma in its name", server.Store().All())
+	}
+}
+
+func TestCompressedBatchesStored(t *testing.T) {
+	for _, algorithm := range []string{protocol.FeatureGzip, protocol.FeatureFlate} {
+		t.Run(algorithm, func(t *testing.T) {
+			server := startServer(t, lotteryserver.Config{ExpectedAgencies: 1, MaxBatchBytes: 4096})
+			client := newClient(t, server, "1", lottery.WithBatchSize(20), lottery.WithCompression(algorithm, 1))
+
+			var input strings.Builder
+			for document := 1; document <= 50; document++ {
+				input.WriteString(bet(strconv.Itoa(document), document) + "\n")
+			}
+			ack, err := client.SubmitFrom(testContext(t), strings.NewReader(input.String()))
+			if err != nil || ack.Stored != 50 {
+				t.Fatalf("SubmitFrom() = %+v, %v, want 50 bets stored", ack, err)
+			}
+			if n := server.Store().Len(); n != 50 {
+				t.Errorf("stored bets = %d, want 50", n)
+			}
+		})
+	}
+}
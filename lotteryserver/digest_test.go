@@ -0,0 +1,110 @@
+package lotteryserver_test
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/lotteryserver"
+)
+
+func TestDigestMismatchResendsBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests bool // damage the payload of the first batch
+		acks     bool // damage the digest of the first batch ack
+	}{
+		{"damaged request", true, false},
+		{"damaged ack", false, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			server := startServer(t, lotteryserver.Config{ExpectedAgencies: 1})
+
+			var mu sync.Mutex
+			batches := 0
+			damagedRequest, damagedAck := false, false
+			request := func(payload []byte) ([]byte, string) {
+				if !isBatch(payload) {
+					return payload, ""
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				batches++
+				if tt.requests && !damagedRequest {
+					damagedRequest = true
+					payload[len(payload)-1] ^= 1
+				}
+				return payload, ""
+			}
+			reply := func(line string) string {
+				parts := strings.Split(line, "|")
+				if len(parts) != 3 || parts[0] != "success" {
+					return line
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if tt.acks && !damagedAck {
+					damagedAck = true
+					digest := []byte(parts[2])
+					digest[len(digest)-2] ^= 1
+					line = parts[0] + "|" + parts[1] + "|" + string(digest)
+				}
+				return line
+			}
+			proxy := startProxy(t, server, request, reply)
+			client := newClient(t, server, "1",
+				lottery.WithServer(proxy.Addr()),
+				lottery.WithDigest(protocol.FeatureSHA256))
+
+			ack, err := client.SubmitFrom(testContext(t), strings.NewReader(bet("1", 1)+"\n"+bet("2", 2)+"\n"))
+			if err != nil || ack.Stored != 2 {
+				t.Fatalf("SubmitFrom() = %+v, %v, want 2 bets stored", ack, err)
+			}
+			mu.Lock()
+			if batches != 2 {
+				t.Errorf("batches sent = %d, want the damaged one and its resend", batches)
+			}
+			mu.Unlock()
+			if n := server.Store().Len(); n != 2 {
+				t.Errorf("stored bets = %d, want 2", n)
+			}
+		})
+	}
+}
+
+func TestDigestMismatchRefusedByServer(t *testing.T) {
+	server := startServer(t, lotteryserver.Config{ExpectedAgencies: 1})
+	conn, reader := dial(t, server)
+
+	request := &protocol.BatchRequest{AgencyID: "1", Lines: []string{bet("1", 1)}}
+	var frame bytes.Buffer
+	if err := request.Encode(&frame); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := protocol.ReadFrame(bufio.NewReader(&frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digested, _, err := protocol.AddDigest(payload, protocol.FeatureCRC32C)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digested[len(digested)-1] ^= 1
+	if err := protocol.WriteFrame(conn, digested); err != nil {
+		t.Fatal(err)
+	}
+
+	var corrupted protocol.Corrupted
+	if err := corrupted.Decode(reader); err != nil {
+		t.Fatalf("reply = %v, want a corrupt line", err)
+	}
+	if n := server.Store().Len(); n != 0 {
+		t.Errorf("stored bets = %d, want 0", n)
+	}
+}
@@ -0,0 +1,117 @@
+package lotteryserver_test
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/lotteryserver"
+)
+
+// proxy forwards connections to a server through hooks that may alter the
+// request frames and the reply lines going through it.
+type proxy struct {
+	listener net.Listener
+	server   string
+
+	// request returns the payload to forward in place of a request, or nil to
+	// answer it with reply instead of forwarding it
+	request func(payload []byte) (forward []byte, reply string)
+	// reply returns the line to forward in place of a reply from the server
+	reply func(line string) string
+}
+
+// startProxy runs a proxy in front of server until the test ends. Nil hooks
+// forward everything as is.
+func startProxy(t *testing.T, server *lotteryserver.Server,
+	request func(payload []byte) ([]byte, string), reply func(line string) string) *proxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &proxy{listener: listener, server: server.Addr().String(), request: request, reply: reply}
+	if p.request == nil {
+		p.request = func(payload []byte) ([]byte, string) { return payload, "" }
+	}
+	if p.reply == nil {
+		p.reply = func(line string) string { return line }
+	}
+	t.Cleanup(func() { listener.Close() })
+	go p.serve()
+	return p
+}
+
+// Addr returns the address clients connect to.
+func (p *proxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *proxy) serve() {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		server, err := net.Dial("tcp", p.server)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		// Replies the proxy makes up go through the same writer as the ones
+		// of the server, so lines are never interleaved
+		var mu sync.Mutex
+		write := func(line string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			_, err := client.Write([]byte(line))
+			return err
+		}
+		go p.forwardRequests(client, server, write)
+		go p.forwardReplies(server, client, write)
+	}
+}
+
+// forwardRequests copies frames from the client to the server.
+func (p *proxy) forwardRequests(client net.Conn, server net.Conn, write func(line string) error) {
+	defer server.Close()
+	reader := bufio.NewReader(client)
+	for {
+		payload, err := protocol.ReadFrame(reader)
+		if err != nil {
+			return
+		}
+		forward, reply := p.request(payload)
+		if forward == nil {
+			err = write(reply)
+		} else {
+			err = protocol.WriteFrame(server, forward)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// forwardReplies copies reply lines from the server to the client.
+func (p *proxy) forwardReplies(server net.Conn, client net.Conn, write func(line string) error) {
+	defer client.Close()
+	reader := bufio.NewReader(server)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if err := write(p.reply(line)); err != nil {
+			return
+		}
+	}
+}
+
+// isBatch reports whether a frame payload carries a batch of bets.
+func isBatch(payload []byte) bool {
+	return bytes.Contains(payload, []byte("agency_ID|"))
+}
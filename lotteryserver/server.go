@@ -0,0 +1,435 @@
+// Package lotteryserver is a Go implementation of the lottery server that speaks
+// the same wire protocol as the Python server in server/common. It keeps the bets
+// in memory (optionally appending them to a CSV file too) and runs the draw once
+// every expected agency notified it finished sending bets.
+//
+// Unlike the Python server, connections are kept open after each reply, so
+// clients can send several messages over the same connection, and "ping"
+// heartbeats on them are answered with "pong". Clients may open them with a
+// hello to agree on the protocol version, features such as batch compression
+// or frame digests, and limits such as Config.MaxBatchBytes. Frames that don't
+// match their digest are answered with "corrupt|<reason>" so they are resent.
+// Winners queries sent as "wait_draw" are held until the draw is done, up to
+// the timeout they carry, so clients don't need to poll for it.
+//
+// Setting Config.TLS makes the server accept TLS connections only, and verify
+// client certificates when the configuration asks for them (see TLSFiles).
+// Setting Config.Auth makes it refuse requests not signed by their agency with
+// one of its keys (see Keyring and protocol.Signer).
+package lotteryserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+var log = logging.MustGetLogger("log")
+
+// maxDecompressedBytes bounds the size of compressed requests once decompressed
+// when Config.MaxBatchBytes doesn't.
+const maxDecompressedBytes = 64 << 20
+
+// frameOverhead is the room left in request frames, on top of the largest batch,
+// for the signature, digest and compression lines that may precede it.
+const frameOverhead = 4 << 10
+
+// maxDrawWait bounds how long a wait_draw request is held, whatever timeout it asks for.
+const maxDrawWait = 5 * time.Minute
+
+// Config holds the server parameters.
+type Config struct {
+	Address          string      // listen address, e.g. ":12345"
+	ExpectedAgencies int         // amount of agencies that must notify before the draw
+	StoragePath      string      // optional CSV file where bets are appended
+	TLS              *tls.Config // accept TLS connections only, plain TCP when nil
+	Auth             *Keyring    // require requests signed by their agency, unchecked when nil
+	MaxBatchBytes    int         // bound of the payload of each batch, advertised in the hello reply, 0 means no bound
+}
+
+// Server accepts client connections and handles each one in its own goroutine.
+type Server struct {
+	config   Config
+	listener net.Listener
+	store    *Store
+	wg       sync.WaitGroup
+
+	drawReady chan struct{} // closed by runDraw
+	done      chan struct{} // closed by Shutdown, releasing the held wait_draw requests
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	closed   bool
+	notified map[int]struct{}
+	drawDone bool
+	winners  map[int][]string
+}
+
+// NewServer creates a server with the given configuration. Listen must be called
+// before Serve.
+func NewServer(config Config) *Server {
+	return &Server{
+		config:    config,
+		store:     NewStore(config.StoragePath),
+		drawReady: make(chan struct{}),
+		done:      make(chan struct{}),
+		conns:     make(map[net.Conn]struct{}),
+		notified:  make(map[int]struct{}),
+		winners:   make(map[int][]string),
+	}
+}
+
+// Listen binds the server socket. Using port 0 picks a free port, which can be
+// read afterwards with Addr.
+func (s *Server) Listen() error {
+	listener, err := net.Listen("tcp", s.config.Address)
+	if err != nil {
+		return err
+	}
+	if s.config.TLS != nil {
+		listener = tls.NewListener(listener, s.config.TLS)
+	}
+	s.listener = listener
+	log.Infof("action: server_start | result: success | address: %v | tls: %v", listener.Addr(), s.config.TLS != nil)
+	return nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts connections until Shutdown is called. It waits for every
+// connection handler to finish before returning.
+func (s *Server) Serve() error {
+	defer s.wg.Wait()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+		s.wg.Add(1)
+		go s.handleConnection(conn)
+	}
+}
+
+// ListenAndServe binds the server socket and serves until Shutdown is called.
+func (s *Server) ListenAndServe() error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Shutdown stops accepting connections and closes the open ones.
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	if !s.closed {
+		close(s.done)
+	}
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	err := s.listener.Close()
+	s.wg.Wait()
+	if closeErr := s.store.Close(); err == nil {
+		err = closeErr
+	}
+	log.Infof("action: server_shutdown | result: success")
+	return err
+}
+
+// Store returns the storage holding the received bets.
+func (s *Server) Store() *Store {
+	return s.store
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// track registers conn so Shutdown can close it. It returns false if the server
+// is already shutting down.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// handleConnection serves requests from conn until the client closes it or a
+// request can't be parsed.
+func (s *Server) handleConnection(conn net.Conn) {
+	defer s.wg.Done()
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// Done upfront so rejected certificates are logged as such, not as a bad request
+		if err := tlsConn.Handshake(); err != nil {
+			if !s.isClosed() {
+				log.Errorf("action: tls_handshake | result: fail | client: %v | error: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		state := tlsConn.ConnectionState()
+		client := "none"
+		if len(state.PeerCertificates) > 0 {
+			client = state.PeerCertificates[0].Subject.CommonName
+		}
+		log.Debugf("action: tls_handshake | result: success | client: %v | version: %s | certificate: %s",
+			conn.RemoteAddr(), tlsVersionName(state.Version), client)
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		payload, err := protocol.ReadFrameLimit(reader, s.maxFrameLength())
+		var request protocol.Message
+		var digest string
+		if err == nil && protocol.IsDigested(payload) {
+			payload, digest, err = protocol.CheckDigest(payload)
+		}
+		if errors.Is(err, protocol.ErrCorrupted) {
+			log.Warningf("action: frame_digest | result: fail | client: %v | error: %v", conn.RemoteAddr(), err)
+			(&protocol.Corrupted{Reason: "digest mismatch"}).Encode(conn)
+			return
+		}
+		if err == nil {
+			request, err = s.authenticate(payload)
+		}
+		var unauthorized *unauthorizedError
+		if errors.As(err, &unauthorized) {
+			log.Warningf("action: auth | result: fail | client: %v | agency: %s | reason: %v", conn.RemoteAddr(), unauthorized.agency, unauthorized.reason)
+			(&protocol.Unauthorized{Reason: unauthorized.reason.Error()}).Encode(conn)
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !s.isClosed() {
+				log.Errorf("action: receive_message | result: fail | error: %v", err)
+				(&protocol.BatchAck{Success: false}).Encode(conn)
+			}
+			return
+		}
+
+		if err := s.handleRequest(conn, request, digest); err != nil {
+			log.Errorf("action: handle_message | result: fail | error: %v", err)
+			return
+		}
+	}
+}
+
+// decode parses the request carried by payload, decompressing it first if it
+// is compressed. Compressed payloads can't announce more than the batch limit,
+// or maxDecompressedBytes when there is none.
+func (s *Server) decode(payload []byte) (protocol.Message, error) {
+	if protocol.IsCompressed(payload) {
+		maxSize := s.config.MaxBatchBytes
+		if maxSize <= 0 {
+			maxSize = maxDecompressedBytes
+		}
+		compressedSize := len(payload)
+		var err error
+		if payload, err = protocol.Decompress(payload, maxSize); err != nil {
+			return nil, err
+		}
+		log.Debugf("action: decompress | result: success | bytes: %d | compressed_bytes: %d", len(payload), compressedSize)
+	}
+	return protocol.ParseRequest(string(payload))
+}
+
+// maxFrameLength bounds the payload of request frames, so the server never
+// allocates much more than the largest batch it accepts before reading it.
+func (s *Server) maxFrameLength() int {
+	if s.config.MaxBatchBytes <= 0 {
+		return protocol.MaxFrameLength
+	}
+	return s.config.MaxBatchBytes + frameOverhead
+}
+
+// handleRequest dispatches a single request and writes its reply. digest is
+// the one of the request frame, if it had any.
+func (s *Server) handleRequest(conn net.Conn, request protocol.Message, digest string) error {
+	switch r := request.(type) {
+	case *protocol.BatchRequest:
+		return s.handleBatch(conn, r, digest)
+	case *protocol.NotifyFinished:
+		return s.handleNotifyFinished(conn, r)
+	case *protocol.QueryWinners:
+		return s.handleQueryWinners(conn, r)
+	case *protocol.WaitDraw:
+		return s.handleWaitDraw(conn, r)
+	case *protocol.Ping:
+		return (&protocol.Pong{}).Encode(conn)
+	case *protocol.Hello:
+		return s.handleHello(conn, r)
+	}
+	return fmt.Errorf("unsupported request %T", request)
+}
+
+// handleBatch stores the bets of the batch. The whole batch is rejected with
+// "fail|0" if any of its lines is not a valid bet. Sequenced batches that were
+// already stored by the same upload are acknowledged with "duplicate|N" without
+// storing them again. Every ack echoes the digest of the batch frame, if it had one.
+func (s *Server) handleBatch(conn net.Conn, request *protocol.BatchRequest, digest string) error {
+	reply := func(ack protocol.BatchAck) error {
+		ack.Digest = digest
+		return ack.Encode(conn)
+	}
+	agency, err := strconv.Atoi(request.AgencyID)
+	if err != nil {
+		log.Infof("action: apuesta_recibida | result: fail | error: invalid agency %q", request.AgencyID)
+		return reply(protocol.BatchAck{Success: false})
+	}
+	if size := request.Size(); s.config.MaxBatchBytes > 0 && size > s.config.MaxBatchBytes {
+		log.Infof("action: apuesta_recibida | result: fail | error: batch of %d bytes exceeds the limit of %d", size, s.config.MaxBatchBytes)
+		return reply(protocol.BatchAck{Success: false})
+	}
+
+	bets := make([]protocol.Bet, 0, len(request.Lines))
+	for _, line := range request.Lines {
+		bet, err := protocol.ParseBet(line)
+		if err != nil {
+			log.Infof("action: apuesta_recibida | result: fail | error: %v", err)
+			return reply(protocol.BatchAck{Success: false})
+		}
+		bets = append(bets, bet)
+	}
+
+	count, duplicate, err := s.store.Add(agency, request.Upload, request.Sequence, bets)
+	if err != nil {
+		log.Errorf("action: apuesta_recibida | result: fail | error: %v", err)
+		return reply(protocol.BatchAck{Success: false})
+	}
+
+	if duplicate {
+		log.Infof("action: apuesta_recibida | result: duplicate | agency: %d | upload: %s | seq: %d | cantidad: %d",
+			agency, request.Upload, request.Sequence, count)
+	} else {
+		log.Infof("action: apuesta_recibida | result: success | cantidad: %d", count)
+	}
+	return reply(protocol.BatchAck{Success: true, Duplicate: duplicate, Count: count})
+}
+
+// handleHello answers with the newest protocol version both peers speak, the
+// features of the client the server supports and the server limits.
+func (s *Server) handleHello(conn net.Conn, request *protocol.Hello) error {
+	version := request.Version
+	if version > protocol.Version {
+		version = protocol.Version
+	}
+	var features []string
+	for _, feature := range request.Features {
+		for _, supported := range protocol.Features {
+			if feature == supported {
+				features = append(features, feature)
+				break
+			}
+		}
+	}
+	log.Infof("action: hello | result: success | agency: %s | version: %d | features: %s",
+		request.AgencyID, version, strings.Join(features, ","))
+	return (&protocol.HelloAck{Version: version, Features: features, MaxBatchBytes: s.config.MaxBatchBytes}).Encode(conn)
+}
+
+// handleNotifyFinished registers the agency as finished and runs the draw
+// exactly once, when every expected agency has notified.
+func (s *Server) handleNotifyFinished(conn net.Conn, request *protocol.NotifyFinished) error {
+	agency, err := strconv.Atoi(request.AgencyID)
+	if err != nil {
+		return fmt.Errorf("invalid agency %q", request.AgencyID)
+	}
+
+	s.mu.Lock()
+	s.notified[agency] = struct{}{}
+	if !s.drawDone && len(s.notified) == s.config.ExpectedAgencies {
+		s.runDraw()
+	}
+	s.mu.Unlock()
+
+	return (&protocol.NotifyAck{}).Encode(conn)
+}
+
+// runDraw collects the winners of every agency. It must be called with s.mu held.
+func (s *Server) runDraw() {
+	for _, stored := range s.store.All() {
+		if HasWon(stored.Bet) {
+			s.winners[stored.Agency] = append(s.winners[stored.Agency], stored.Bet.Document)
+		}
+	}
+	s.drawDone = true
+	close(s.drawReady)
+	log.Infof("action: sorteo | result: success")
+}
+
+// handleQueryWinners answers with the agency winners if the draw is done, or
+// with "in_progress-sorteo_no_listo" otherwise.
+func (s *Server) handleQueryWinners(conn net.Conn, request *protocol.QueryWinners) error {
+	agency, err := strconv.Atoi(request.AgencyID)
+	if err != nil {
+		return fmt.Errorf("invalid agency %q", request.AgencyID)
+	}
+
+	s.mu.Lock()
+	drawDone := s.drawDone
+	winners := s.winners[agency]
+	s.mu.Unlock()
+
+	if !drawDone {
+		return (&protocol.DrawNotReady{}).Encode(conn)
+	}
+
+	log.Infof("action: consulta_ganadores | result: success | cant_ganadores: %d | agency: client%d", len(winners), agency)
+	return (&protocol.WinnersResponse{Documents: winners}).Encode(conn)
+}
+
+// handleWaitDraw answers as handleQueryWinners once the draw is done, holding
+// the request until then for up to its timeout, bounded by maxDrawWait. If the
+// draw is still not done by then it answers "in_progress-sorteo_no_listo".
+// Shutdown releases it without an answer.
+func (s *Server) handleWaitDraw(conn net.Conn, request *protocol.WaitDraw) error {
+	timeout := request.Timeout
+	if timeout > maxDrawWait {
+		timeout = maxDrawWait
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-s.drawReady:
+	case <-timer.C:
+	case <-s.done:
+		return nil // Shutdown already closed the connection
+	}
+	return s.handleQueryWinners(conn, &protocol.QueryWinners{AgencyID: request.AgencyID})
+}
@@ -0,0 +1,376 @@
+package lotteryserver_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/lotteryserver"
+)
+
+func TestMain(m *testing.M) {
+	logging.SetLevel(logging.ERROR, "")
+	os.Exit(m.Run())
+}
+
+// startServer runs a server on a loopback port until the test ends.
+func startServer(t *testing.T, config lotteryserver.Config) *lotteryserver.Server {
+	t.Helper()
+	config.Address = "127.0.0.1:0"
+	server := lotteryserver.NewServer(config)
+	if err := server.Listen(); err != nil {
+		t.Fatalf("Listen() = %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve() }()
+	t.Cleanup(func() {
+		server.Shutdown()
+		if err := <-done; err != nil {
+			t.Errorf("Serve() = %v", err)
+		}
+	})
+	return server
+}
+
+// dial opens a connection to server, closed when the test ends.
+func dial(t *testing.T, server *lotteryserver.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", server.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+// newSession opens a persistent client session to server, closed when the
+// test ends.
+func newSession(t *testing.T, server *lotteryserver.Server) *common.Session {
+	session := common.NewSession(common.ClientConfig{ServerAddress: server.Addr().String(), Persistent: true})
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+// bet returns the line of a valid bet with the given document and number.
+func bet(document string, number int) string {
+	return protocol.Bet{
+		FirstName: "Ana",
+		LastName:  "Gómez",
+		Document:  document,
+		Birthdate: time.Date(1990, 1, 2, 0, 0, 0, 0, time.UTC),
+		Number:    number,
+	}.String()
+}
+
+// sendBatch sends the bets of agency over session and returns the ack.
+func sendBatch(t *testing.T, session *common.Session, agency string, lines ...string) protocol.BatchAck {
+	t.Helper()
+	var ack protocol.BatchAck
+	if err := session.RoundTrip(context.Background(), &protocol.BatchRequest{AgencyID: agency, Lines: lines}, &ack); err != nil {
+		t.Fatalf("sending a batch: %v", err)
+	}
+	return ack
+}
+
+// notify tells the server agency finished sending its bets.
+func notify(t *testing.T, session *common.Session, agency string) {
+	t.Helper()
+	if err := session.RoundTrip(context.Background(), &protocol.NotifyFinished{AgencyID: agency}, &protocol.NotifyAck{}); err != nil {
+		t.Fatalf("notify_finished: %v", err)
+	}
+}
+
+// queryWinners asks for the winners of agency, returning a *WinnersResponse or
+// a *DrawNotReady.
+func queryWinners(t *testing.T, session *common.Session, agency string) protocol.Message {
+	t.Helper()
+	var reply protocol.Message
+	err := session.Do(context.Background(), func(conn net.Conn, reader *bufio.Reader) error {
+		if err := (&protocol.QueryWinners{AgencyID: agency}).Encode(conn); err != nil {
+			return err
+		}
+		var err error
+		reply, err = protocol.ReadWinnersReply(reader)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("query_winners: %v", err)
+	}
+	return reply
+}
+
+func TestSendNotifyWinners(t *testing.T) {
+	server := startServer(t, lotteryserver.Config{ExpectedAgencies: 2})
+	first, second := newSession(t, server), newSession(t, server)
+
+	if ack := sendBatch(t, first, "1", bet("100", lotteryserver.LotteryWinnerNumber), bet("101", 1)); !ack.Success || ack.Count != 2 {
+		t.Fatalf("ack = %+v, want 2 bets stored", ack)
+	}
+	sendBatch(t, first, "1", bet("102", lotteryserver.LotteryWinnerNumber))
+	sendBatch(t, second, "2", bet("200", 5), bet("201", lotteryserver.LotteryWinnerNumber))
+
+	// The draw waits for every agency
+	notify(t, first, "1")
+	if reply, ok := queryWinners(t, first, "1").(*protocol.DrawNotReady); !ok {
+		t.Fatalf("winners before the draw = %#v, want %T", reply, &protocol.DrawNotReady{})
+	}
+	notify(t, second, "2")
+
+	tests := []struct {
+		session *common.Session
+		agency  string
+		want    []string
+	}{
+		{first, "1", []string{"100", "102"}},
+		{second, "2", []string{"201"}},
+		{second, "3", nil},
+	}
+	for _, tt := range tests {
+		reply, ok := queryWinners(t, tt.session, tt.agency).(*protocol.WinnersResponse)
+		if !ok {
+			t.Fatalf("winners of agency %s = %#v, want the winners", tt.agency, reply)
+		}
+		if !equal(reply.Documents, tt.want) {
+			t.Errorf("winners of agency %s = %v, want %v", tt.agency, reply.Documents, tt.want)
+		}
+	}
+	if n := server.Store().Len(); n != 5 {
+		t.Errorf("stored bets = %d, want 5", n)
+	}
+}
+
+func TestConnectionKeptOpen(t *testing.T) {
+	server := startServer(t, lotteryserver.Config{ExpectedAgencies: 1})
+	conn, reader := dial(t, server)
+
+	for i, document := range []string{"1", "2", "3"} {
+		if err := (&protocol.BatchRequest{AgencyID: "1", Lines: []string{bet(document, 1)}}).Encode(conn); err != nil {
+			t.Fatal(err)
+		}
+		var ack protocol.BatchAck
+		if err := ack.Decode(reader); err != nil || !ack.Success {
+			t.Fatalf("ack #%d = %+v, %v, want success", i+1, ack, err)
+		}
+	}
+	if n := server.Store().Len(); n != 3 {
+		t.Errorf("stored bets = %d, want 3", n)
+	}
+}
+
+func TestPingAnswered(t *testing.T) {
+	server := startServer(t, lotteryserver.Config{ExpectedAgencies: 1})
+	session := common.NewSession(common.ClientConfig{
+		ServerAddress:     server.Addr().String(),
+		Persistent:        true,
+		ReadTimeout:       time.Second,
+		HeartbeatInterval: 20 * time.Millisecond,
+	})
+	defer session.Close()
+
+	if err := session.RoundTrip(context.Background(), &protocol.Ping{}, &protocol.Pong{}); err != nil {
+		t.Fatalf("ping = %v", err)
+	}
+	// The heartbeats sent while idle must leave the connection usable
+	time.Sleep(100 * time.Millisecond)
+	if ack := sendBatch(t, session, "1", bet("1", 1)); !ack.Success {
+		t.Errorf("ack after idling = %+v, want success", ack)
+	}
+}
+
+func TestInvalidBatchRejected(t *testing.T) {
+	server := startServer(t, lotteryserver.Config{ExpectedAgencies: 1})
+	session := newSession(t, server)
+
+	tests := []struct {
+		name   string
+		agency string
+		lines  []string
+	}{
+		{"invalid bet", "1", []string{bet("1", 1), "Ana,Paz,2,17/03/1999,2"}},
+		{"invalid agency", "one", []string{bet("1", 1)}},
+	}
+	for _, tt := range tests {
+		if ack := sendBatch(t, session, tt.agency, tt.lines...); ack.Success {
+			t.Errorf("%s: ack = %+v, want fail", tt.name, ack)
+		}
+	}
+	if n := server.Store().Len(); n != 0 {
+		t.Errorf("stored bets = %d, want the whole batches rejected", n)
+	}
+}
+
+func TestOversizedFrameRejected(t *testing.T) {
+	server := startServer(t, lotteryserver.Config{ExpectedAgencies: 1})
+	tests := []struct {
+		name  string
+		frame string
+	}{
+		{"length over the limit", "9999999999;"},
+		{"header without delimiter", "12345678901234567890"},
+		{"signed length", "-5;"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, reader := dial(t, server)
+			if _, err := conn.Write([]byte(tt.frame)); err != nil {
+				t.Fatal(err)
+			}
+			var ack protocol.BatchAck
+			if err := ack.Decode(reader); err != nil || ack.Success {
+				t.Fatalf("reply = %+v, %v, want fail", ack, err)
+			}
+			if _, err := reader.ReadByte(); err == nil {
+				t.Error("the connection is still open")
+			}
+		})
+	}
+}
+
+func TestFrameBoundedByBatchLimit(t *testing.T) {
+	server := startServer(t, lotteryserver.Config{ExpectedAgencies: 1, MaxBatchBytes: 512})
+
+	// Frames may hold the largest batch plus a few KiB of signature and such,
+	// anything longer is refused before its payload is read
+	conn, reader := dial(t, server)
+	if _, err := conn.Write([]byte("8192;")); err != nil {
+		t.Fatal(err)
+	}
+	var ack protocol.BatchAck
+	if err := ack.Decode(reader); err != nil || ack.Success {
+		t.Fatalf("reply = %+v, %v, want fail", ack, err)
+	}
+	if _, err := reader.ReadByte(); err == nil {
+		t.Error("the connection is still open")
+	}
+
+	// A batch within the limit is stored
+	session := newSession(t, server)
+	if ack := sendBatch(t, session, "1", bet("1", 1)); !ack.Success {
+		t.Errorf("ack = %+v, want success", ack)
+	}
+}
+
+func TestSequencedBatches(t *testing.T) {
+	server := startServer(t, lotteryserver.Config{ExpectedAgencies: 1})
+	session := newSession(t, server)
+	send := func(upload string, sequence uint64, lines ...string) protocol.BatchAck {
+		t.Helper()
+		var ack protocol.BatchAck
+		request := &protocol.BatchRequest{AgencyID: "1", Upload: upload, Sequence: sequence, Lines: lines}
+		if err := session.RoundTrip(context.Background(), request, &ack); err != nil {
+			t.Fatalf("sending a batch: %v", err)
+		}
+		return ack
+	}
+
+	tests := []struct {
+		name     string
+		upload   string
+		sequence uint64
+		lines    []string
+		want     protocol.BatchAck
+		stored   int
+	}{
+		{"first delivery", "a1", 1, []string{bet("1", 1), bet("2", 2)}, protocol.BatchAck{Success: true, Count: 2}, 2},
+		{"resend", "a1", 1, []string{bet("1", 1), bet("2", 2)}, protocol.BatchAck{Success: true, Duplicate: true, Count: 2}, 2},
+		{"next sequence", "a1", 2, []string{bet("3", 3)}, protocol.BatchAck{Success: true, Count: 1}, 3},
+		{"same sequence of another upload", "b2", 1, []string{bet("4", 4)}, protocol.BatchAck{Success: true, Count: 1}, 4},
+		{"rejected batch", "a1", 3, []string{"Ana,Paz,5,17/03/1999,5"}, protocol.BatchAck{}, 4},
+		{"rejected sequence sent again", "a1", 3, []string{bet("5", 5)}, protocol.BatchAck{Success: true, Count: 1}, 5},
+	}
+	for _, tt := range tests {
+		if ack := send(tt.upload, tt.sequence, tt.lines...); ack != tt.want {
+			t.Errorf("%s: ack = %+v, want %+v", tt.name, ack, tt.want)
+		}
+		if n := server.Store().Len(); n != tt.stored {
+			t.Errorf("%s: stored bets = %d, want %d", tt.name, n, tt.stored)
+		}
+	}
+}
+
+func TestStorageFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bets.csv")
+	server := startServer(t, lotteryserver.Config{ExpectedAgencies: 1, StoragePath: path})
+	sendBatch(t, newSession(t, server), "3", bet("1", 10), bet("2", 20))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "3,Ana,Gómez,1,1990-01-02,10\n3,Ana,Gómez,2,1990-01-02,20\n"
+	if string(data) != want {
+		t.Errorf("storage file = %q, want %q", data, want)
+	}
+}
+
+// equal reports whether a and b hold the same documents, in any order.
+func equal(a []string, b []string) bool {
+	a, b = append([]string(nil), a...), append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return strings.Join(a, ",") == strings.Join(b, ",")
+}
+
+func TestWaitDraw(t *testing.T) {
+	server := startServer(t, lotteryserver.Config{ExpectedAgencies: 2})
+	session := newSession(t, server)
+	sendBatch(t, session, "1", bet("100", lotteryserver.LotteryWinnerNumber))
+	notify(t, session, "1")
+
+	// waitDraw sends a wait_draw of agency 1 on its own connection and
+	// returns the reply and how long it was held
+	type result struct {
+		reply protocol.Message
+		held  time.Duration
+		err   error
+	}
+	waitDraw := func(timeout time.Duration) <-chan result {
+		conn, reader := dial(t, server)
+		done := make(chan result, 1)
+		go func() {
+			start := time.Now()
+			if err := (&protocol.WaitDraw{AgencyID: "1", Timeout: timeout}).Encode(conn); err != nil {
+				done <- result{err: err}
+				return
+			}
+			reply, err := protocol.ReadWinnersReply(reader)
+			done <- result{reply, time.Since(start), err}
+		}()
+		return done
+	}
+
+	// The draw is not done when the timeout passes
+	const timeout = 100 * time.Millisecond
+	r := <-waitDraw(timeout)
+	if _, ok := r.reply.(*protocol.DrawNotReady); !ok || r.err != nil {
+		t.Fatalf("reply after the timeout = %#v, %v, want %T", r.reply, r.err, &protocol.DrawNotReady{})
+	}
+	if r.held < timeout {
+		t.Errorf("request held %v, want at least %v", r.held, timeout)
+	}
+
+	// The draw releases the request held
+	pending := waitDraw(10 * time.Second)
+	time.Sleep(50 * time.Millisecond)
+	notify(t, session, "2")
+	select {
+	case r := <-pending:
+		winners, ok := r.reply.(*protocol.WinnersResponse)
+		if !ok || r.err != nil || !equal(winners.Documents, []string{"100"}) {
+			t.Errorf("reply after the draw = %#v, %v, want the winners", r.reply, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the draw did not release the request")
+	}
+}
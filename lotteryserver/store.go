@@ -0,0 +1,133 @@
+package lotteryserver
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// LotteryWinnerNumber is the simulated winner number of the lottery contest.
+const LotteryWinnerNumber = 7574
+
+// StoredBet is a bet together with the agency that sent it.
+type StoredBet struct {
+	Agency int
+	Bet    protocol.Bet
+}
+
+// HasWon checks whether a bet won the prize or not.
+func HasWon(bet protocol.Bet) bool {
+	return bet.Number == LotteryWinnerNumber
+}
+
+// batchKey identifies a sequenced batch.
+type batchKey struct {
+	agency   int
+	upload   string
+	sequence uint64
+}
+
+// Store keeps the received bets in memory. When created with a path, bets are
+// also appended to that CSV file with the same layout the Python server uses.
+// It is safe for concurrent use.
+type Store struct {
+	path    string
+	mu      sync.Mutex
+	bets    []StoredBet
+	batches map[batchKey]int // bets stored by each sequenced batch
+	file    *os.File
+}
+
+// NewStore creates an empty store. An empty path keeps bets in memory only.
+func NewStore(path string) *Store {
+	return &Store{
+		path:    path,
+		batches: make(map[batchKey]int),
+	}
+}
+
+// Add stores the bets of a batch of an agency and returns how many bets the
+// batch holds. A non zero sequence makes the operation idempotent: if the
+// agency already stored a batch with that sequence in the same upload nothing
+// is stored, and the count of the first delivery is returned with duplicate set.
+func (s *Store) Add(agency int, upload string, sequence uint64, bets []protocol.Bet) (count int, duplicate bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := batchKey{agency: agency, upload: upload, sequence: sequence}
+	if sequence != 0 {
+		if stored, ok := s.batches[key]; ok {
+			return stored, true, nil
+		}
+	}
+
+	if s.path != "" {
+		if err := s.persist(agency, bets); err != nil {
+			return 0, false, err
+		}
+	}
+	for _, bet := range bets {
+		s.bets = append(s.bets, StoredBet{Agency: agency, Bet: bet})
+	}
+	if sequence != 0 {
+		s.batches[key] = len(bets)
+	}
+	return len(bets), false, nil
+}
+
+// All returns a copy of every stored bet.
+func (s *Store) All() []StoredBet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]StoredBet(nil), s.bets...)
+}
+
+// Len returns the amount of stored bets.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bets)
+}
+
+// Close closes the storage file, if any.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// persist appends the bets to the storage file. It must be called with s.mu held.
+func (s *Store) persist(agency int, bets []protocol.Bet) error {
+	if s.file == nil {
+		file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		s.file = file
+	}
+
+	writer := csv.NewWriter(s.file)
+	for _, bet := range bets {
+		record := []string{
+			strconv.Itoa(agency),
+			bet.FirstName,
+			bet.LastName,
+			bet.Document,
+			bet.Birthdate.Format(protocol.BirthdateLayout),
+			strconv.Itoa(bet.Number),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
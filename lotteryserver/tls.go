@@ -0,0 +1,61 @@
+package lotteryserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// TLSFiles are the files and settings the server needs to accept TLS
+// connections, optionally verifying the certificates of the clients.
+type TLSFiles struct {
+	CertFile          string // server certificate
+	KeyFile           string // private key of the server certificate
+	ClientCAFile      string // CA bundle client certificates must be signed by, empty to not ask for them
+	RequireClientCert bool   // reject clients without a certificate signed by ClientCAFile
+	MinVersion        string // oldest TLS version accepted, "1.2" or "1.3", 1.2 when empty
+}
+
+// Config builds the TLS configuration of the server.
+func (f TLSFiles) Config() (*tls.Config, error) {
+	minVersion, err := protocol.ParseTLSVersion(f.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	if f.CertFile == "" || f.KeyFile == "" {
+		return nil, errors.New("the TLS server certificate and key are required")
+	}
+	certificate, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS server certificate: %w", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: minVersion}
+
+	if f.ClientCAFile == "" {
+		if f.RequireClientCert {
+			return nil, errors.New("requiring client certificates needs the CA bundle that signs them")
+		}
+		return config, nil
+	}
+	if config.ClientCAs, err = protocol.LoadCertPool(f.ClientCAFile); err != nil {
+		return nil, fmt.Errorf("load TLS client CA bundle: %w", err)
+	}
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if f.RequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// tlsVersionName returns the name of a TLS version, as in the MinVersion setting.
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
@@ -0,0 +1,178 @@
+package lotteryserver_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/lottery"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/lotteryserver"
+)
+
+// certs are the PEM files of a throwaway CA and the server and client
+// certificates it signs.
+type certs struct {
+	ca, serverCert, serverKey, clientCert, clientKey string
+}
+
+// newCerts writes a new CA, a server certificate for 127.0.0.1 and a client
+// certificate to a temporary directory.
+func newCerts(t *testing.T) certs {
+	t.Helper()
+	dir := t.TempDir()
+	ca, caKey := issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "lottery test CA"},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+	server, serverKey := issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	client, clientKey := issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "agency"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	return certs{
+		ca:         writePEM(t, dir, "ca.pem", "CERTIFICATE", ca.Raw),
+		serverCert: writePEM(t, dir, "server.pem", "CERTIFICATE", server.Raw),
+		serverKey:  writePEM(t, dir, "server-key.pem", "EC PRIVATE KEY", marshalKey(t, serverKey)),
+		clientCert: writePEM(t, dir, "client.pem", "CERTIFICATE", client.Raw),
+		clientKey:  writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", marshalKey(t, clientKey)),
+	}
+}
+
+// issue creates a certificate from template, signed by parent or self-signed
+// when parent is nil.
+func issue(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func marshalKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// writePEM stores a PEM block in dir/name and returns its path.
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// startTLSServer runs a server that requires client certificates signed by
+// the CA of c, and accepts TLS minVersion and later.
+func startTLSServer(t *testing.T, c certs, minVersion string) *lotteryserver.Server {
+	t.Helper()
+	config, err := lotteryserver.TLSFiles{
+		CertFile:          c.serverCert,
+		KeyFile:           c.serverKey,
+		ClientCAFile:      c.ca,
+		RequireClientCert: true,
+		MinVersion:        minVersion,
+	}.Config()
+	if err != nil {
+		t.Fatalf("server TLSFiles.Config() = %v", err)
+	}
+	return startServer(t, lotteryserver.Config{ExpectedAgencies: 1, TLS: config})
+}
+
+// clientTLS builds the TLS configuration of a client trusting the server CA
+// of server and presenting the client certificate of client.
+func clientTLS(t *testing.T, server certs, client certs) *tls.Config {
+	t.Helper()
+	config, err := common.TLSFiles{CAFile: server.ca, CertFile: client.clientCert, KeyFile: client.clientKey}.Config()
+	if err != nil {
+		t.Fatalf("client TLSFiles.Config() = %v", err)
+	}
+	return config
+}
+
+func TestMutualTLS(t *testing.T) {
+	c := newCerts(t)
+	server := startTLSServer(t, c, "1.2")
+	client := newClient(t, server, "1", lottery.WithTLS(clientTLS(t, c, c)))
+
+	ack, err := client.SubmitFrom(testContext(t), strings.NewReader(bet("1", 1)+"\n"+bet("2", 2)+"\n"))
+	if err != nil || ack.Stored != 2 {
+		t.Fatalf("SubmitFrom() = %+v, %v, want 2 bets stored", ack, err)
+	}
+	if n := server.Store().Len(); n != 2 {
+		t.Errorf("stored bets = %d, want 2", n)
+	}
+}
+
+func TestTLSRejectsUntrustedClientCert(t *testing.T) {
+	c := newCerts(t)
+	server := startTLSServer(t, c, "1.2")
+	foreign := newCerts(t)
+	client := newClient(t, server, "1", lottery.WithTLS(clientTLS(t, c, foreign)))
+
+	_, err := client.SubmitFrom(testContext(t), strings.NewReader(bet("1", 1)+"\n"))
+	if !errors.Is(err, lottery.ErrTLS) {
+		t.Errorf("SubmitFrom() = %v, want %v", err, lottery.ErrTLS)
+	}
+	if n := server.Store().Len(); n != 0 {
+		t.Errorf("stored bets = %d, want 0", n)
+	}
+}
+
+func TestTLSRejectsOlderVersion(t *testing.T) {
+	c := newCerts(t)
+	server := startTLSServer(t, c, "1.3")
+	config := clientTLS(t, c, c)
+	config.MaxVersion = tls.VersionTLS12
+	client := newClient(t, server, "1", lottery.WithTLS(config))
+
+	_, err := client.SubmitFrom(testContext(t), strings.NewReader(bet("1", 1)+"\n"))
+	if !errors.Is(err, lottery.ErrTLS) {
+		t.Errorf("SubmitFrom() = %v, want %v", err, lottery.ErrTLS)
+	}
+	if n := server.Store().Len(); n != 0 {
+		t.Errorf("stored bets = %d, want 0", n)
+	}
+}